@@ -0,0 +1,736 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrUsage is returned by the admin commands when they are given the wrong
+// arguments
+var ErrUsage = errors.New("usage: netcore [flags] zone|host|lease|reservation|record list|create|update|delete [arguments]")
+
+// ErrExists is returned when creating something that already exists
+var ErrExists = errors.New("already exists")
+
+// InvalidError is returned by the admin operations when they are asked to
+// store something that doesn't pass validation. Nothing is written when one is
+// returned.
+type InvalidError struct {
+	Err error
+}
+
+func (e InvalidError) Error() string {
+	return e.Err.Error()
+}
+
+// adminUsage describes the arguments of every admin command
+const adminUsage = `netcore [flags] <command> <action> [arguments]
+
+  zone list
+  zone create <zone> subnet=<cidr> gateway=<ip> [<setting>=<value> ...]
+  zone update <zone> <setting>=<value> ...     (an empty value removes the setting)
+  zone delete <zone>
+
+  host list
+  host create <host> zone=<zone> [<setting>=<value> ...]
+  host update <host> <setting>=<value> ...     (an empty value removes the setting)
+  host delete <host>
+
+  lease list
+  lease create <mac> <ip> [<duration>]
+  lease update <mac> <duration>
+  lease delete <mac>
+
+  reservation list
+  reservation create <mac> <ip>
+  reservation update <mac> <ip>
+  reservation delete <mac>
+
+  record list [<name>]
+  record create <name> <type> <value> [ttl=<seconds>] [<attribute>=<value> ...]
+  record update <name> <type> <old value> <new value> [ttl=<seconds>] [<attribute>=<value> ...]
+  record delete <name> <type> [<value>]
+`
+
+// adminCheckHost is the made up host used to check a zone's settings when no
+// real host has been assigned to it
+const adminCheckHost = "@check"
+
+// defaultAdminLeaseDuration is used for leases created without a duration
+const defaultAdminLeaseDuration = 12 * time.Hour
+
+// runAdmin carries out the admin command given by args, such as
+// "zone list" or "record delete www.example.com A", writing any output to w
+func runAdmin(db DB, args []string, w io.Writer) error {
+	if len(args) < 2 {
+		return ErrUsage
+	}
+	command, action, args := args[0], args[1], args[2:]
+	switch command {
+	case "zone", "host":
+		return adminConfigCommand(db, w, command, action, args)
+	case "lease":
+		return adminLeaseCommand(db, w, false, action, args)
+	case "reservation":
+		return adminLeaseCommand(db, w, true, action, args)
+	case "record":
+		return adminRecordCommand(db, w, action, args)
+	}
+	return ErrUsage
+}
+
+// adminMain runs the admin command given on the command line and returns the
+// exit status
+func adminMain(db DB, args []string) int {
+	err := runAdmin(db, args, os.Stdout)
+	if err == ErrUsage {
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "netcore: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func adminConfigCommand(db DB, w io.Writer, kind string, action string, args []string) error {
+	if action == "list" {
+		if len(args) != 0 {
+			return ErrUsage
+		}
+		objects, err := listConfigObjects(db, kind)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for name := range objects {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, name := range names {
+			var settings []string
+			for setting, value := range objects[name] {
+				settings = append(settings, setting+"="+value)
+			}
+			sort.Strings(settings)
+			fmt.Fprintf(tw, "%s\t%s\n", name, strings.Join(settings, " "))
+		}
+		return tw.Flush()
+	}
+
+	if len(args) < 1 {
+		return ErrUsage
+	}
+	changes, err := parseAssignments(args[1:])
+	if err != nil {
+		return err
+	}
+	if (action == "update" && len(changes) == 0) || (action == "delete" && len(changes) != 0) {
+		return ErrUsage
+	}
+	err = changeConfigObject(db, kind, action, args[0], changes)
+	if err == ErrNotFound || err == ErrExists {
+		return fmt.Errorf("%s %s: %s", kind, args[0], err)
+	}
+	return err
+}
+
+func adminLeaseCommand(db DB, w io.Writer, reservation bool, action string, args []string) error {
+	switch action {
+	case "list":
+		if len(args) != 0 {
+			return ErrUsage
+		}
+		leases, err := listLeases(db, reservation)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, lease := range leases {
+			if reservation {
+				fmt.Fprintf(tw, "%s\t%s\n", lease.MAC, lease.IP)
+			} else {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", lease.MAC, lease.IP, lease.Duration)
+			}
+		}
+		return tw.Flush()
+	case "create", "update", "delete":
+	default:
+		return ErrUsage
+	}
+
+	if len(args) < 1 {
+		return ErrUsage
+	}
+	mac, err := net.ParseMAC(args[0])
+	if err != nil {
+		return err
+	}
+	switch {
+	case action == "create" && reservation && len(args) == 2:
+		err = createLease(db, mac, net.ParseIP(args[1]), 0)
+	case action == "create" && !reservation && (len(args) == 2 || len(args) == 3):
+		duration := defaultAdminLeaseDuration
+		if len(args) == 3 {
+			if duration, err = time.ParseDuration(args[2]); err != nil {
+				return err
+			}
+		}
+		err = createLease(db, mac, net.ParseIP(args[1]), duration)
+	case action == "update" && reservation && len(args) == 2:
+		err = moveReservation(db, mac, net.ParseIP(args[1]))
+	case action == "update" && !reservation && len(args) == 2:
+		var duration time.Duration
+		if duration, err = time.ParseDuration(args[1]); err != nil {
+			return err
+		}
+		err = renewLease(db, mac, duration)
+	case action == "delete" && len(args) == 1:
+		err = deleteLease(db, mac, reservation)
+	default:
+		return ErrUsage
+	}
+	if err == ErrNotFound {
+		return fmt.Errorf("%s: %s", mac, err)
+	}
+	return err
+}
+
+func adminRecordCommand(db DB, w io.Writer, action string, args []string) error {
+	// options splits trailing arguments into the TTL and attributes
+	options := func(args []string) (uint32, map[string]string, error) {
+		attrs, err := parseAssignments(args)
+		if err != nil {
+			return 0, nil, err
+		}
+		var ttl uint32
+		if value, ok := attrs["ttl"]; ok {
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return 0, nil, fmt.Errorf("ttl %q: %s", value, err)
+			}
+			ttl = uint32(n)
+			delete(attrs, "ttl")
+		}
+		return ttl, attrs, nil
+	}
+
+	switch action {
+	case "list":
+		if len(args) > 1 {
+			return ErrUsage
+		}
+		name := ""
+		if len(args) == 1 {
+			name = args[0]
+		}
+		records, err := db.ListDNS(name)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, record := range records {
+			for _, value := range record.Entry.Values {
+				var attrs []string
+				for attr, attrValue := range value.Attr {
+					attrs = append(attrs, attr+"="+attrValue)
+				}
+				sort.Strings(attrs)
+				expires := ""
+				if value.Expiration != nil {
+					expires = "expires " + value.Expiration.Format(time.RFC3339)
+				}
+				fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", record.Name, record.Entry.TTL, record.Type, value.Value, strings.Join(attrs, " "), expires)
+			}
+		}
+		return tw.Flush()
+
+	case "create":
+		if len(args) < 3 {
+			return ErrUsage
+		}
+		ttl, attrs, err := options(args[3:])
+		if err != nil {
+			return err
+		}
+		return registerRecord(db, args[0], args[1], args[2], ttl, attrs)
+
+	case "update":
+		if len(args) < 4 {
+			return ErrUsage
+		}
+		ttl, attrs, err := options(args[4:])
+		if err != nil {
+			return err
+		}
+		err = updateRecord(db, args[0], args[1], args[2], args[3], ttl, attrs)
+		if err == ErrNotFound {
+			return fmt.Errorf("%s %s %s: %s", args[0], strings.ToUpper(args[1]), args[2], err)
+		}
+		return err
+
+	case "delete":
+		if len(args) < 2 || len(args) > 3 {
+			return ErrUsage
+		}
+		value := ""
+		if len(args) == 3 {
+			value = args[2]
+		}
+		err := unregisterRecord(db, args[0], args[1], value)
+		if err == ErrNotFound {
+			return fmt.Errorf("%s %s: %s", args[0], strings.ToUpper(args[1]), err)
+		}
+		return err
+	}
+	return ErrUsage
+}
+
+// configObjects groups every config value by the zone or host it belongs to,
+// and says which of them are hosts (those with a zone assigned)
+func configObjects(store configStore) (objects map[string]map[string]string, hosts map[string]bool, err error) {
+	values, err := store.listConfigValues()
+	if err != nil {
+		return nil, nil, err
+	}
+	objects = make(map[string]map[string]string)
+	hosts = make(map[string]bool)
+	for key, value := range values {
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if objects[parts[0]] == nil {
+			objects[parts[0]] = make(map[string]string)
+		}
+		objects[parts[0]][parts[1]] = value
+		if parts[1] == "zone" && parts[0] != configGlobal {
+			hosts[parts[0]] = true
+		}
+	}
+	return objects, hosts, nil
+}
+
+// listConfigObjects returns the settings of every zone or every host, by
+// name, or of the global level (under its own name) if kind is "global"
+func listConfigObjects(db DB, kind string) (map[string]map[string]string, error) {
+	store, ok := db.(configStore)
+	if !ok {
+		return nil, errors.New("this backend can't manage config")
+	}
+	objects, hosts, err := configObjects(store)
+	if err != nil {
+		return nil, err
+	}
+	for name := range objects {
+		if (kind == "global") != (name == configGlobal) || (kind != "global" && hosts[name] != (kind == "host")) {
+			delete(objects, name)
+		}
+	}
+	return objects, nil
+}
+
+// changeConfigObject creates, updates or deletes the named zone or host, or
+// updates the global level if kind is "global". Every change is validated, and
+// the resulting config of every host affected is checked, before anything is
+// written. An empty value in changes removes that setting.
+func changeConfigObject(db DB, kind string, action string, name string, changes map[string]string) error {
+	store, ok := db.(configStore)
+	if !ok {
+		return errors.New("this backend can't manage config")
+	}
+	objects, hosts, err := configObjects(store)
+	if err != nil {
+		return err
+	}
+	if kind == "global" {
+		name = configGlobal
+	} else if name == "" || strings.ContainsAny(name, "/ ") || strings.HasPrefix(name, "@") {
+		return InvalidError{fmt.Errorf("%q is not a valid %s name", name, kind)}
+	}
+	_, exists := objects[name]
+	isKind := exists && (kind == "global" || hosts[name] == (kind == "host"))
+
+	switch {
+	case action == "create" && kind != "global":
+		if exists {
+			return ErrExists
+		}
+		if kind == "zone" && (changes["subnet"] == "" || changes["gateway"] == "") {
+			return InvalidError{errors.New("a zone needs a subnet and a gateway")}
+		}
+		if kind == "host" && changes["zone"] == "" {
+			return InvalidError{errors.New("a host needs a zone")}
+		}
+	case action == "update":
+		if !isKind && kind != "global" {
+			return ErrNotFound
+		}
+	case action == "delete" && kind != "global":
+		if !isKind {
+			return ErrNotFound
+		}
+		if kind == "zone" {
+			for host := range hosts {
+				if objects[host]["zone"] == name {
+					return InvalidError{fmt.Errorf("zone %s still has host %s assigned to it", name, host)}
+				}
+			}
+		}
+		changes = make(map[string]string)
+		for setting := range objects[name] {
+			changes[setting] = ""
+		}
+	default:
+		return ErrUsage
+	}
+
+	for setting, value := range changes {
+		if kind == "zone" && setting == "zone" {
+			return InvalidError{errors.New("the zone can only be set for a host or globally")}
+		}
+		if err := validateSetting(setting, value); err != nil {
+			return InvalidError{err}
+		}
+	}
+
+	// Check the result as a whole before writing anything
+	if action != "delete" {
+		pending := pendingConfig{store: store, changes: make(map[string]string)}
+		for setting, value := range changes {
+			pending.changes[name+"/"+setting] = value
+		}
+		var checkHosts []string
+		switch kind {
+		case "host":
+			checkHosts = []string{name}
+		case "zone":
+			pending.changes[adminCheckHost+"/zone"] = name
+			checkHosts = []string{adminCheckHost}
+			for host := range hosts {
+				if objects[host]["zone"] == name {
+					checkHosts = append(checkHosts, host)
+				}
+			}
+		case "global":
+			for host := range hosts {
+				checkHosts = append(checkHosts, host)
+			}
+		}
+		for _, host := range checkHosts {
+			if _, err := loadHostConfig(db, pending, host); err != nil {
+				return InvalidError{err}
+			}
+		}
+	}
+
+	var settings []string
+	for setting := range changes {
+		settings = append(settings, setting)
+	}
+	sort.Strings(settings)
+	for _, setting := range settings {
+		key := name + "/" + setting
+		if changes[setting] == "" {
+			err = store.deleteConfigValue(key)
+			if err == ErrNotFound {
+				err = nil
+			}
+		} else {
+			err = store.setConfigValue(key, changes[setting])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingConfig is a configStore that shows changes on top of store without
+// writing them, so that they can be checked first. An empty value stands for a
+// setting being removed.
+type pendingConfig struct {
+	store   configStore
+	changes map[string]string
+}
+
+func (p pendingConfig) getConfigValue(key string) (string, bool, error) {
+	if value, ok := p.changes[key]; ok {
+		return value, value != "", nil
+	}
+	return p.store.getConfigValue(key)
+}
+
+func (p pendingConfig) setConfigValue(key string, value string) error {
+	p.changes[key] = value
+	return nil
+}
+
+func (p pendingConfig) deleteConfigValue(key string) error {
+	p.changes[key] = ""
+	return nil
+}
+
+func (p pendingConfig) listConfigValues() (map[string]string, error) {
+	values, err := p.store.listConfigValues()
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range p.changes {
+		if value == "" {
+			delete(values, key)
+		} else {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// validateSetting checks a single config value on its own. An empty value is
+// always acceptable because it removes the setting.
+func validateSetting(name string, value string) error {
+	if value == "" {
+		return nil
+	}
+	var err error
+	switch name {
+	case "zone":
+		if strings.ContainsAny(value, "/ ") || strings.HasPrefix(value, "@") {
+			err = errors.New("not a valid zone name")
+		}
+	case "domain":
+		if _, ok := dns.IsDomainName(value); !ok {
+			err = errors.New("not a valid domain name")
+		}
+	case "subnet", "dhcpsubnet":
+		_, _, err = net.ParseCIDR(value)
+	case "gateway", "dhcpip":
+		if net.ParseIP(value).To4() == nil {
+			err = errors.New("not an IPv4 address")
+		}
+	case "dhcpleaseduration", "dnscachemaxttl", "dnscachemissingttl", "dhcppoolwarn", "dhcppoolcritical":
+		var n int
+		n, err = strconv.Atoi(value)
+		if err == nil && n < 0 {
+			err = errors.New("negative")
+		}
+	case "loglevel":
+		_, err = parseLogLevels(value)
+	case "dnstsigkeys":
+		_, err = parseTSIGKeys(value)
+	case "dnssecondaries":
+		_, err = parseDNSSecondaries(value)
+	case "dhcpnic", "dhcptftp", "dnsforwarders", "alertsmtp", "alertfrom", "alertto":
+		// Checked along with everything else
+	default:
+		return fmt.Errorf("unknown setting %q", name)
+	}
+	if err != nil {
+		return ConfigError{name, fmt.Errorf("%q: %s", value, err)}
+	}
+	return nil
+}
+
+// parseAssignments turns arguments such as "ttl=60" into a map
+func parseAssignments(args []string) (map[string]string, error) {
+	assignments := make(map[string]string)
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("expected <name>=<value>, got %q", arg)
+		}
+		assignments[parts[0]] = parts[1]
+	}
+	return assignments, nil
+}
+
+// checkLeaseIP returns an InvalidError unless ip is an IPv4 address within the
+// subnet of one of the zones
+func checkLeaseIP(db DB, ip net.IP) error {
+	if ip.To4() == nil {
+		return InvalidError{fmt.Errorf("%s is not an IPv4 address", ip)}
+	}
+	zones, err := listConfigObjects(db, "zone")
+	if err != nil {
+		return err
+	}
+	for _, settings := range zones {
+		if _, subnet, err := net.ParseCIDR(settings["subnet"]); err == nil && subnet.Contains(ip) {
+			return nil
+		}
+	}
+	return InvalidError{fmt.Errorf("%s is not in the subnet of any zone", ip)}
+}
+
+// listLeases returns every reservation, or every lease that isn't one
+func listLeases(db DB, reservations bool) ([]*MACEntry, error) {
+	leases, err := db.ListLeases()
+	if err != nil {
+		return nil, err
+	}
+	var listed []*MACEntry
+	for _, lease := range leases {
+		if lease.Reserved() == reservations {
+			listed = append(listed, lease)
+		}
+	}
+	return listed, nil
+}
+
+// currentLease returns the lease held by mac, or the reservation if reserved
+func currentLease(db DB, mac net.HardwareAddr, reserved bool) (*MACEntry, error) {
+	entry, found, err := db.GetMAC(mac, false)
+	if err != nil {
+		return nil, err
+	}
+	if !found || entry.IP == nil || entry.Reserved() != reserved {
+		return nil, ErrNotFound
+	}
+	return entry, nil
+}
+
+// createLease leases ip to mac for the given duration, or reserves it for mac
+// if the duration is zero
+func createLease(db DB, mac net.HardwareAddr, ip net.IP, duration time.Duration) error {
+	if err := checkLeaseIP(db, ip); err != nil {
+		return err
+	}
+	if duration != 0 && duration < minimumLeaseDuration {
+		return InvalidError{fmt.Errorf("%s is shorter than the minimum of %s", duration, minimumLeaseDuration)}
+	}
+	entry, found, err := db.GetMAC(mac, false)
+	if err != nil {
+		return err
+	}
+	if found && entry.IP != nil {
+		return InvalidError{fmt.Errorf("%s already holds %s", mac, entry.IP)}
+	}
+	return db.CreateLease(&MACEntry{MAC: mac, IP: ip.To4(), Duration: duration})
+}
+
+// renewLease sets the remaining duration of the lease held by mac
+func renewLease(db DB, mac net.HardwareAddr, duration time.Duration) error {
+	if duration < minimumLeaseDuration {
+		return InvalidError{fmt.Errorf("%s is shorter than the minimum of %s", duration, minimumLeaseDuration)}
+	}
+	entry, err := currentLease(db, mac, false)
+	if err != nil {
+		return err
+	}
+	entry.Duration = duration
+	return db.RenewLease(entry)
+}
+
+// moveReservation reserves ip for mac in place of the address it has reserved
+func moveReservation(db DB, mac net.HardwareAddr, ip net.IP) error {
+	if err := checkLeaseIP(db, ip); err != nil {
+		return err
+	}
+	entry, err := currentLease(db, mac, true)
+	if err != nil {
+		return err
+	}
+	if err := db.DeleteLease(mac); err != nil {
+		return err
+	}
+	err = db.CreateLease(&MACEntry{MAC: mac, IP: ip.To4()})
+	if err != nil {
+		// Put the old reservation back rather than leave the MAC with nothing
+		if restoreErr := db.CreateLease(&MACEntry{MAC: mac, IP: entry.IP}); restoreErr != nil {
+			return fmt.Errorf("%s (and restoring %s failed: %s)", err, entry.IP, restoreErr)
+		}
+	}
+	return err
+}
+
+// deleteLease releases the lease held by mac, or the reservation if reserved
+func deleteLease(db DB, mac net.HardwareAddr, reserved bool) error {
+	if _, err := currentLease(db, mac, reserved); err != nil {
+		return err
+	}
+	return db.DeleteLease(mac)
+}
+
+// registerRecord permanently stores a DNS value, along with its PTR record if
+// it is an address
+func registerRecord(db DB, name string, rrType string, value string, ttl uint32, attrs map[string]string) error {
+	rrType = strings.ToUpper(rrType)
+	if err := validateDNSValue(rrType, value, attrs); err != nil {
+		return InvalidError{err}
+	}
+	switch rrType {
+	case "A", "AAAA":
+		if len(attrs) > 0 {
+			return InvalidError{fmt.Errorf("%s records don't have attributes", rrType)}
+		}
+		return registerAddress(db, rrType, name, net.ParseIP(value), false, ttl, 0)
+	}
+	return db.Register(name, rrType, value, attrs, ttl, 0)
+}
+
+// updateRecord replaces one DNS value with another
+func updateRecord(db DB, name string, rrType string, oldValue string, value string, ttl uint32, attrs map[string]string) error {
+	entry, err := db.GetDNS(name, rrType)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, v := range entry.Values {
+		found = found || v.Value == oldValue
+	}
+	if !found {
+		return ErrNotFound
+	}
+	if err := registerRecord(db, name, rrType, value, ttl, attrs); err != nil {
+		return err
+	}
+	if value == oldValue {
+		return nil // updated in place
+	}
+	return unregisterRecord(db, name, rrType, oldValue)
+}
+
+// unregisterRecord removes one DNS value, or every value if value is empty,
+// along with the PTR record of any address removed
+func unregisterRecord(db DB, name string, rrType string, value string) error {
+	rrType = strings.ToUpper(rrType)
+	if value == "" && (rrType == "A" || rrType == "AAAA") {
+		// Take each address's PTR record with it
+		entry, err := db.GetDNS(name, rrType)
+		if err != nil {
+			return err
+		}
+		for _, v := range entry.Values {
+			if err := unregisterRecord(db, name, rrType, v.Value); err != nil {
+				return err
+			}
+		}
+		err = db.Unregister(name, rrType, "")
+		if err == ErrNotFound {
+			return nil // the TTL and any metadata went with the last value
+		}
+		return err
+	}
+	if err := db.Unregister(name, rrType, value); err != nil {
+		return err
+	}
+	if ip := net.ParseIP(value); ip != nil && (rrType == "A" || rrType == "AAAA") {
+		err := db.Unregister(arpaNameFromIP(ip), "PTR", cleanFQDN(name))
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
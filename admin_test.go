@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func runAdminCommand(t *testing.T, db DB, command string) (string, error) {
+	var out bytes.Buffer
+	err := runAdmin(db, strings.Fields(command), &out)
+	return out.String(), err
+}
+
+func TestAdminZonesAndHosts(t *testing.T) {
+	db := NewMemDB()
+
+	for _, command := range []string{
+		"zone create office subnet=10.0.0.0/24 gateway=10.0.0.1",
+		"zone create office subnet=10.0.1.0/24 gateway=10.0.1.1",       // already exists
+		"zone create branch subnet=10.1.0.0/24 gateway=10.2.0.1",       // gateway outside the subnet
+		"zone create branch subnet=10.1.0.0/24 gateway=10.1.0.1 ttl=5", // unknown setting
+		"host create core1 zone=office dhcpip=10.0.0.2 dhcpnic=eth0",
+		"host create core2 zone=nowhere",
+		"zone update office dhcpsubnet=10.0.0.0/25", // includes the gateway and core1's DHCP IP
+		"zone update office dhcpsubnet=10.0.0.128/25",
+	} {
+		runAdminCommand(t, db, command)
+	}
+
+	out, err := runAdminCommand(t, db, "zone list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "office  dhcpsubnet=10.0.0.128/25 gateway=10.0.0.1 subnet=10.0.0.0/24\n" {
+		t.Errorf("unexpected zones:\n%s", out)
+	}
+	out, _ = runAdminCommand(t, db, "host list")
+	if out != "core1  dhcpip=10.0.0.2 dhcpnic=eth0 zone=office\n" {
+		t.Errorf("unexpected hosts:\n%s", out)
+	}
+
+	if _, err := runAdminCommand(t, db, "zone delete office"); err == nil {
+		t.Error("expected a zone with hosts to be kept")
+	}
+	if _, err := runAdminCommand(t, db, "host update core1 dhcpnic="); err != nil {
+		t.Error(err)
+	}
+	if _, found, _ := db.getConfigValue("core1/dhcpnic"); found {
+		t.Error("expected an empty value to remove the setting")
+	}
+	for _, command := range []string{"host delete core1", "zone delete office"} {
+		if _, err := runAdminCommand(t, db, command); err != nil {
+			t.Errorf("%s: %s", command, err)
+		}
+	}
+	if values, _ := db.listConfigValues(); len(values) != 0 {
+		t.Errorf("expected everything to be deleted, got %v", values)
+	}
+}
+
+func TestAdminLeasesAndReservations(t *testing.T) {
+	db := NewMemDB()
+	runAdminCommand(t, db, "zone create office subnet=10.0.0.0/24 gateway=10.0.0.1")
+
+	if _, err := runAdminCommand(t, db, "reservation create 00:11:22:33:44:55 192.168.0.10"); err == nil {
+		t.Error("expected a reservation outside every zone to be refused")
+	}
+	for _, command := range []string{
+		"reservation create 00:11:22:33:44:55 10.0.0.10",
+		"lease create 00:11:22:33:44:66 10.0.0.130 1h",
+		"reservation update 00:11:22:33:44:55 10.0.0.11",
+	} {
+		if _, err := runAdminCommand(t, db, command); err != nil {
+			t.Fatalf("%s: %s", command, err)
+		}
+	}
+	if _, err := runAdminCommand(t, db, "lease create 00:11:22:33:44:77 10.0.0.11"); err == nil {
+		t.Error("expected a lease on a reserved address to be refused")
+	}
+
+	out, _ := runAdminCommand(t, db, "reservation list")
+	if out != "00:11:22:33:44:55  10.0.0.11\n" {
+		t.Errorf("unexpected reservations:\n%s", out)
+	}
+	out, _ = runAdminCommand(t, db, "lease list")
+	if out != "00:11:22:33:44:66  10.0.0.130  1h0m0s\n" {
+		t.Errorf("unexpected leases:\n%s", out)
+	}
+
+	for _, command := range []string{
+		"lease update 00:11:22:33:44:66 1s", // too short
+		"lease update 00:11:22:33:44:99 2h", // no such lease
+		"lease update 00:11:22:33:44:55 2h", // a reservation
+	} {
+		if _, err := runAdminCommand(t, db, command); err == nil {
+			t.Errorf("%s: expected an error", command)
+		}
+	}
+	if _, err := runAdminCommand(t, db, "lease update 00:11:22:33:44:66 2h"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := runAdminCommand(t, db, "reservation delete 00:11:22:33:44:66"); err == nil {
+		t.Error("expected deleting a lease as a reservation to fail")
+	}
+	if _, err := runAdminCommand(t, db, "lease delete 00:11:22:33:44:66"); err != nil {
+		t.Fatal(err)
+	}
+	if db.HasIP(net.ParseIP("10.0.0.130")) || db.HasIP(net.ParseIP("10.0.0.10")) {
+		t.Error("expected the released addresses to be free")
+	}
+}
+
+func TestAdminRecords(t *testing.T) {
+	db := NewMemDB()
+	db.owner = ""
+
+	for _, command := range []string{
+		"record create host.example.com A 10.0.0.10 ttl=300",
+		"record create example.com MX mail.example.com priority=10",
+		"record update host.example.com A 10.0.0.10 10.0.0.11",
+	} {
+		if _, err := runAdminCommand(t, db, command); err != nil {
+			t.Fatalf("%s: %s", command, err)
+		}
+	}
+	if _, err := runAdminCommand(t, db, "record create example.com MX mail.example.com priority=high"); err == nil {
+		t.Error("expected an MX record with a bad priority to be refused")
+	}
+
+	out, _ := runAdminCommand(t, db, "record list example.com")
+	if out != "example.com       0    MX  mail.example.com  priority=10  \nhost.example.com  300  A   10.0.0.11                      \n" {
+		t.Errorf("unexpected records:\n%q", out)
+	}
+	if _, err := db.GetDNS("10.0.0.10.in-addr.arpa", "PTR"); err != ErrNotFound {
+		t.Errorf("expected the old PTR record to be removed, got %v", err)
+	}
+
+	if _, err := runAdminCommand(t, db, "record delete host.example.com A"); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ := db.ListDNS(""); len(records) != 1 {
+		t.Errorf("expected only the MX record to be left, got %+v", records)
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var apiAddr = flag.String("api", "", "Address to serve the HTTP management API on, such as \":8053\" (or empty to disable it).")
+var apiToken = flag.String("apiToken", "", "Bearer token that management API requests must present (defaults to the NETCORE_API_TOKEN environment variable).")
+
+// apiPrefix is the path that every API endpoint lives under. Anything that
+// changes the meaning of an existing endpoint belongs under a new version.
+const apiPrefix = "/api/v1/"
+
+// ErrNoAPIToken is returned when the API is enabled without a token to protect it
+var ErrNoAPIToken = errors.New("The management API requires a token (see -apiToken).")
+
+var errMethodNotAllowed = errors.New("method not allowed")
+var errUnauthorized = errors.New("unauthorized")
+
+// apiServer serves the HTTP/JSON management API. Every request has to carry
+// the token as "Authorization: Bearer <token>".
+type apiServer struct {
+	cfg   *Config
+	token string
+}
+
+// apiLease is a lease or reservation as the API shows it. Duration is the
+// remaining time in seconds, and is left out for reservations.
+type apiLease struct {
+	MAC      string `json:"mac"`
+	IP       string `json:"ip"`
+	Duration int64  `json:"duration,omitempty"`
+}
+
+// apiRecord is a single DNS value as the API shows it
+type apiRecord struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	TTL     uint32            `json:"ttl,omitempty"`
+	Value   string            `json:"value"`
+	Attr    map[string]string `json:"attr,omitempty"`
+	Expires *time.Time        `json:"expires,omitempty"`
+}
+
+// apiWake names the machine to wake, by exactly one of its MAC address, IP
+// address or hostname
+type apiWake struct {
+	MAC  string `json:"mac"`
+	IP   string `json:"ip"`
+	Name string `json:"name"`
+}
+
+func apiSetup(cfg *Config, addr string, token string) (service, error) {
+	if token == "" {
+		token = os.Getenv("NETCORE_API_TOKEN")
+	}
+	if token == "" {
+		return service{}, ErrNoAPIToken
+	}
+	return httpService("api", addr, apiServer{cfg: cfg, token: token}), nil
+}
+
+func (s apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, errUnauthorized)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) {
+		writeAPIError(w, ErrNotFound)
+		return
+	}
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+
+	var err error
+	switch path[0] {
+	case "zones":
+		err = s.serveConfigObjects(w, r, "zone", path[1:])
+	case "hosts":
+		err = s.serveConfigObjects(w, r, "host", path[1:])
+	case "config":
+		err = s.serveConfig(w, r, path[1:])
+	case "leases":
+		err = s.serveLeases(w, r, false, path[1:])
+	case "reservations":
+		err = s.serveLeases(w, r, true, path[1:])
+	case "records":
+		err = s.serveRecords(w, r, path[1:])
+	case "wol":
+		err = s.serveWOL(w, r, path[1:])
+	default:
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeAPIError(w, err)
+	}
+}
+
+// serveConfigObjects handles /zones and /hosts. PUT creates the named zone or
+// host if it doesn't exist yet, or otherwise changes just the settings given,
+// where an empty value removes a setting.
+func (s apiServer) serveConfigObjects(w http.ResponseWriter, r *http.Request, kind string, path []string) error {
+	if len(path) > 1 {
+		return ErrNotFound
+	}
+	objects, err := listConfigObjects(s.cfg.db, kind)
+	if err != nil {
+		return err
+	}
+	if len(path) == 0 {
+		if r.Method != "GET" {
+			return errMethodNotAllowed
+		}
+		return writeAPIResponse(w, http.StatusOK, objects)
+	}
+
+	name := path[0]
+	settings, exists := objects[name]
+	switch r.Method {
+	case "GET":
+		if !exists {
+			return ErrNotFound
+		}
+		return writeAPIResponse(w, http.StatusOK, settings)
+	case "PUT":
+		var changes map[string]string
+		if err := readAPIRequest(r, &changes); err != nil {
+			return err
+		}
+		action, status := "update", http.StatusOK
+		if !exists {
+			action, status = "create", http.StatusCreated
+		}
+		if err := changeConfigObject(s.cfg.db, kind, action, name, changes); err != nil {
+			return err
+		}
+		objects, err := listConfigObjects(s.cfg.db, kind)
+		if err != nil {
+			return err
+		}
+		return writeAPIResponse(w, status, objects[name])
+	case "DELETE":
+		if err := changeConfigObject(s.cfg.db, kind, "delete", name, nil); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return errMethodNotAllowed
+}
+
+// serveConfig handles /config, which shows the effective settings of this
+// server (or of the host given as ?host=) and where each came from, and
+// /config/global, which holds the settings every zone and host inherits
+func (s apiServer) serveConfig(w http.ResponseWriter, r *http.Request, path []string) error {
+	switch {
+	case len(path) == 0:
+		if r.Method != "GET" {
+			return errMethodNotAllowed
+		}
+		cfg := s.cfg
+		if host := r.URL.Query().Get("host"); host != "" {
+			store, ok := s.cfg.db.(configStore)
+			if !ok {
+				return errors.New("this backend can't manage config")
+			}
+			var err error
+			if cfg, err = loadHostConfig(s.cfg.db, store, host); err != nil {
+				if err == ErrNoZone {
+					return ErrNotFound
+				}
+				return err
+			}
+		}
+		return writeAPIResponse(w, http.StatusOK, cfg.Settings())
+
+	case len(path) == 1 && path[0] == "global":
+		switch r.Method {
+		case "GET":
+		case "PUT":
+			var changes map[string]string
+			if err := readAPIRequest(r, &changes); err != nil {
+				return err
+			}
+			if err := changeConfigObject(s.cfg.db, "global", "update", "", changes); err != nil {
+				return err
+			}
+		default:
+			return errMethodNotAllowed
+		}
+		objects, err := listConfigObjects(s.cfg.db, "global")
+		if err != nil {
+			return err
+		}
+		settings := objects[configGlobal]
+		if settings == nil {
+			settings = make(map[string]string)
+		}
+		return writeAPIResponse(w, http.StatusOK, settings)
+	}
+	return ErrNotFound
+}
+
+// serveLeases handles /leases and /reservations. Leases are created with a
+// POST of an apiLease and renewed with a PUT of their new duration, while
+// reservations are moved with a PUT of their new IP address.
+func (s apiServer) serveLeases(w http.ResponseWriter, r *http.Request, reservations bool, path []string) error {
+	db := s.cfg.db
+	if len(path) == 0 {
+		switch r.Method {
+		case "GET":
+			leases, err := listLeases(db, reservations)
+			if err != nil {
+				return err
+			}
+			list := make([]apiLease, 0, len(leases))
+			for _, lease := range leases {
+				list = append(list, newAPILease(lease))
+			}
+			return writeAPIResponse(w, http.StatusOK, list)
+		case "POST":
+			var lease apiLease
+			if err := readAPIRequest(r, &lease); err != nil {
+				return err
+			}
+			mac, err := net.ParseMAC(lease.MAC)
+			if err != nil {
+				return InvalidError{err}
+			}
+			duration := time.Duration(lease.Duration) * time.Second
+			if reservations {
+				duration = 0
+			} else if duration == 0 {
+				duration = defaultAdminLeaseDuration
+			}
+			if err := createLease(db, mac, net.ParseIP(lease.IP), duration); err != nil {
+				return err
+			}
+			return s.writeLease(w, http.StatusCreated, mac, reservations)
+		}
+		return errMethodNotAllowed
+	}
+	if len(path) > 1 {
+		return ErrNotFound
+	}
+
+	mac, err := net.ParseMAC(path[0])
+	if err != nil {
+		return ErrNotFound
+	}
+	switch r.Method {
+	case "GET":
+		return s.writeLease(w, http.StatusOK, mac, reservations)
+	case "PUT":
+		var lease apiLease
+		if err := readAPIRequest(r, &lease); err != nil {
+			return err
+		}
+		if reservations {
+			err = moveReservation(db, mac, net.ParseIP(lease.IP))
+		} else {
+			err = renewLease(db, mac, time.Duration(lease.Duration)*time.Second)
+		}
+		if err != nil {
+			return err
+		}
+		return s.writeLease(w, http.StatusOK, mac, reservations)
+	case "DELETE":
+		if err := deleteLease(db, mac, reservations); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return errMethodNotAllowed
+}
+
+func (s apiServer) writeLease(w http.ResponseWriter, status int, mac net.HardwareAddr, reserved bool) error {
+	lease, err := currentLease(s.cfg.db, mac, reserved)
+	if err != nil {
+		return err
+	}
+	return writeAPIResponse(w, status, newAPILease(lease))
+}
+
+func newAPILease(lease *MACEntry) apiLease {
+	return apiLease{
+		MAC:      lease.MAC.String(),
+		IP:       lease.IP.String(),
+		Duration: int64(lease.Duration / time.Second),
+	}
+}
+
+// serveRecords handles /records, which lists every DNS value (or those of
+// ?name=) and registers a value with a POST of an apiRecord, and
+// /records/<name>/<type>, which lists one record set. A PUT there replaces the
+// value given as ?value= with the one in the apiRecord sent, and a DELETE
+// removes the value given as ?value=, or the whole record set without it.
+func (s apiServer) serveRecords(w http.ResponseWriter, r *http.Request, path []string) error {
+	db := s.cfg.db
+	switch {
+	case len(path) == 0 && r.Method == "GET":
+		return s.writeRecords(w, r.URL.Query().Get("name"), "")
+	case len(path) == 0 && r.Method == "POST":
+		var record apiRecord
+		if err := readAPIRequest(r, &record); err != nil {
+			return err
+		}
+		if err := registerRecord(db, record.Name, record.Type, record.Value, record.TTL, record.Attr); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	case len(path) == 0:
+		return errMethodNotAllowed
+	case len(path) != 2:
+		return ErrNotFound
+	}
+
+	name, rrType, value := path[0], strings.ToUpper(path[1]), r.URL.Query().Get("value")
+	switch r.Method {
+	case "GET":
+		return s.writeRecords(w, name, rrType)
+	case "PUT":
+		var record apiRecord
+		if err := readAPIRequest(r, &record); err != nil {
+			return err
+		}
+		if value == "" {
+			return InvalidError{errors.New("the value to replace must be given as ?value=")}
+		}
+		if err := updateRecord(db, name, rrType, value, record.Value, record.TTL, record.Attr); err != nil {
+			return err
+		}
+		return s.writeRecords(w, name, rrType)
+	case "DELETE":
+		if err := unregisterRecord(db, name, rrType, value); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return errMethodNotAllowed
+}
+
+// writeRecords writes every DNS value of name (or of every name if it is
+// empty) and rrType (or of every type if it is empty)
+func (s apiServer) writeRecords(w http.ResponseWriter, name string, rrType string) error {
+	records, err := s.cfg.db.ListDNS(name)
+	if err != nil {
+		return err
+	}
+	list := []apiRecord{}
+	for _, record := range records {
+		if rrType != "" && record.Type != rrType {
+			continue
+		}
+		for _, value := range record.Entry.Values {
+			list = append(list, apiRecord{
+				Name:    record.Name,
+				Type:    record.Type,
+				TTL:     record.Entry.TTL,
+				Value:   value.Value,
+				Attr:    value.Attr,
+				Expires: value.Expiration,
+			})
+		}
+	}
+	if rrType != "" && len(list) == 0 {
+		return ErrNotFound
+	}
+	return writeAPIResponse(w, http.StatusOK, list)
+}
+
+// serveWOL handles /wol, which sends a wake-on-LAN packet to the machine named
+// by the apiWake that is POSTed
+func (s apiServer) serveWOL(w http.ResponseWriter, r *http.Request, path []string) error {
+	if len(path) != 0 {
+		return ErrNotFound
+	}
+	if r.Method != "POST" {
+		return errMethodNotAllowed
+	}
+	var wake apiWake
+	if err := readAPIRequest(r, &wake); err != nil {
+		return err
+	}
+	var err error
+	switch {
+	case wake.MAC != "" && wake.IP == "" && wake.Name == "":
+		mac, parseErr := net.ParseMAC(wake.MAC)
+		if parseErr != nil {
+			return InvalidError{parseErr}
+		}
+		err = wakeByMAC(s.cfg, mac)
+	case wake.IP != "" && wake.MAC == "" && wake.Name == "":
+		ip := net.ParseIP(wake.IP)
+		if ip == nil {
+			return InvalidError{errors.New("not a valid IP address: " + wake.IP)}
+		}
+		err = wakeByIP(s.cfg, ip)
+	case wake.Name != "" && wake.MAC == "" && wake.IP == "":
+		err = wakeByHostname(s.cfg, wake.Name)
+	default:
+		return InvalidError{errors.New("give exactly one of mac, ip or name")}
+	}
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// readAPIRequest decodes the JSON body of r into v
+func readAPIRequest(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return InvalidError{err}
+	}
+	return nil
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError reports err as {"error": "<message>"}, along with a status that
+// says whether it was the request or the server at fault. Configs that fail
+// validation also list each problem as {"key": ..., "error": ...}.
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err.(type) {
+	case InvalidError, ConfigErrors, ConfigError:
+		status = http.StatusBadRequest
+	}
+	switch err {
+	case ErrNotFound:
+		status = http.StatusNotFound
+	case ErrExists, ErrLeaseConflict:
+		status = http.StatusConflict
+	case errUnauthorized:
+		status = http.StatusUnauthorized
+	case errMethodNotAllowed:
+		status = http.StatusMethodNotAllowed
+	}
+	if status == http.StatusInternalServerError {
+		apiLog.Error("request failed", "err", err)
+	}
+
+	type problem struct {
+		Key   string `json:"key"`
+		Error string `json:"error"`
+	}
+	body := struct {
+		Error    string    `json:"error"`
+		Problems []problem `json:"problems,omitempty"`
+	}{Error: err.Error()}
+	if invalid, ok := err.(InvalidError); ok {
+		err = invalid.Err
+	}
+	switch problems := err.(type) {
+	case ConfigErrors:
+		for _, p := range problems {
+			body.Problems = append(body.Problems, problem{p.Key, p.Err.Error()})
+		}
+	case ConfigError:
+		body.Problems = append(body.Problems, problem{problems.Key, problems.Err.Error()})
+	}
+	writeAPIResponse(w, status, body)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// apiRequest sends a request to the API as a client with the right token and
+// decodes any JSON response into v
+func apiRequest(t *testing.T, server *httptest.Server, method string, path string, body interface{}, v interface{}) int {
+	var payload bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&payload).Encode(body)
+	}
+	req, err := http.NewRequest(method, server.URL+path, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func newTestAPI(t *testing.T) (*httptest.Server, *MemDB) {
+	db := NewMemDB()
+	db.owner = ""
+	cfg := &Config{db: db, hostname: "core1", sources: make(map[string]configSource)}
+	return httptest.NewServer(apiServer{cfg: cfg, token: "secret"}), db
+}
+
+func TestAPIRequiresToken(t *testing.T) {
+	server, _ := newTestAPI(t)
+	defer server.Close()
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req, _ := http.NewRequest("GET", server.URL+"/api/v1/zones", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%q: expected 401, got %d", auth, resp.StatusCode)
+		}
+	}
+}
+
+func TestAPIZonesAndHosts(t *testing.T) {
+	server, _ := newTestAPI(t)
+	defer server.Close()
+
+	zone := map[string]string{"subnet": "10.0.0.0/24", "gateway": "10.0.0.1"}
+	if status := apiRequest(t, server, "PUT", "/api/v1/zones/office", zone, nil); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", status)
+	}
+
+	var failure struct {
+		Error    string
+		Problems []struct{ Key, Error string }
+	}
+	status := apiRequest(t, server, "PUT", "/api/v1/zones/office", map[string]string{"gateway": "10.1.0.1"}, &failure)
+	if status != http.StatusBadRequest || len(failure.Problems) != 1 || failure.Problems[0].Key != "office/gateway" {
+		t.Errorf("expected the gateway to be refused, got %d %+v", status, failure)
+	}
+
+	host := map[string]string{"zone": "office", "dhcpip": "10.0.0.2"}
+	if status := apiRequest(t, server, "PUT", "/api/v1/hosts/core1", host, nil); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	if status := apiRequest(t, server, "DELETE", "/api/v1/zones/office", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("expected deleting a zone in use to be refused, got %d", status)
+	}
+
+	var settings []ConfigSetting
+	apiRequest(t, server, "GET", "/api/v1/config?host=core1", nil, &settings)
+	found := false
+	for _, setting := range settings {
+		found = found || setting == ConfigSetting{Name: "gateway", Value: "10.0.0.1", Source: "office/gateway"}
+	}
+	if !found {
+		t.Errorf("expected the zone's gateway in %+v", settings)
+	}
+
+	var zones map[string]map[string]string
+	apiRequest(t, server, "GET", "/api/v1/zones", nil, &zones)
+	if len(zones) != 1 || zones["office"]["subnet"] != "10.0.0.0/24" {
+		t.Errorf("unexpected zones: %+v", zones)
+	}
+}
+
+func TestAPILeasesAndRecords(t *testing.T) {
+	server, db := newTestAPI(t)
+	defer server.Close()
+	runAdminCommand(t, db, "zone create office subnet=10.0.0.0/24 gateway=10.0.0.1")
+
+	lease := apiLease{MAC: "00:11:22:33:44:55", IP: "10.0.0.10"}
+	if status := apiRequest(t, server, "POST", "/api/v1/reservations", lease, nil); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	lease.MAC = "00:11:22:33:44:66"
+	if status := apiRequest(t, server, "POST", "/api/v1/leases", lease, nil); status != http.StatusConflict {
+		t.Errorf("expected a lease on a reserved address to conflict, got %d", status)
+	}
+	var leases []apiLease
+	apiRequest(t, server, "GET", "/api/v1/reservations", nil, &leases)
+	if len(leases) != 1 || leases[0] != (apiLease{MAC: "00:11:22:33:44:55", IP: "10.0.0.10"}) {
+		t.Errorf("unexpected reservations: %+v", leases)
+	}
+	if status := apiRequest(t, server, "DELETE", "/api/v1/leases/00:11:22:33:44:55", nil, nil); status != http.StatusNotFound {
+		t.Errorf("expected deleting a reservation as a lease to fail, got %d", status)
+	}
+
+	record := apiRecord{Name: "host.example.com", Type: "A", Value: "10.0.0.10", TTL: 300}
+	if status := apiRequest(t, server, "POST", "/api/v1/records", record, nil); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	var records []apiRecord
+	status := apiRequest(t, server, "PUT", "/api/v1/records/host.example.com/a?value=10.0.0.10", apiRecord{Value: "10.0.0.11", TTL: 300}, &records)
+	if status != http.StatusOK || len(records) != 1 || records[0].Value != "10.0.0.11" {
+		t.Errorf("unexpected records after update: %d %+v", status, records)
+	}
+	if status := apiRequest(t, server, "DELETE", "/api/v1/records/host.example.com/A", nil, nil); status != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", status)
+	}
+	if status := apiRequest(t, server, "GET", "/api/v1/records/11.0.0.10.in-addr.arpa/PTR", nil, nil); status != http.StatusNotFound {
+		t.Errorf("expected the PTR record to go with the address, got %d", status)
+	}
+
+	if status := apiRequest(t, server, "POST", "/api/v1/wol", apiWake{Name: "nowhere.example.com"}, nil); status != http.StatusNotFound {
+		t.Errorf("expected waking an unknown host to fail with 404, got %d", status)
+	}
+}
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"encoding/base64"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"net"
+	"net/mail"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 // Config is the host+zone config for this server
@@ -25,6 +36,18 @@ type Config struct {
 	dnsForwarders      []string
 	dnsCacheMaxTTL     time.Duration
 	dnsCacheMissingTTL time.Duration
+	dnsTSIGKeys        map[string]string // base64 secrets keyed by the fully qualified key name
+	dnsSecondaries     map[string]string // primary host:port keyed by the fully qualified zone name
+	dhcpPoolWarn       int               // percent
+	dhcpPoolCritical   int               // percent
+	alertSMTP          string
+	alertFrom          string
+	alertTo            []string
+	logLevel           string
+	sources            map[string]configSource
+	listeners          []func()
+	loaded             time.Time // when the settings were read
+	reloadErr          error     // why the last attempt to reload them failed, if it did
 }
 
 type ConfigProvider interface {
@@ -32,6 +55,23 @@ type ConfigProvider interface {
 	GetConfig() (*Config, error)
 }
 
+// ConfigWatcher is implemented by backends that can report changes to the
+// configuration as they happen. WatchConfig sends the key of each changed value,
+// such as "<zone>/subnet", until stop is closed. An empty key means that changes
+// may have been missed and everything should be considered changed.
+type ConfigWatcher interface {
+	WatchConfig(stop <-chan struct{}) <-chan string
+}
+
+// configStore is implemented by backends that keep configuration as string
+// values under keys such as "<hostname>/zone" or "<zone>/subnet"
+type configStore interface {
+	getConfigValue(key string) (value string, found bool, err error)
+	setConfigValue(key string, value string) error
+	deleteConfigValue(key string) error
+	listConfigValues() (map[string]string, error)
+}
+
 var setZone = flag.String("setZone", "", "Overwrite (permanently) the zone that this machine is in.")
 var setDHCPIP = flag.String("setDHCPIP", "", "Overwrite (permanently) the DHCP hosting IP for this machine (or set it to empty to disable DHCP).")
 var setDHCPNIC = flag.String("setDHCPNIC", "", "Overwrite (permanently) the DHCP hosting NIC name for this machine (or set it to empty to disable DHCP).")
@@ -45,9 +85,33 @@ var ErrNoZone = errors.New("This host has not been assigned to a zone.")
 // ErrNoDHCPIP is an error returned during config init to indicate that the host has not been assigned to a zone in etcd keyed off of its hostname
 var ErrNoDHCPIP = errors.New("This host has not been assigned a DHCP IP.")
 
+// ErrNoSubnet is an error returned during config init to indicate that the zone has not been assigned a subnet in etcd keyed off of the zone name
+var ErrNoSubnet = errors.New("This zone does not have an assigned subnet.")
+
 // ErrNoGateway is an error returned during config init to indicate that the zone has not been assigned a gateway in etcd keyed off of the zone name
 var ErrNoGateway = errors.New("This zone does not have an assigned gateway.")
 
+// ConfigError is a problem with the config value stored under Key
+type ConfigError struct {
+	Key string
+	Err error
+}
+
+func (e ConfigError) Error() string {
+	return e.Key + ": " + e.Err.Error()
+}
+
+// ConfigErrors is every problem found while loading or validating a config
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
 // Hostname returns this machine's hostname
 func (cfg *Config) Hostname() string {
 	cfg.Lock()
@@ -139,3 +203,755 @@ func (cfg *Config) DNSCacheMissingTTL() time.Duration {
 	defer cfg.Unlock()
 	return cfg.dnsCacheMissingTTL
 }
+
+// DNSTSIGKeys returns the base64 secrets of the TSIG keys that zone transfers
+// can be signed with, keyed by their fully qualified names in lower case
+func (cfg *Config) DNSTSIGKeys() map[string]string {
+	cfg.Lock()
+	defer cfg.Unlock()
+	return cfg.dnsTSIGKeys
+}
+
+// DNSSecondaries returns the zones we are a secondary for, keyed by their fully
+// qualified names in lower case, along with the host:port of their primaries
+func (cfg *Config) DNSSecondaries() map[string]string {
+	cfg.Lock()
+	defer cfg.Unlock()
+	return cfg.dnsSecondaries
+}
+
+// DHCPPoolWarn returns the percentage of the DHCP pool in use at which a
+// warning is sent
+func (cfg *Config) DHCPPoolWarn() int {
+	cfg.Lock()
+	defer cfg.Unlock()
+	return cfg.dhcpPoolWarn
+}
+
+// DHCPPoolCritical returns the percentage of the DHCP pool in use at which a
+// critical alert is sent
+func (cfg *Config) DHCPPoolCritical() int {
+	cfg.Lock()
+	defer cfg.Unlock()
+	return cfg.dhcpPoolCritical
+}
+
+// AlertSMTP returns the host:port of the SMTP relay that alerts are sent
+// through, or "" if alerts are disabled
+func (cfg *Config) AlertSMTP() string {
+	cfg.Lock()
+	defer cfg.Unlock()
+	return cfg.alertSMTP
+}
+
+// AlertFrom returns the address that alerts are sent from
+func (cfg *Config) AlertFrom() string {
+	cfg.Lock()
+	defer cfg.Unlock()
+	if cfg.alertFrom == "" {
+		return "netcore@" + cfg.hostname
+	}
+	return cfg.alertFrom
+}
+
+// AlertTo returns the addresses that alerts are sent to
+func (cfg *Config) AlertTo() []string {
+	cfg.Lock()
+	defer cfg.Unlock()
+	return cfg.alertTo
+}
+
+// LogLevel returns the log levels to use, as taken by setLogLevels
+func (cfg *Config) LogLevel() string {
+	cfg.Lock()
+	defer cfg.Unlock()
+	return cfg.logLevel
+}
+
+// OnChange registers fn to be called whenever the config is updated in place
+func (cfg *Config) OnChange(fn func()) {
+	cfg.Lock()
+	defer cfg.Unlock()
+	cfg.listeners = append(cfg.listeners, fn)
+}
+
+// Loaded returns when the settings in use were loaded, and the error from the
+// last attempt to reload them if it failed
+func (cfg *Config) Loaded() (time.Time, error) {
+	cfg.Lock()
+	defer cfg.Unlock()
+	return cfg.loaded, cfg.reloadErr
+}
+
+// update replaces the settings in cfg with those of next and then notifies
+// everything registered with OnChange
+func (cfg *Config) update(next *Config) {
+	cfg.Lock()
+	cfg.zone = next.zone
+	cfg.domain = next.domain
+	cfg.subnet = next.subnet
+	cfg.gateway = next.gateway
+	cfg.dhcpIP = next.dhcpIP
+	cfg.dhcpNIC = next.dhcpNIC
+	cfg.dhcpSubnet = next.dhcpSubnet
+	cfg.dhcpLeaseDuration = next.dhcpLeaseDuration
+	cfg.dhcpTFTP = next.dhcpTFTP
+	cfg.dnsForwarders = next.dnsForwarders
+	cfg.dnsCacheMaxTTL = next.dnsCacheMaxTTL
+	cfg.dnsCacheMissingTTL = next.dnsCacheMissingTTL
+	cfg.dnsTSIGKeys = next.dnsTSIGKeys
+	cfg.dnsSecondaries = next.dnsSecondaries
+	cfg.dhcpPoolWarn = next.dhcpPoolWarn
+	cfg.dhcpPoolCritical = next.dhcpPoolCritical
+	cfg.alertSMTP = next.alertSMTP
+	cfg.alertFrom = next.alertFrom
+	cfg.alertTo = next.alertTo
+	cfg.logLevel = next.logLevel
+	cfg.sources = next.sources
+	cfg.loaded = next.loaded
+	cfg.reloadErr = nil
+	listeners := cfg.listeners
+	cfg.Unlock()
+
+	for _, fn := range listeners {
+		fn()
+	}
+}
+
+// watchConfig keeps cfg up to date with changes to this host's and this zone's
+// config until stop is closed. It does nothing if the backend can't report
+// changes. If a reload fails then the current config is kept.
+func watchConfig(cfg *Config, stop <-chan struct{}) {
+	watcher, ok := cfg.db.(ConfigWatcher)
+	if !ok {
+		return
+	}
+	for key := range watcher.WatchConfig(stop) {
+		if key != "" && !strings.HasPrefix(key, cfg.Hostname()+"/") && !strings.HasPrefix(key, cfg.Zone()+"/") && !strings.HasPrefix(key, configGlobal+"/") {
+			continue // somebody else's config
+		}
+		configLog.Info("config changed, reloading", "key", key)
+		next, err := cfg.db.GetConfig()
+		if err != nil {
+			configLog.Error("config reload failed, keeping the current config", "err", err)
+			cfg.Lock()
+			cfg.reloadErr = err
+			cfg.Unlock()
+			continue
+		}
+		cfg.update(next)
+	}
+}
+
+// configGlobal is the level holding defaults that apply to every zone and host
+const configGlobal = "@global"
+
+// configSettings lists every setting, in the order they are shown
+var configSettings = []string{"zone", "domain", "subnet", "gateway", "dhcpip", "dhcpnic", "dhcpsubnet", "dhcpleaseduration", "dhcptftp", "dnsforwarders", "dnscachemaxttl", "dnscachemissingttl", "dnstsigkeys", "dnssecondaries", "dhcppoolwarn", "dhcppoolcritical", "alertsmtp", "alertfrom", "alertto", "loglevel"}
+
+// configSource records the value a setting ended up with and the key it was
+// taken from, which is empty if the built-in default was used
+type configSource struct {
+	value string
+	key   string
+}
+
+// loadConfig builds the config for this server from the values held in store
+func loadConfig(db DB, store configStore) (*Config, error) {
+	hostname, err := getNetcoreName()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadHostConfig(db, store, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{"host", hostname}
+	for _, setting := range cfg.Settings() {
+		args = append(args, setting.Name, setting.Value)
+	}
+	configLog.Debug("config loaded", args...)
+
+	return cfg, nil
+}
+
+// loadHostConfig builds the config for the named host from the values held in
+// store. Each setting is taken from "<hostname>/<setting>" if present,
+// otherwise from "<zone>/<setting>", otherwise from "@global/<setting>", and
+// otherwise the built-in default applies. The zone itself can only be set per
+// host or globally. Every problem found with the values is reported at once in
+// a ConfigErrors, except for a missing zone, without which the zone's values
+// can't be found at all.
+func loadHostConfig(db DB, store configStore, hostname string) (*Config, error) {
+	cfg := &Config{
+		db:       db,
+		hostname: hostname,
+		sources:  make(map[string]configSource),
+	}
+	var problems ConfigErrors
+
+	// lookup finds the most specific value for a setting and records where it
+	// came from
+	lookup := func(name string, def string) (value string, key string, err error) {
+		for _, level := range []string{cfg.hostname, cfg.zone, configGlobal} {
+			if level == "" {
+				continue
+			}
+			value, _, err := store.getConfigValue(level + "/" + name)
+			if err != nil {
+				return "", "", err
+			}
+			if value != "" {
+				cfg.sources[name] = configSource{value: value, key: level + "/" + name}
+				return value, level + "/" + name, nil
+			}
+		}
+		cfg.sources[name] = configSource{value: def}
+		return def, name, nil
+	}
+
+	// Zone
+	{
+		value, _, err := lookup("zone", "")
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			return nil, ErrNoZone
+		}
+		cfg.zone = value
+	}
+
+	// Domain
+	{
+		value, _, err := lookup("domain", "")
+		if err != nil {
+			return nil, err
+		}
+		cfg.domain = value
+	}
+
+	// Subnet
+	{
+		value, key, err := lookup("subnet", "")
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			_, subnet, err := net.ParseCIDR(value)
+			if err != nil {
+				problems = append(problems, ConfigError{key, err})
+			}
+			cfg.subnet = subnet
+		}
+	}
+
+	// Gateway
+	{
+		value, key, err := lookup("gateway", "")
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			cfg.gateway = net.ParseIP(value).To4()
+			if cfg.gateway == nil {
+				problems = append(problems, ConfigError{key, fmt.Errorf("%q is not an IPv4 address", value)})
+			}
+		}
+	}
+
+	// DHCPIP
+	{
+		value, key, err := lookup("dhcpip", "")
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			cfg.dhcpIP = net.ParseIP(value).To4()
+			if cfg.dhcpIP == nil {
+				problems = append(problems, ConfigError{key, fmt.Errorf("%q is not an IPv4 address", value)})
+			}
+		}
+	}
+
+	// DHCPNIC
+	{
+		value, _, err := lookup("dhcpnic", "")
+		if err != nil {
+			return nil, err
+		}
+		cfg.dhcpNIC = value
+	}
+
+	// DHCPSubnet
+	{
+		value, key, err := lookup("dhcpsubnet", "")
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			_, dhcpSubnet, err := net.ParseCIDR(value)
+			if err != nil {
+				problems = append(problems, ConfigError{key, err})
+			}
+			cfg.dhcpSubnet = dhcpSubnet
+		}
+	}
+
+	// DHCPLeaseDuration
+	{
+		value, key, err := lookup("dhcpleaseduration", "720") // default setting is 12 hours
+		if err != nil {
+			return nil, err
+		}
+		minutes, err := strconv.Atoi(value)
+		if err != nil {
+			problems = append(problems, ConfigError{key, fmt.Errorf("%q is not a whole number of minutes", value)})
+		}
+		cfg.dhcpLeaseDuration = time.Duration(minutes) * time.Minute
+	}
+
+	// DHCPTFTP
+	{
+		value, _, err := lookup("dhcptftp", "")
+		if err != nil {
+			return nil, err
+		}
+		cfg.dhcpTFTP = value
+	}
+
+	// DNSForwarders
+	{
+		value, _, err := lookup("dnsforwarders", "8.8.8.8:53,8.8.4.4:53") // default uses Google's Public DNS servers
+		if err != nil {
+			return nil, err
+		}
+		cfg.dnsForwarders = parseDNSForwarders(value)
+	}
+
+	// dnsCacheMaxTTL
+	{
+		value, key, err := lookup("dnscachemaxttl", "0") // default to no caching
+		if err != nil {
+			return nil, err
+		}
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			problems = append(problems, ConfigError{key, fmt.Errorf("%q is not a whole number of seconds", value)})
+		}
+		cfg.dnsCacheMaxTTL = time.Duration(seconds) * time.Second
+	}
+
+	// dnsCacheMissingTTL
+	{
+		value, key, err := lookup("dnscachemissingttl", "30") // default setting is 30 seconds
+		if err != nil {
+			return nil, err
+		}
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			problems = append(problems, ConfigError{key, fmt.Errorf("%q is not a whole number of seconds", value)})
+		}
+		cfg.dnsCacheMissingTTL = time.Duration(seconds) * time.Second
+	}
+
+	// DNSTSIGKeys
+	{
+		value, key, err := lookup("dnstsigkeys", "") // default is no keys
+		if err != nil {
+			return nil, err
+		}
+		cfg.dnsTSIGKeys, err = parseTSIGKeys(value)
+		if err != nil {
+			problems = append(problems, ConfigError{key, err})
+		}
+		// Keep the secrets out of the logs and the settings shown
+		var names []string
+		for name := range cfg.dnsTSIGKeys {
+			names = append(names, name+":<secret>")
+		}
+		sort.Strings(names)
+		cfg.sources["dnstsigkeys"] = configSource{value: strings.Join(names, ","), key: cfg.sources["dnstsigkeys"].key}
+	}
+
+	// DNSSecondaries
+	{
+		value, key, err := lookup("dnssecondaries", "") // default is no secondary zones
+		if err != nil {
+			return nil, err
+		}
+		cfg.dnsSecondaries, err = parseDNSSecondaries(value)
+		if err != nil {
+			problems = append(problems, ConfigError{key, err})
+		}
+	}
+
+	// DHCPPoolWarn
+	{
+		value, key, err := lookup("dhcppoolwarn", "85") // default setting is 85%
+		if err != nil {
+			return nil, err
+		}
+		percent, err := strconv.Atoi(value)
+		if err != nil {
+			problems = append(problems, ConfigError{key, fmt.Errorf("%q is not a whole percentage", value)})
+		}
+		cfg.dhcpPoolWarn = percent
+	}
+
+	// DHCPPoolCritical
+	{
+		value, key, err := lookup("dhcppoolcritical", "100") // default setting is when it's full
+		if err != nil {
+			return nil, err
+		}
+		percent, err := strconv.Atoi(value)
+		if err != nil {
+			problems = append(problems, ConfigError{key, fmt.Errorf("%q is not a whole percentage", value)})
+		}
+		cfg.dhcpPoolCritical = percent
+	}
+
+	// AlertSMTP
+	{
+		value, _, err := lookup("alertsmtp", "") // default is to send no alerts
+		if err != nil {
+			return nil, err
+		}
+		cfg.alertSMTP = value
+	}
+
+	// AlertFrom
+	{
+		value, _, err := lookup("alertfrom", "") // default is netcore@<hostname>
+		if err != nil {
+			return nil, err
+		}
+		cfg.alertFrom = value
+	}
+
+	// AlertTo
+	{
+		value, _, err := lookup("alertto", "")
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range strings.Split(value, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				cfg.alertTo = append(cfg.alertTo, address)
+			}
+		}
+	}
+
+	// LogLevel
+	{
+		value, key, err := lookup("loglevel", defaultLogLevel)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parseLogLevels(value); err != nil {
+			problems = append(problems, ConfigError{key, err})
+		}
+		cfg.logLevel = value
+	}
+
+	// Only report validation problems for values that could at least be parsed
+	reported := make(map[string]bool)
+	for _, problem := range problems {
+		reported[problem.Key] = true
+	}
+	for _, problem := range cfg.Validate() {
+		if !reported[problem.Key] {
+			problems = append(problems, problem)
+		}
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	cfg.loaded = time.Now()
+	return cfg, nil
+}
+
+// parseTSIGKeys splits a comma-separated list of "<name>:<base64 secret>" TSIG
+// keys into a map of the secrets by fully qualified name
+func parseTSIGKeys(value string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, key := range strings.Split(value, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		parts := strings.SplitN(key, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not <name>:<secret>", key)
+		}
+		if _, ok := dns.IsDomainName(parts[0]); !ok || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not a valid key name", parts[0])
+		}
+		if _, err := base64.StdEncoding.DecodeString(parts[1]); err != nil {
+			return nil, fmt.Errorf("the secret of %s is not base64", parts[0])
+		}
+		keys[dns.CanonicalName(parts[0])] = parts[1]
+	}
+	return keys, nil
+}
+
+// parseDNSSecondaries splits a comma-separated list of "<zone>@<primary>"
+// secondary zones into a map of the primaries by fully qualified zone name,
+// adding the standard DNS port to any primary without one
+func parseDNSSecondaries(value string) (map[string]string, error) {
+	secondaries := make(map[string]string)
+	for _, secondary := range strings.Split(value, ",") {
+		secondary = strings.TrimSpace(secondary)
+		if secondary == "" {
+			continue
+		}
+		parts := strings.SplitN(secondary, "@", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not <zone>@<primary>", secondary)
+		}
+		if _, ok := dns.IsDomainName(parts[0]); !ok || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not a valid zone name", parts[0])
+		}
+		primary := parts[1]
+		if _, _, err := net.SplitHostPort(primary); err != nil {
+			primary = net.JoinHostPort(primary, "53")
+		}
+		secondaries[dns.CanonicalName(parts[0])] = primary
+	}
+	return secondaries, nil
+}
+
+// parseDNSForwarders splits a comma-separated list of forwarders, adding the
+// standard DNS port to any that are just an address
+func parseDNSForwarders(value string) []string {
+	var forwarders []string
+	for _, forwarder := range strings.Split(value, ",") {
+		forwarder = strings.TrimSpace(forwarder)
+		if forwarder == "" {
+			continue
+		}
+		if net.ParseIP(forwarder) != nil {
+			forwarder = net.JoinHostPort(forwarder, "53")
+		}
+		forwarders = append(forwarders, forwarder)
+	}
+	return forwarders
+}
+
+// Validate checks every setting in the config, on its own and against the
+// others, and returns all of the problems found
+func (cfg *Config) Validate() ConfigErrors {
+	cfg.Lock()
+	defer cfg.Unlock()
+	var problems ConfigErrors
+	problem := func(key string, format string, args ...interface{}) {
+		problems = append(problems, ConfigError{key, fmt.Errorf(format, args...)})
+	}
+	// Problems are reported against the key each value came from
+	sourceKey := func(name string) string {
+		if source, ok := cfg.sources[name]; ok && source.key != "" {
+			return source.key
+		}
+		return name
+	}
+
+	if cfg.domain != "" {
+		if _, ok := dns.IsDomainName(cfg.domain); !ok {
+			problem(sourceKey("domain"), "%q is not a valid domain name", cfg.domain)
+		}
+	}
+
+	if cfg.subnet == nil {
+		problems = append(problems, ConfigError{sourceKey("subnet"), ErrNoSubnet})
+	}
+
+	if cfg.gateway == nil {
+		problems = append(problems, ConfigError{sourceKey("gateway"), ErrNoGateway})
+	} else if cfg.subnet != nil && !cfg.subnet.Contains(cfg.gateway) {
+		problem(sourceKey("gateway"), "%s is outside the zone subnet %s", cfg.gateway, cfg.subnet)
+	}
+
+	if cfg.dhcpIP != nil && cfg.subnet != nil && !cfg.subnet.Contains(cfg.dhcpIP) {
+		problem(sourceKey("dhcpip"), "%s is outside the zone subnet %s", cfg.dhcpIP, cfg.subnet)
+	}
+
+	if cfg.dhcpSubnet != nil {
+		poolBits, _ := cfg.dhcpSubnet.Mask.Size()
+		if cfg.subnet != nil {
+			subnetBits, _ := cfg.subnet.Mask.Size()
+			if !cfg.subnet.Contains(cfg.dhcpSubnet.IP) || poolBits < subnetBits {
+				problem(sourceKey("dhcpsubnet"), "%s is outside the zone subnet %s", cfg.dhcpSubnet, cfg.subnet)
+			}
+		}
+		if cfg.gateway != nil && cfg.dhcpSubnet.Contains(cfg.gateway) {
+			problem(sourceKey("dhcpsubnet"), "%s includes the gateway %s", cfg.dhcpSubnet, cfg.gateway)
+		}
+		if cfg.dhcpIP != nil && cfg.dhcpSubnet.Contains(cfg.dhcpIP) {
+			problem(sourceKey("dhcpsubnet"), "%s includes this host's DHCP IP %s", cfg.dhcpSubnet, cfg.dhcpIP)
+		}
+	}
+
+	if cfg.dhcpLeaseDuration < minimumLeaseDuration {
+		problem(sourceKey("dhcpleaseduration"), "%s is shorter than the minimum of %s", cfg.dhcpLeaseDuration, minimumLeaseDuration)
+	}
+
+	if len(cfg.dnsForwarders) == 0 {
+		problem(sourceKey("dnsforwarders"), "no forwarders are listed")
+	}
+	for _, forwarder := range cfg.dnsForwarders {
+		if forwarder == "!" && len(cfg.dnsForwarders) == 1 {
+			continue // forwarding is turned off
+		}
+		host, port, err := net.SplitHostPort(forwarder)
+		if err != nil {
+			problem(sourceKey("dnsforwarders"), "%q is not a host:port: %s", forwarder, err)
+			continue
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil || host == "" {
+			problem(sourceKey("dnsforwarders"), "%q is not a host:port", forwarder)
+		}
+	}
+
+	if cfg.dnsCacheMaxTTL < 0 {
+		problem(sourceKey("dnscachemaxttl"), "%s is negative", cfg.dnsCacheMaxTTL)
+	}
+	if cfg.dnsCacheMissingTTL < 0 {
+		problem(sourceKey("dnscachemissingttl"), "%s is negative", cfg.dnsCacheMissingTTL)
+	}
+
+	if cfg.dhcpPoolWarn < 1 || cfg.dhcpPoolWarn > 100 {
+		problem(sourceKey("dhcppoolwarn"), "%d%% is not between 1%% and 100%%", cfg.dhcpPoolWarn)
+	} else if cfg.dhcpPoolWarn > cfg.dhcpPoolCritical {
+		problem(sourceKey("dhcppoolwarn"), "%d%% is above the critical level of %d%%", cfg.dhcpPoolWarn, cfg.dhcpPoolCritical)
+	}
+	if cfg.dhcpPoolCritical < 1 || cfg.dhcpPoolCritical > 100 {
+		problem(sourceKey("dhcppoolcritical"), "%d%% is not between 1%% and 100%%", cfg.dhcpPoolCritical)
+	}
+
+	if cfg.alertSMTP != "" {
+		if _, _, err := net.SplitHostPort(cfg.alertSMTP); err != nil {
+			problem(sourceKey("alertsmtp"), "%q is not a host:port: %s", cfg.alertSMTP, err)
+		}
+		if len(cfg.alertTo) == 0 {
+			problem(sourceKey("alertto"), "alerts are enabled but nobody is listed to send them to")
+		}
+	}
+	if cfg.alertFrom != "" {
+		if _, err := mail.ParseAddress(cfg.alertFrom); err != nil {
+			problem(sourceKey("alertfrom"), "%q is not an email address: %s", cfg.alertFrom, err)
+		}
+	}
+	for _, address := range cfg.alertTo {
+		if _, err := mail.ParseAddress(address); err != nil {
+			problem(sourceKey("alertto"), "%q is not an email address: %s", address, err)
+		}
+	}
+
+	return problems
+}
+
+// ConfigSetting is the effective value of a setting and the key it was taken
+// from, which is empty if the built-in default applies
+type ConfigSetting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source,omitempty"`
+}
+
+// Settings returns the effective value of every setting, in the order they are
+// shown
+func (cfg *Config) Settings() []ConfigSetting {
+	cfg.Lock()
+	defer cfg.Unlock()
+	settings := make([]ConfigSetting, 0, len(configSettings))
+	for _, name := range configSettings {
+		source := cfg.sources[name]
+		settings = append(settings, ConfigSetting{Name: name, Value: source.value, Source: source.key})
+	}
+	return settings
+}
+
+// WriteSettings writes the value of every setting to w along with the key it
+// was taken from, or a note that the built-in default applies
+func (cfg *Config) WriteSettings(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, setting := range cfg.Settings() {
+		from := setting.Source
+		if from == "" {
+			from = "default"
+		}
+		fmt.Fprintf(tw, "%s\t= %s\t(%s)\n", setting.Name, setting.Value, from)
+	}
+	return tw.Flush()
+}
+
+// showConfig loads the config for this host and prints the effective settings,
+// returning the exit status for the showConfig flag
+func showConfig(db DB) int {
+	cfg, err := db.GetConfig()
+	if err != nil {
+		fmt.Printf("PROBLEM: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Effective config for %s:\n", cfg.Hostname())
+	cfg.WriteSettings(os.Stdout)
+	return 0
+}
+
+// checkConfig loads the config for this host without starting anything and
+// prints every problem found, returning the exit status for the check flag
+func checkConfig(db DB) int {
+	cfg, err := db.GetConfig()
+	if problems, ok := err.(ConfigErrors); ok {
+		for _, problem := range problems {
+			fmt.Printf("PROBLEM: %s\n", problem)
+		}
+		fmt.Printf("Config has %d problem(s).\n", len(problems))
+		return 1
+	}
+	if err != nil {
+		fmt.Printf("PROBLEM: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Config for %s in zone %s is valid.\n", cfg.Hostname(), cfg.Zone())
+	return 0
+}
+
+// configOverride is a config value that was provided on the command line
+type configOverride struct {
+	key   string
+	value *string
+}
+
+// writeConfigOverrides permanently writes any config values provided on the
+// command line to store. The zone-level values are only written when the
+// setZone flag has also been provided.
+func writeConfigOverrides(store configStore) error {
+	hostname, err := getNetcoreName()
+	if err != nil {
+		return err
+	}
+	overrides := []configOverride{
+		{hostname + "/zone", setZone},
+		{hostname + "/dhcpip", setDHCPIP},
+		{hostname + "/dhcpnic", setDHCPNIC},
+		{hostname + "/dhcptftp", setDHCPTFTP},
+	}
+	if setZone != nil && *setZone != "" {
+		overrides = append(overrides,
+			configOverride{*setZone + "/dhcpsubnet", setDHCPSubnet},
+			configOverride{*setZone + "/dhcpleaseduration", setDHCPLeaseDuration})
+	}
+	for _, override := range overrides {
+		if override.value == nil || *override.value == "" {
+			continue
+		}
+		if err := store.setConfigValue(override.key, *override.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigReportsAllProblems(t *testing.T) {
+	os.Setenv("NETCORE_NAME", "core1")
+	defer os.Unsetenv("NETCORE_NAME")
+
+	db := NewMemDB()
+	err := db.LoadConfig(strings.NewReader(`
+		core1/zone = office
+		core1/dhcpip = 10.0.1.2
+		office/subnet = 10.0.0.0/24
+		office/gateway = 10.0.0.129
+		office/dhcpsubnet = 10.0.0.128/25
+		office/dhcpleaseduration = soon
+		office/dnsforwarders = 10.0.0.53, bogus
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.GetConfig()
+	problems, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	found := make(map[string]bool)
+	for _, problem := range problems {
+		found[problem.Key] = true
+	}
+	for _, key := range []string{"core1/dhcpip", "office/dhcpsubnet", "office/dhcpleaseduration", "office/dnsforwarders"} {
+		if !found[key] {
+			t.Errorf("expected a problem with %s, got %s", key, problems)
+		}
+	}
+	if len(problems) != 4 {
+		t.Errorf("expected 4 problems, got %d: %s", len(problems), problems)
+	}
+}
+
+func TestLoadConfigDNSForwarders(t *testing.T) {
+	os.Setenv("NETCORE_NAME", "core1")
+	defer os.Unsetenv("NETCORE_NAME")
+
+	db := NewMemDB()
+	db.LoadConfig(strings.NewReader(`
+		core1/zone = office
+		office/subnet = 10.0.0.0/24
+		office/gateway = 10.0.0.1
+		office/dnsforwarders = 10.0.0.53, 192.0.2.1:5353
+	`))
+
+	cfg, err := db.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarders := cfg.DNSForwarders()
+	if len(forwarders) != 2 || forwarders[0] != "10.0.0.53:53" || forwarders[1] != "192.0.2.1:5353" {
+		t.Errorf("unexpected forwarders: %v", forwarders)
+	}
+}
+
+func TestValidateForwardingOff(t *testing.T) {
+	os.Setenv("NETCORE_NAME", "core1")
+	defer os.Unsetenv("NETCORE_NAME")
+
+	for _, test := range []struct {
+		forwarders string
+		valid      bool
+	}{
+		{"!", true},
+		{"!, 10.0.0.53", false}, // only on its own
+	} {
+		db := NewMemDB()
+		db.LoadConfig(strings.NewReader(`
+			core1/zone = office
+			office/subnet = 10.0.0.0/24
+			office/gateway = 10.0.0.1
+			office/dnsforwarders = ` + test.forwarders))
+
+		cfg, err := db.GetConfig()
+		if test.valid && err != nil {
+			t.Errorf("%s: expected no problems, got %v", test.forwarders, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected a problem", test.forwarders)
+		}
+		if err == nil && test.valid && forwardingEnabled(cfg.DNSForwarders()) {
+			t.Errorf("%s: expected forwarding to be off", test.forwarders)
+		}
+	}
+}
+
+func TestLoadConfigInheritance(t *testing.T) {
+	os.Setenv("NETCORE_NAME", "core1")
+	defer os.Unsetenv("NETCORE_NAME")
+
+	db := NewMemDB()
+	db.LoadConfig(strings.NewReader(`
+		@global/domain = example.com
+		@global/dnscachemaxttl = 60
+		@global/dhcpleaseduration = 120
+		core1/zone = office
+		office/domain = office.example.com
+		office/subnet = 10.0.0.0/24
+		office/gateway = 10.0.0.1
+		core1/dhcpleaseduration = 30
+	`))
+
+	cfg, err := db.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Domain() != "office.example.com" {
+		t.Errorf("expected the zone's domain to override the global one, got %s", cfg.Domain())
+	}
+	if cfg.DNSCacheMaxTTL() != time.Minute {
+		t.Errorf("expected the global cache TTL, got %s", cfg.DNSCacheMaxTTL())
+	}
+	if cfg.DHCPLeaseDuration() != 30*time.Minute {
+		t.Errorf("expected the host's lease duration, got %s", cfg.DHCPLeaseDuration())
+	}
+
+	var out bytes.Buffer
+	cfg.WriteSettings(&out)
+	for _, line := range []string{
+		"domain              = office.example.com     (office/domain)",
+		"dhcpleaseduration   = 30                     (core1/dhcpleaseduration)",
+		"dnscachemaxttl      = 60                     (@global/dnscachemaxttl)",
+		"dnscachemissingttl  = 30                     (default)",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, out.String())
+		}
+	}
+}
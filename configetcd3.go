@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+func (db EtcdV3DB) GetConfig() (*Config, error) {
+	return loadConfig(db, db)
+}
+
+func (db EtcdV3DB) WatchConfig(stop <-chan struct{}) <-chan string {
+	changed := make(chan string)
+	notify := func(event *clientv3.Event) {
+		key := "" // a nil event means that anything may have changed
+		if event != nil {
+			key = strings.TrimPrefix(string(event.Kv.Key), "/config/")
+		}
+		select {
+		case changed <- key:
+		case <-stop:
+		}
+	}
+
+	var rev int64
+	ctx, cancel := etcdV3Context()
+	response, err := db.client.Get(ctx, "/config/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	cancel()
+	if err == nil {
+		rev = response.Header.Revision
+	}
+
+	go func() {
+		defer close(changed)
+		if err != nil {
+			notify(nil) // we don't know where we are, so assume it all changed
+		}
+		db.watchPrefix("/config/", rev, stop, notify)
+	}()
+	return changed
+}
+
+func (db EtcdV3DB) getConfigValue(key string) (string, bool, error) {
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Get(ctx, "/config/"+key)
+	if err != nil {
+		return "", false, err
+	}
+	if len(response.Kvs) == 0 {
+		return "", false, nil
+	}
+	return string(response.Kvs[0].Value), true, nil
+}
+
+func (db EtcdV3DB) setConfigValue(key string, value string) error {
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	_, err := db.client.Put(ctx, "/config/"+key, value)
+	return err
+}
+
+func (db EtcdV3DB) deleteConfigValue(key string) error {
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Delete(ctx, "/config/"+key)
+	if err != nil {
+		return err
+	}
+	if response.Deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (db EtcdV3DB) listConfigValues() (map[string]string, error) {
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Get(ctx, "/config/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(response.Kvs))
+	for _, kv := range response.Kvs {
+		values[strings.TrimPrefix(string(kv.Key), "/config/")] = string(kv.Value)
+	}
+	return values, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+func (db *MemDB) GetConfig() (*Config, error) {
+	return loadConfig(db, db)
+}
+
+// LoadConfig reads configuration values from r, one "key = value" pair per
+// line, using the same keys as the etcd config tree without the config/ prefix
+// (for example "office/subnet = 10.0.0.0/24"). Blank lines and lines starting
+// with # are ignored.
+func (db *MemDB) LoadConfig(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("config line %d: expected key = value", line)
+		}
+		db.setConfigValue(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return scanner.Err()
+}
+
+func (db *MemDB) getConfigValue(key string) (string, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	value, found := db.config[key]
+	return value, found, nil
+}
+
+func (db *MemDB) setConfigValue(key string, value string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.config[key] = value
+	for _, watcher := range db.configWatchers {
+		select {
+		case watcher <- key:
+		default:
+			// A change is already waiting, and the whole config is reloaded for it
+		}
+	}
+	return nil
+}
+
+func (db *MemDB) deleteConfigValue(key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.config[key]; !ok {
+		return ErrNotFound
+	}
+	delete(db.config, key)
+	for _, watcher := range db.configWatchers {
+		select {
+		case watcher <- key:
+		default:
+		}
+	}
+	return nil
+}
+
+func (db *MemDB) listConfigValues() (map[string]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	values := make(map[string]string, len(db.config))
+	for key, value := range db.config {
+		values[key] = value
+	}
+	return values, nil
+}
+
+func (db *MemDB) WatchConfig(stop <-chan struct{}) <-chan string {
+	changed := make(chan string, 64)
+	db.mu.Lock()
+	db.configWatchers = append(db.configWatchers, changed)
+	db.mu.Unlock()
+
+	go func() {
+		<-stop
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		for i, watcher := range db.configWatchers {
+			if watcher == changed {
+				db.configWatchers = append(db.configWatchers[:i], db.configWatchers[i+1:]...)
+				break
+			}
+		}
+		close(changed)
+	}()
+
+	return changed
+}
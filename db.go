@@ -5,3 +5,8 @@ type DB interface {
 	DHCPDB
 	DNSDB
 }
+
+// Pinger is implemented by DBs kept on a server that might be unreachable
+type Pinger interface {
+	Ping() error
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// testBackend is a DB under test along with the means to manipulate it in ways
+// that the DB interface doesn't provide
+type testBackend struct {
+	db      DB
+	store   configStore
+	advance func(d time.Duration) // moves the backend's clock forward, if it can be controlled
+}
+
+// testBackends returns a fresh instance of every DB implementation so that the
+// same conformance tests can be run against each of them
+func testBackends() map[string]func() testBackend {
+	return map[string]func() testBackend{
+		"etcd": func() testBackend {
+			db, fake := newFakeEtcdDB()
+			now := time.Now()
+			fake.now = func() time.Time { return now }
+			return testBackend{db: db, store: db, advance: func(d time.Duration) { now = now.Add(d) }}
+		},
+		"memory": func() testBackend {
+			db := NewMemDB()
+			db.owner = "test-owner"
+			now := time.Now()
+			db.now = func() time.Time { return now }
+			return testBackend{db: db, store: db, advance: func(d time.Duration) { now = now.Add(d) }}
+		},
+		"etcd3": func() testBackend {
+			// NOTE: This needs a real etcd and it wipes the netcore trees from it,
+			//       so it only runs when NETCORE_TEST_ETCD3 names a disposable one
+			db, err := NewEtcdV3DB(os.Getenv("NETCORE_TEST_ETCD3"))
+			if err != nil {
+				panic(err)
+			}
+			v3 := db.(EtcdV3DB)
+			v3.owner = "test-owner"
+			for _, tree := range etcdV2Trees {
+				ctx, cancel := etcdV3Context()
+				v3.client.Delete(ctx, "/"+tree+"/", clientv3.WithPrefix())
+				cancel()
+			}
+			return testBackend{db: v3, store: v3}
+		},
+	}
+}
+
+func runConformance(t *testing.T, test func(t *testing.T, b testBackend)) {
+	for name, newBackend := range testBackends() {
+		t.Run(name, func(t *testing.T) {
+			if name == "etcd3" && os.Getenv("NETCORE_TEST_ETCD3") == "" {
+				t.Skip("NETCORE_TEST_ETCD3 is not set")
+			}
+			test(t, newBackend())
+		})
+	}
+}
+
+func TestConformanceConfig(t *testing.T) {
+	os.Setenv("NETCORE_NAME", "core1")
+	defer os.Unsetenv("NETCORE_NAME")
+
+	runConformance(t, func(t *testing.T, b testBackend) {
+		if _, err := b.db.GetConfig(); err != ErrNoZone {
+			t.Fatalf("expected ErrNoZone, got %v", err)
+		}
+
+		values := map[string]string{
+			"core1/zone":               "office",
+			"core1/dhcpip":             "10.0.0.2",
+			"core1/dhcpnic":            "eth0",
+			"office/domain":            "office.example.com",
+			"office/subnet":            "10.0.0.0/24",
+			"office/gateway":           "10.0.0.1",
+			"office/dhcpsubnet":        "10.0.0.128/25",
+			"office/dhcpleaseduration": "60",
+			"office/dnscachemaxttl":    "300",
+		}
+		for key, value := range values {
+			if err := b.store.setConfigValue(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		cfg, err := b.db.GetConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Hostname() != "core1" || cfg.Zone() != "office" || cfg.Domain() != "office.example.com" {
+			t.Errorf("unexpected identity: %s %s %s", cfg.Hostname(), cfg.Zone(), cfg.Domain())
+		}
+		if !cfg.Gateway().Equal(net.ParseIP("10.0.0.1")) || !cfg.DHCPIP().Equal(net.ParseIP("10.0.0.2")) {
+			t.Errorf("unexpected addresses: %s %s", cfg.Gateway(), cfg.DHCPIP())
+		}
+		if cfg.DHCPSubnet().String() != "10.0.0.128/25" || cfg.DHCPNIC() != "eth0" {
+			t.Errorf("unexpected DHCP settings: %s %s", cfg.DHCPSubnet(), cfg.DHCPNIC())
+		}
+		if cfg.DHCPLeaseDuration() != time.Hour || cfg.DNSCacheMaxTTL() != 5*time.Minute || cfg.DNSCacheMissingTTL() != 30*time.Second {
+			t.Errorf("unexpected durations: %s %s %s", cfg.DHCPLeaseDuration(), cfg.DNSCacheMaxTTL(), cfg.DNSCacheMissingTTL())
+		}
+	})
+}
+
+func TestConformanceConfigWatch(t *testing.T) {
+	os.Setenv("NETCORE_NAME", "core1")
+	defer os.Unsetenv("NETCORE_NAME")
+
+	runConformance(t, func(t *testing.T, b testBackend) {
+		if _, ok := b.db.(ConfigWatcher); !ok {
+			t.Skip("backend can't watch for config changes")
+		}
+		values := map[string]string{
+			"core1/zone":     "office",
+			"office/domain":  "office.example.com",
+			"office/subnet":  "10.0.0.0/24",
+			"office/gateway": "10.0.0.1",
+		}
+		for key, value := range values {
+			if err := b.store.setConfigValue(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cfg, err := b.db.GetConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		changed := make(chan struct{}, 16)
+		cfg.OnChange(func() { changed <- struct{}{} })
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go watchConfig(cfg, stop)
+		time.Sleep(100 * time.Millisecond) // give the watch a chance to start
+
+		// A broken value is ignored and the current config kept
+		if err := b.store.setConfigValue("office/subnet", "bogus"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.store.setConfigValue("office/subnet", "10.0.0.0/16"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.store.setConfigValue("office/domain", "example.org"); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.After(5 * time.Second)
+		for cfg.Domain() != "example.org" {
+			select {
+			case <-changed:
+			case <-deadline:
+				t.Fatalf("config was not reloaded, domain is still %s", cfg.Domain())
+			}
+		}
+		if cfg.Subnet().String() != "10.0.0.0/16" {
+			t.Errorf("unexpected subnet after reload: %s", cfg.Subnet())
+		}
+	})
+}
+
+func TestConformanceLeases(t *testing.T) {
+	runConformance(t, func(t *testing.T, b testBackend) {
+		mac1, _ := net.ParseMAC("00:11:22:33:44:55")
+		mac2, _ := net.ParseMAC("00:11:22:33:44:66")
+		ip := net.ParseIP("10.0.0.130").To4()
+
+		if b.db.HasIP(ip) {
+			t.Fatal("expected an unleased IP")
+		}
+		if _, found, _ := b.db.GetMAC(mac1, true); found {
+			t.Fatal("expected an unknown MAC")
+		}
+
+		lease := &MACEntry{MAC: mac1, IP: ip, Duration: time.Hour}
+		if err := b.db.CreateLease(lease); err != nil {
+			t.Fatal(err)
+		}
+		if !b.db.HasIP(ip) {
+			t.Error("expected the IP to be leased")
+		}
+		entry, err := b.db.GetIP(ip)
+		if err != nil || entry.MAC.String() != mac1.String() {
+			t.Errorf("expected IP to belong to %s, got %s (%v)", mac1, entry.MAC, err)
+		}
+		macEntry, found, err := b.db.GetMAC(mac1, true)
+		if err != nil || !found {
+			t.Fatalf("expected the MAC to be found (%v)", err)
+		}
+		if !macEntry.IP.Equal(ip) || macEntry.Duration != time.Hour {
+			t.Errorf("unexpected lease: %s for %s", macEntry.IP, macEntry.Duration)
+		}
+
+		// Another MAC can neither take nor renew the address
+		if err := b.db.CreateLease(&MACEntry{MAC: mac2, IP: ip, Duration: time.Hour}); err != ErrLeaseConflict {
+			t.Errorf("expected a duplicate lease to conflict, got %v", err)
+		}
+		if err := b.db.RenewLease(&MACEntry{MAC: mac2, IP: ip, Duration: time.Hour}); err != ErrLeaseConflict {
+			t.Errorf("expected a renewal by another MAC to conflict, got %v", err)
+		}
+
+		if b.advance == nil {
+			return // the rest depends on controlling the clock
+		}
+
+		// Renewal extends the lease past its original expiration
+		b.advance(30 * time.Minute)
+		if err := b.db.RenewLease(&MACEntry{MAC: mac1, IP: ip, Duration: time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+		b.advance(45 * time.Minute)
+		if !b.db.HasIP(ip) {
+			t.Error("expected the renewed lease to still be held")
+		}
+
+		// Expiry releases the address
+		b.advance(time.Hour)
+		if b.db.HasIP(ip) {
+			t.Error("expected the lease to have expired")
+		}
+		if _, err := b.db.GetIP(ip); err == nil {
+			t.Error("expected the expired IP to be missing")
+		}
+		if macEntry, _, _ := b.db.GetMAC(mac1, true); macEntry.IP != nil {
+			t.Errorf("expected no IP for an expired lease, got %s", macEntry.IP)
+		}
+		if err := b.db.CreateLease(&MACEntry{MAC: mac2, IP: ip, Duration: time.Hour}); err != nil {
+			t.Errorf("expected the expired IP to be leasable again (%v)", err)
+		}
+	})
+}
+
+func TestConformanceDNS(t *testing.T) {
+	runConformance(t, func(t *testing.T, b testBackend) {
+		if _, err := b.db.GetDNS("host.example.com.", "A"); err != ErrNotFound {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+		if found, err := b.db.HasDNS("host.example.com.", "A"); err != nil || found {
+			t.Fatalf("expected no record (%v)", err)
+		}
+
+		if err := b.db.RegisterA("Host.Example.com.", net.ParseIP("10.0.0.130"), false, 60, 600); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.db.Register("host.example.com", "A", "10.0.0.131", nil, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.db.Register("example.com", "MX", "mail.example.com", map[string]string{"priority": "10"}, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		entry, err := b.db.GetDNS("host.example.com.", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.TTL != 60 || len(entry.Values) != 2 {
+			t.Fatalf("unexpected entry: %+v", entry)
+		}
+		if found, err := b.db.HasDNS("host.example.com", "A"); err != nil || !found {
+			t.Errorf("expected the record to exist (%v)", err)
+		}
+		ptr, err := b.db.GetDNS("130.0.0.10.in-addr.arpa.", "PTR")
+		if err != nil || len(ptr.Values) != 1 || ptr.Values[0].Value != "host.example.com" || ptr.TTL != 60 {
+			t.Errorf("unexpected PTR entry: %+v (%v)", ptr, err)
+		}
+		mx, err := b.db.GetDNS("example.com", "MX")
+		if err != nil || len(mx.Values) != 1 || mx.Values[0].Value != "mail.example.com" || mx.Values[0].Attr["priority"] != "10" {
+			t.Errorf("unexpected MX entry: %+v (%v)", mx, err)
+		}
+
+		if b.advance == nil {
+			return // the rest depends on controlling the clock
+		}
+
+		// The registered address expires while the permanent one remains
+		b.advance(10*time.Minute + time.Second)
+		entry, err = b.db.GetDNS("host.example.com.", "A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entry.Values) != 1 || entry.Values[0].Value != "10.0.0.131" || entry.Values[0].Expiration != nil {
+			t.Errorf("unexpected values after expiry: %+v", entry.Values)
+		}
+		if entry.TTL != 0 {
+			t.Errorf("expected the TTL to expire with the registration, got %d", entry.TTL)
+		}
+		if _, err := b.db.GetDNS("130.0.0.10.in-addr.arpa.", "PTR"); err != ErrNotFound {
+			t.Errorf("expected the PTR record to expire, got %v", err)
+		}
+	})
+}
+
+func TestConformanceNameExists(t *testing.T) {
+	runConformance(t, func(t *testing.T, b testBackend) {
+		if err := b.db.Register("www.lab.example.com", "A", "10.0.0.1", nil, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		for name, exists := range map[string]bool{
+			"www.lab.example.com.": true,
+			"lab.example.com":      true, // a name with nothing but names below it
+			"example.com":          true,
+			"ftp.lab.example.com":  false,
+			"example.org":          false,
+		} {
+			found, err := b.db.NameExists(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != exists {
+				t.Errorf("expected NameExists(%s) to be %v", name, exists)
+			}
+		}
+	})
+}
+
+func TestConformanceZoneSerial(t *testing.T) {
+	runConformance(t, func(t *testing.T, b testBackend) {
+		if keeper, ok := b.db.(SerialKeeper); ok {
+			stop := make(chan struct{})
+			defer close(stop)
+			go keeper.KeepSerials(stop)
+			time.Sleep(100 * time.Millisecond) // give the watch a chance to start
+		}
+		serial := func(zone string) uint32 {
+			t.Helper()
+			entry, err := b.db.GetDNS(zone, "SOA")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return soaSerial(entry)
+		}
+		rises := func(change string, err error, last uint32) uint32 {
+			t.Helper()
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := serial("example.com")
+			if next <= last {
+				t.Errorf("expected the serial to rise after %s, got %d then %d", change, last, next)
+			}
+			return next
+		}
+
+		if err := b.db.SetDNSMeta("example.com", "SOA", map[string]string{"ns": "ns1.example.com", "mbox": "hostmaster.example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		last := serial("example.com")
+		last = rises("adding a value", b.db.Register("www.example.com", "A", "10.0.0.1", nil, 0, 0), last)
+		last = rises("adding another", b.db.Register("www.example.com", "A", "10.0.0.2", nil, 0, 0), last)
+
+		// Renewing a value leaves it alone, but changing its attributes or the
+		// TTL of its set doesn't
+		if err := b.db.Register("www.example.com", "A", "10.0.0.2", nil, 0, 3600); err != nil {
+			t.Fatal(err)
+		}
+		if got := serial("example.com"); got != last {
+			t.Errorf("expected renewing a value to leave the serial at %d, got %d", last, got)
+		}
+		last = rises("changing the TTL of a set", b.db.Register("www.example.com", "A", "10.0.0.2", nil, 60, 0), last)
+		last = rises("adding a value with attributes", b.db.Register("example.com", "MX", "mail.example.com", map[string]string{"priority": "10"}, 0, 0), last)
+		last = rises("changing its attributes", b.db.Register("example.com", "MX", "mail.example.com", map[string]string{"priority": "20"}, 0, 0), last)
+		last = rises("removing a value", b.db.Unregister("www.example.com", "A", "10.0.0.1"), last)
+		last = rises("removing the last value of a set", b.db.Unregister("www.example.com", "A", "10.0.0.2"), last)
+		last = rises("adding a set", b.db.Register("mail.example.com", "A", "10.0.0.3", nil, 0, 0), last)
+		last = rises("removing a set", b.db.Unregister("mail.example.com", "A", ""), last)
+
+		// A copy of a primary's zone keeps the primary's serial
+		if err := b.db.SetDNSMeta("ad.example.com", "SOA", map[string]string{"primary": "dc1.ad.example.com", "serial": "7"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.db.Register("dc1.ad.example.com", "A", "10.0.0.5", nil, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got := serial("ad.example.com"); got != 7 {
+			t.Errorf("expected the primary's serial of 7, got %d", got)
+		}
+
+		if b.advance == nil {
+			return // the rest depends on controlling the clock
+		}
+
+		// The serial rises when a value expires, without anything being written
+		last = rises("adding an expiring value", b.db.Register("dhcp.example.com", "A", "10.0.0.130", nil, 60, 600), last)
+		b.advance(10*time.Minute + time.Second)
+		deadline := time.Now().Add(2 * time.Second)
+		for serial("example.com") <= last && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		rises("a value expiring", nil, last)
+
+		// A removed zone isn't brought back by a change below it
+		if err := b.db.Unregister("example.com", "SOA", ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.db.Register("www.example.com", "A", "10.0.0.1", nil, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.db.GetDNS("example.com", "SOA"); err != ErrNotFound {
+			t.Errorf("expected the zone to stay removed, got %v", err)
+		}
+	})
+}
+
+func TestConformanceClaimTransfer(t *testing.T) {
+	runConformance(t, func(t *testing.T, b testBackend) {
+		claimer, ok := b.db.(TransferClaimer)
+		if !ok {
+			t.Skip("not shared between instances")
+		}
+		var other TransferClaimer // another instance sharing the backend
+		switch db := b.db.(type) {
+		case EtcdDB:
+			db.owner = "other-owner"
+			other = db
+		case EtcdV3DB:
+			db.owner = "other-owner"
+			other = db
+		}
+
+		if claimed, err := claimer.ClaimTransfer("example.com.", 7); err != nil || !claimed {
+			t.Fatalf("expected the first claim to succeed, got %v %v", claimed, err)
+		}
+		if claimed, err := other.ClaimTransfer("example.com.", 7); err != nil || claimed {
+			t.Errorf("expected another instance's claim to fail, got %v %v", claimed, err)
+		}
+		if claimed, err := claimer.ClaimTransfer("example.com.", 7); err != nil || !claimed {
+			t.Errorf("expected the claim to be renewed by its holder, got %v %v", claimed, err)
+		}
+		if claimed, err := other.ClaimTransfer("example.com.", 8); err != nil || !claimed {
+			t.Errorf("expected the next serial to be claimed, got %v %v", claimed, err)
+		}
+	})
+}
+
+func TestConformanceListAndDelete(t *testing.T) {
+	runConformance(t, func(t *testing.T, b testBackend) {
+		mac1, _ := net.ParseMAC("00:11:22:33:44:55")
+		mac2, _ := net.ParseMAC("00:11:22:33:44:66")
+		ip1 := net.ParseIP("10.0.0.130").To4()
+		ip2 := net.ParseIP("10.0.0.131").To4()
+
+		// Leases and reservations
+		if err := b.db.CreateLease(&MACEntry{MAC: mac2, IP: ip2, Duration: time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.db.CreateLease(&MACEntry{MAC: mac1, IP: ip1}); err != nil {
+			t.Fatal(err)
+		}
+		leases, err := b.db.ListLeases()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(leases) != 2 || !leases[0].IP.Equal(ip1) || !leases[0].Reserved() || !leases[1].IP.Equal(ip2) || leases[1].Reserved() {
+			t.Fatalf("unexpected leases: %+v", leases)
+		}
+		if err := b.db.DeleteLease(mac1); err != nil {
+			t.Fatal(err)
+		}
+		if b.db.HasIP(ip1) {
+			t.Error("expected the deleted lease to release its IP")
+		}
+		if err := b.db.DeleteLease(mac1); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound deleting a missing lease, got %v", err)
+		}
+
+		// DNS records
+		b.db.RegisterA("host.example.com", ip1, false, 60, 0)
+		b.db.Register("www.example.com", "CNAME", "host.example.com", nil, 0, 0)
+		b.db.Register("example.com", "MX", "mail.example.com", map[string]string{"priority": "10"}, 0, 0)
+		b.db.Register("example.org", "A", "10.0.0.1", nil, 0, 0)
+		records, err := b.db.ListDNS("example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var listed []string
+		for _, record := range records {
+			listed = append(listed, record.Name+" "+record.Type)
+		}
+		if strings.Join(listed, ", ") != "example.com MX, host.example.com A, www.example.com CNAME" {
+			t.Errorf("unexpected records: %s", strings.Join(listed, ", "))
+		}
+		if all, _ := b.db.ListDNS(""); len(all) != 5 { // including the PTR record
+			t.Errorf("expected 5 records in all, got %d", len(all))
+		}
+
+		if err := b.db.Unregister("example.com", "MX", "mail.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.db.GetDNS("example.com", "MX"); err != ErrNotFound {
+			t.Errorf("expected the MX record to be gone, got %v", err)
+		}
+		if err := b.db.Unregister("www.example.com", "CNAME", ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.db.GetDNS("www.example.com", "CNAME"); err != ErrNotFound {
+			t.Errorf("expected the CNAME record to be gone, got %v", err)
+		}
+		if err := b.db.Unregister("www.example.com", "CNAME", ""); err != ErrNotFound {
+			t.Errorf("expected ErrNotFound unregistering a missing record, got %v", err)
+		}
+	})
+}
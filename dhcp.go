@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/binary"
-	"log"
+	"errors"
 	"net"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/krolaw/dhcp4"
@@ -18,10 +20,14 @@ type DHCPDB interface {
 	RenewLease(lease *MACEntry) error
 	CreateLease(lease *MACEntry) error
 	WriteLease(lease *MACEntry) error
+	ListLeases() ([]*MACEntry, error)
+	DeleteLease(mac net.HardwareAddr) error
 }
 
 // DHCPService is the DHCP server instance
 type DHCPService struct {
+	sync.RWMutex   // guards the settings below, which change when the config is reloaded
+	nic            string
 	ip             net.IP
 	domain         string
 	subnet         *net.IPNet
@@ -29,6 +35,10 @@ type DHCPService struct {
 	leaseDuration  time.Duration
 	defaultOptions dhcp4.Options // FIXME: make different options per pool?
 	db             DB
+	poolAlerts     *poolAlerter
+	dbHealth       *dbHealth
+	stopping       bool          // set once the service is shut down, after which nothing is answered
+	stop           chan struct{} // closed when the service is shut down, to stop its background checks
 }
 
 type IPEntry struct {
@@ -42,148 +52,349 @@ type MACEntry struct {
 	Attr     map[string]string
 }
 
+// Reserved returns true if the entry holds an IP address that never expires,
+// which is how reservations are stored
+func (e *MACEntry) Reserved() bool {
+	return e.IP != nil && e.Duration == 0
+}
+
+// ErrLeaseConflict is returned when a lease is written for an IP address that
+// is already leased to a different MAC address
+var ErrLeaseConflict = errors.New("The IP address is leased to another MAC address.")
+
 const minimumLeaseDuration = 60 * time.Second // FIXME: put this in a config
 
-func dhcpSetup(cfg *Config) chan error {
+const leaseCheckInterval = 15 * time.Minute // FIXME: put this in a config
+
+// LeaseChecker is implemented by backends that store the IP and MAC sides of a
+// lease separately, and so can end up with one side missing
+type LeaseChecker interface {
+	// CheckLeases finds IP keys whose MAC doesn't point back at them and MAC
+	// keys whose IP doesn't point back at them. If repair is true then each
+	// one found is fixed: an IP key gets its missing MAC key restored or is
+	// removed if the MAC has moved on to another IP, and a MAC key is removed.
+	CheckLeases(repair bool) (LeaseCheckResult, error)
+}
+
+// LeaseCheckResult lists the inconsistent lease keys found by CheckLeases
+type LeaseCheckResult struct {
+	OrphanedIPs  []net.IP
+	OrphanedMACs []net.HardwareAddr
+}
+
+func dhcpSetup(cfg *Config, health *dbHealth) service {
 	cfg.db.InitDHCP()
-	exit := make(chan error, 1)
-	go func() {
-		d := &DHCPService{
-			ip:            cfg.DHCPIP(),
-			leaseDuration: cfg.DHCPLeaseDuration(),
-			db:            cfg.db,
-			subnet:        cfg.Subnet(),
-			guestPool:     cfg.DHCPSubnet(),
-			domain:        cfg.Domain(),
-			defaultOptions: dhcp4.Options{
-				dhcp4.OptionSubnetMask:       net.IP(cfg.Subnet().Mask),
-				dhcp4.OptionRouter:           cfg.Gateway(),
-				dhcp4.OptionDomainNameServer: cfg.DHCPIP(),
-			},
-		}
-		dhcpTFTP := cfg.DHCPTFTP()
-		if dhcpTFTP != "" {
-			d.defaultOptions[dhcp4.OptionTFTPServerName] = []byte(dhcpTFTP)
-		}
-		exit <- dhcp4.ListenAndServeIf(cfg.DHCPNIC(), d)
-	}()
-	return exit
+	d := &DHCPService{
+		nic:        cfg.DHCPNIC(),
+		db:         cfg.db,
+		poolAlerts: newPoolAlerter(cfg),
+		dbHealth:   health,
+		stop:       make(chan struct{}),
+	}
+	if checker, ok := cfg.db.(LeaseChecker); ok {
+		go leaseCheckLoop(checker, d.stop)
+	}
+	go d.poolAlerts.run(d.stop)
+	d.configure(cfg)
+	cfg.OnChange(func() { d.configure(cfg) })
+	return service{
+		name: "dhcp",
+		run: func(ready func()) error {
+			ready() // FIXME: dhcp4 doesn't tell us once it's listening
+			return dhcp4.ListenAndServeIf(d.nic, d)
+		},
+		stop: d.shutdown,
+	}
+}
+
+// shutdown stops the service from answering anything more, once the requests
+// already being handled (and their etcd writes) have finished. The listener
+// itself stays open until we exit because dhcp4 has no way of closing it.
+// The lease and pool checks are stopped too.
+func (d *DHCPService) shutdown() {
+	d.Lock() // waits for ServeDHCP to finish with its read lock
+	defer d.Unlock()
+	if !d.stopping {
+		close(d.stop)
+	}
+	d.stopping = true
+}
+
+// configure applies the settings in cfg to the service. The NIC can't be
+// changed without restarting, and a config without a DHCP IP or pool is
+// ignored so that the service keeps running with what it had.
+func (d *DHCPService) configure(cfg *Config) {
+	ip, guestPool := cfg.DHCPIP(), cfg.DHCPSubnet()
+	if ip == nil || guestPool == nil {
+		dhcpLog.Warn("config no longer has an IP and pool assigned; keeping the current settings until restarted")
+		return
+	}
+	if nic := cfg.DHCPNIC(); nic != d.nic {
+		dhcpLog.Warn("NIC changed; this takes effect when restarted", "from", d.nic, "to", nic)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.ip = ip
+	d.leaseDuration = cfg.DHCPLeaseDuration()
+	d.subnet = cfg.Subnet()
+	d.guestPool = guestPool
+	d.domain = cfg.Domain()
+	d.defaultOptions = dhcp4.Options{
+		dhcp4.OptionSubnetMask:       net.IP(d.subnet.Mask),
+		dhcp4.OptionRouter:           cfg.Gateway(),
+		dhcp4.OptionDomainNameServer: ip,
+	}
+	if dhcpTFTP := cfg.DHCPTFTP(); dhcpTFTP != "" {
+		d.defaultOptions[dhcp4.OptionTFTPServerName] = []byte(dhcpTFTP)
+	}
+}
+
+// macEntriesByMAC sorts lease entries by MAC address
+type macEntriesByMAC []*MACEntry
+
+func (s macEntriesByMAC) Len() int           { return len(s) }
+func (s macEntriesByMAC) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s macEntriesByMAC) Less(i, j int) bool { return s[i].MAC.String() < s[j].MAC.String() }
+
+// PoolUsage is how many of the addresses in a zone's DHCP pool are taken
+type PoolUsage struct {
+	Zone   string
+	Pool   *net.IPNet
+	Size   int // the addresses that can be handed out
+	Leased int // those that are leased or reserved
+}
+
+// dhcpPoolUsage works out the PoolUsage of every zone that has a DHCP pool,
+// which is its own dhcpsubnet setting or otherwise the global one
+func dhcpPoolUsage(db DB) ([]PoolUsage, error) {
+	zones, err := listConfigObjects(db, "zone")
+	if err != nil {
+		return nil, err
+	}
+	global, err := listConfigObjects(db, "global")
+	if err != nil {
+		return nil, err
+	}
+	leases, err := db.ListLeases()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pools []PoolUsage
+	for _, name := range names {
+		value := zones[name]["dhcpsubnet"]
+		if value == "" {
+			value = global[configGlobal]["dhcpsubnet"]
+		}
+		_, pool, err := net.ParseCIDR(value)
+		if err != nil {
+			continue
+		}
+		pools = append(pools, countPoolUsage(name, pool, leases))
+	}
+	return pools, nil
+}
+
+// countPoolUsage works out how many addresses in pool are taken by leases
+func countPoolUsage(zone string, pool *net.IPNet, leases []*MACEntry) PoolUsage {
+	ones, bits := pool.Mask.Size()
+	usage := PoolUsage{Zone: zone, Pool: pool, Size: 1<<uint(bits-ones) - 1} // all but the first, as getIPFromPool does
+	for _, lease := range leases {
+		if pool.Contains(lease.IP) && !lease.IP.Equal(pool.IP) {
+			usage.Leased++
+		}
+	}
+	return usage
+}
+
+// Percent returns how much of the pool is taken, rounded down
+func (u PoolUsage) Percent() int {
+	if u.Size <= 0 {
+		return 100
+	}
+	return u.Leased * 100 / u.Size
+}
+
+// leaseCheckLoop periodically finds and repairs inconsistent lease keys until
+// stop is closed
+func leaseCheckLoop(checker LeaseChecker, stop <-chan struct{}) {
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		result, err := checker.CheckLeases(true)
+		if err != nil {
+			dhcpLog.Error("lease check failed", "err", err)
+			continue
+		}
+		for _, ip := range result.OrphanedIPs {
+			dhcpLog.Warn("lease check repaired orphaned IP", "ip", ip.String())
+		}
+		for _, mac := range result.OrphanedMACs {
+			dhcpLog.Warn("lease check repaired orphaned MAC", "mac", mac.String())
+		}
+	}
 }
 
 // ServeDHCP is called by dhcp4.ListenAndServe when the service is started
 func (d *DHCPService) ServeDHCP(packet dhcp4.Packet, msgType dhcp4.MessageType, reqOptions dhcp4.Options) (response dhcp4.Packet) {
+	d.RLock()
+	defer d.RUnlock()
+	if d.stopping {
+		return nil
+	}
+
+	outcome := "ignored"
+	logger := dhcpLog.With("type", strings.ToLower(msgType.String()), "mac", packet.CHAddr().String())
+	defer func() {
+		dhcpMessages.WithLabelValues(strings.ToLower(msgType.String()), outcome).Inc()
+		logger.Debug("handled", "outcome", outcome)
+	}()
+
+	// Without etcd we can't tell which addresses are free, and saying nothing
+	// lets clients keep their leases or ask another server instead of being
+	// refused
+	if !d.dbHealth.Reachable() {
+		outcome = "unavailable"
+		return nil
+	}
+
 	switch msgType {
 	case dhcp4.Discover:
 		// RFC 2131 4.3.1
-		// FIXME: send to StatHat and/or increment a counter
 		mac := packet.CHAddr()
 
 		// Check MAC blacklist
 		if !d.isMACPermitted(mac) {
-			log.Printf("DHCP Discover from %s\n is not permitted", mac.String())
+			logger.Info("not permitted")
+			outcome = "denied"
 			return nil
 		}
-		log.Printf("DHCP Discover from %s\n", mac.String())
+		logger.Debug("received")
 
 		// Look up the MAC entry with cascaded attributes
 		lease, found, err := d.db.GetMAC(mac, true)
 		if err != nil {
+			outcome = "error"
 			return nil
 		}
 
 		// Existing Lease
-		if found {
+		if found && lease.IP != nil {
 			options := d.getOptionsFromMAC(lease)
-			log.Printf("DHCP Discover from %s (we offer %s from current lease)\n", lease.MAC.String(), lease.IP.String())
+			logger.Info("offer from current lease", "ip", lease.IP.String())
 			// for x, y := range reqOptions {
 			// 	log.Printf("\tR[%v] %v %s\n", x, y, y)
 			// }
 			// for x, y := range options {
 			// 	log.Printf("\tO[%v] %v %s\n", x, y, y)
 			// }
-			return dhcp4.ReplyPacket(packet, dhcp4.Offer, d.ip.To4(), lease.IP.To4(), d.getLeaseDurationForRequest(reqOptions, lease.Duration), options.SelectOrderOrAll(reqOptions[dhcp4.OptionParameterRequestList]))
+			duration := lease.Duration
+			if lease.Reserved() {
+				duration = d.leaseDuration
+			}
+			outcome = "offer"
+			return dhcp4.ReplyPacket(packet, dhcp4.Offer, d.ip.To4(), lease.IP.To4(), d.getLeaseDurationForRequest(reqOptions, duration), options.SelectOrderOrAll(reqOptions[dhcp4.OptionParameterRequestList]))
 		}
 
 		// New Lease
 		ip := d.getIPFromPool()
 		if ip != nil {
 			options := d.getOptionsFromMAC(lease)
-			log.Printf("DHCP Discover from %s (we offer %s from pool)\n", mac.String(), ip.String())
+			logger.Info("offer from pool", "ip", ip.String())
 			// for x, y := range reqOptions {
 			// 	log.Printf("\tR[%v] %v %s\n", x, y, y)
 			// }
 			// for x, y := range options {
 			// 	log.Printf("\tO[%v] %v %s\n", x, y, y)
 			// }
+			outcome = "offer"
 			return dhcp4.ReplyPacket(packet, dhcp4.Offer, d.ip.To4(), ip.To4(), d.getLeaseDurationForRequest(reqOptions, d.leaseDuration), options.SelectOrderOrAll(reqOptions[dhcp4.OptionParameterRequestList]))
 		}
 
-		log.Printf("DHCP Discover from %s (no offer due to no addresses available in pool)\n", mac.String())
-		// FIXME: Send to StatHat and/or increment a counter
-		// TODO: Send an email?
+		logger.Warn("no offer, as there are no addresses available in the pool")
+		outcome = "exhausted"
+		d.poolAlerts.Check()
 
 		return nil
 
 	case dhcp4.Request:
 		// RFC 2131 4.3.2
-		// FIXME: send to StatHat and/or increment a counter
 		mac := packet.CHAddr()
 
 		// Check MAC blacklist
 		if !d.isMACPermitted(mac) {
-			log.Printf("DHCP Request from %s\n is not permitted", mac.String())
+			logger.Info("not permitted")
+			outcome = "denied"
 			return nil
 		}
 
 		// Check IP presence
 		state, requestedIP := d.getRequestState(packet, reqOptions)
-		log.Printf("DHCP Request (%s) from %s...\n", state, mac.String())
+		logger = logger.With("state", state, "ip", requestedIP.String())
+		logger.Debug("received")
 		if len(requestedIP) == 0 || requestedIP.IsUnspecified() { // no IP provided at all... why? FIXME
-			log.Printf("DHCP Request (%s) from %s (empty IP, so we're just ignoring this request)\n", state, mac.String())
+			logger.Info("ignored, as no IP was given")
 			return nil
 		}
 
 		// Check IPv4
 		if len(requestedIP) != net.IPv4len {
-			log.Printf("DHCP Request (%s) from %s wanting %s (IPv6 address requested, so we're just ignoring this request)\n", state, mac.String(), requestedIP.String())
+			logger.Info("ignored, as an IPv6 address was requested")
 			return nil
 		}
 
 		// Check IP subnet
 		if !d.subnet.Contains(requestedIP) {
-			log.Printf("DHCP Request (%s) from %s wanting %s (we reject due to wrong subnet)\n", state, mac.String(), requestedIP.String())
+			logger.Info("rejected, as the IP is in the wrong subnet")
+			outcome = "nak"
 			return dhcp4.ReplyPacket(packet, dhcp4.NAK, d.ip.To4(), nil, 0, nil)
 		}
 
 		// Check Target Server
 		targetServerIP := packet.SIAddr()
 		if len(targetServerIP) > 0 && !targetServerIP.IsUnspecified() {
-			log.Printf("DHCP Request (%s) from %s wanting %s is in response to a DHCP offer from %s\n", state, mac.String(), requestedIP.String(), targetServerIP.String())
+			logger.Debug("in response to an offer", "server", targetServerIP.String())
 			if d.ip.Equal(targetServerIP) {
 				return nil
 			}
 		}
 
 		// Process Request
-		log.Printf("DHCP Request (%s) from %s wanting %s...\n", state, mac.String(), requestedIP.String())
 		lease, found, err := d.db.GetMAC(mac, true)
 		if err != nil {
+			outcome = "error"
 			return nil
 		}
 
-		if found {
+		if found && lease.IP != nil {
 			// Existing Lease
+			reserved := lease.Reserved()
 			lease.Duration = d.getLeaseDurationForRequest(reqOptions, d.leaseDuration)
 			if lease.IP.Equal(requestedIP) {
-				err = d.db.RenewLease(lease)
+				if !reserved { // renewing would put an expiration on the reservation
+					err = d.db.RenewLease(lease)
+				}
 			} else {
-				log.Printf("DHCP Request (%s) from %s wanting %s (we reject due to lease mismatch, should be %s)\n", state, lease.MAC.String(), requestedIP.String(), lease.IP.String())
+				logger.Info("rejected, as the MAC is leased another IP", "leased", lease.IP.String())
+				outcome = "nak"
 				return dhcp4.ReplyPacket(packet, dhcp4.NAK, d.ip.To4(), nil, 0, nil)
 			}
 		} else {
 			// Check IP subnet is within the guestPool (we don't want users requesting non-pool addresses unless we assigned it to their MAC, administratively)
 			if !d.guestPool.Contains(requestedIP) {
-				log.Printf("DHCP Request (%s) from %s wanting %s (we reject due to not being within the guestPool)\n", state, mac.String(), requestedIP.String())
+				logger.Info("rejected, as the IP isn't in the pool")
+				outcome = "nak"
 				return dhcp4.ReplyPacket(packet, dhcp4.NAK, d.ip.To4(), nil, 0, nil)
 			}
 
@@ -196,42 +407,49 @@ func (d *DHCPService) ServeDHCP(packet dhcp4.Packet, msgType dhcp4.MessageType,
 			err = d.db.CreateLease(lease)
 		}
 
+		if err != nil && err != ErrLeaseConflict {
+			logger.Warn("not acknowledged, as the lease couldn't be written", "err", err)
+			outcome = "error"
+			return nil
+		}
+
 		if err == nil {
 			d.maintainDNSRecords(lease, packet, reqOptions) // TODO: Move this?
 			options := d.getOptionsFromMAC(lease)
-			log.Printf("DHCP Request (%s) from %s wanting %s (we agree)\n", state, mac.String(), requestedIP.String())
+			logger.Info("acknowledged", "duration", lease.Duration.String())
+			outcome = "ack"
 			return dhcp4.ReplyPacket(packet, dhcp4.ACK, d.ip.To4(), requestedIP.To4(), lease.Duration, options.SelectOrderOrAll(reqOptions[dhcp4.OptionParameterRequestList]))
 		}
 
-		log.Printf("DHCP Request (%s) from %s wanting %s (we reject due to address collision)\n", state, mac.String(), requestedIP.String())
+		logger.Info("rejected, as the IP is leased to another MAC", "err", err)
+		outcome = "nak"
 		return dhcp4.ReplyPacket(packet, dhcp4.NAK, d.ip.To4(), nil, 0, nil)
 
 	case dhcp4.Decline:
 		// RFC 2131 4.3.3
-		// FIXME: release from DB?  tick a flag?  increment a counter?  send to StatHat?
-		mac := packet.CHAddr()
-		log.Printf("DHCP Decline from %s\n", mac.String())
+		// FIXME: release from DB?  tick a flag?
+		logger.Info("received")
 
 	case dhcp4.Release:
 		// RFC 2131 4.3.4
-		// FIXME: release from DB?  tick a flag?  increment a counter?  send to StatHat?
-		mac := packet.CHAddr()
-		log.Printf("DHCP Release from %s\n", mac.String())
+		// FIXME: release from DB?  tick a flag?
+		logger.Info("received")
 
 	case dhcp4.Inform:
 		// RFC 2131 4.3.5
 		// https://tools.ietf.org/html/draft-ietf-dhc-dhcpinform-clarify-06
-		// FIXME: release from DB?  tick a flag?  increment a counter?  send to StatHat?
+		// FIXME: release from DB?  tick a flag?
 		// FIXME: we should reply with valuable info, but not assign an IP to this client, per RFC 2131 for DHCPINFORM
 		// NOTE: the client's IP is supposed to only be in the ciaddr field, not the requested IP field, per RFC 2131 4.4.3
 		mac := packet.CHAddr()
 		ip := packet.CIAddr()
 		if len(ip) > 0 && !ip.IsUnspecified() {
-			log.Printf("DHCP Inform from %s for %s \n", mac.String(), ip.String())
+			logger.Info("received", "ip", ip.String())
 			if len(ip) == net.IPv4len && d.guestPool.Contains(ip) {
 				entry, found, _ := d.db.GetMAC(mac, true)
 				if found {
 					options := d.getOptionsFromMAC(entry)
+					outcome = "ack"
 					return informReplyPacket(packet, dhcp4.ACK, d.ip.To4(), options.SelectOrderOrAll(reqOptions[dhcp4.OptionParameterRequestList]))
 				}
 			}
@@ -308,10 +526,10 @@ func (d *DHCPService) maintainDNSRecords(entry *MACEntry, packet dhcp4.Packet, r
 			// TODO: Pick a TTL for the record and use it
 			d.db.RegisterA(host, entry.IP, false, 0, uint64(d.leaseDuration.Seconds()+0.5))
 		} else {
-			log.Println(">> No host name")
+			dhcpLog.Debug("no DNS record, as there's no host name", "mac", entry.MAC.String())
 		}
 	} else {
-		log.Println(">> No domain name")
+		dhcpLog.Debug("no DNS record, as there's no domain name", "mac", entry.MAC.String())
 	}
 }
 
@@ -320,7 +538,6 @@ func (d *DHCPService) getOptionsFromMAC(entry *MACEntry) dhcp4.Options {
 
 	for i := range d.defaultOptions {
 		options[i] = d.defaultOptions[i]
-		log.Printf("OPTION:[%d][%+v]\n", i, d.defaultOptions[i])
 	}
 
 	{ // Subnet Mask
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"errors"
 	"net"
+	"path"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,7 +18,7 @@ func (db EtcdDB) GetIP(ip net.IP) (IPEntry, error) {
 	key := etcdKeyFromIP(ip)
 	response, err := db.client.Get(key, false, false)
 	if response == nil || response.Node == nil {
-		return IPEntry{}, errors.New("Not Found")
+		return IPEntry{}, ErrNotFound
 	}
 	mac, err := net.ParseMAC(response.Node.Value)
 	if err != nil {
@@ -51,11 +52,12 @@ func (db EtcdDB) GetMAC(mac net.HardwareAddr, cascade bool) (*MACEntry, bool, er
 	// Fetch attributes and lease data for this MAC
 	key := etcdKeyFromMAC(mac)
 	response, err := db.client.Get(key, true, true) // do the lookup
-	if err != nil {
-		// FIXME: Return the etcd error for everything except missing keys
-		//return nil, false, err
+	if etcdKeyNotFound(err) {
 		return &entry, false, nil
 	}
+	if err != nil {
+		return nil, false, err
+	}
 
 	if response.Node == nil || !response.Node.Dir {
 		// Not found
@@ -68,22 +70,50 @@ func (db EtcdDB) GetMAC(mac net.HardwareAddr, cascade bool) (*MACEntry, bool, er
 	return &entry, true, nil
 }
 
+// RenewLease extends the lease on the IP key, which must already belong to the
+// lease's MAC address, and then the MAC key. If the MAC key can't be written
+// then the IP key is returned to its previous expiration.
 func (db EtcdDB) RenewLease(lease *MACEntry) error {
 	// FIXME: Validate lease
+	ipKey := "dhcp/" + lease.IP.String()
 	duration := uint64(lease.Duration.Seconds() + 0.5) // Half second jitter to hide network delay
-	_, err := db.client.CompareAndSwap("dhcp/"+lease.IP.String(), lease.MAC.String(), duration, lease.MAC.String(), 0)
-	if err == nil {
-		return db.WriteLease(lease)
+	response, err := db.client.CompareAndSwap(ipKey, lease.MAC.String(), duration, lease.MAC.String(), 0)
+	if etcdCompareFailed(err) || etcdKeyNotFound(err) {
+		return ErrLeaseConflict
+	}
+	if err != nil {
+		return err
+	}
+	err = db.WriteLease(lease)
+	if err != nil && response != nil && response.PrevNode != nil && response.PrevNode.TTL > 0 {
+		_, rollbackErr := db.client.CompareAndSwap(ipKey, lease.MAC.String(), uint64(response.PrevNode.TTL), lease.MAC.String(), 0)
+		if rollbackErr != nil {
+			etcdLog.Error("lease renewal rollback failed", "key", ipKey, "err", rollbackErr)
+		}
 	}
 	return err
 }
 
+// CreateLease claims the IP key for the lease's MAC address and then writes the
+// MAC key. If the MAC key can't be written then the IP key is released again so
+// that the address isn't left taken with no MAC pointing at it.
 func (db EtcdDB) CreateLease(lease *MACEntry) error {
 	// FIXME: Validate lease
+	ipKey := "dhcp/" + lease.IP.String()
 	duration := uint64(lease.Duration.Seconds() + 0.5)
-	_, err := db.client.Create("dhcp/"+lease.IP.String(), lease.MAC.String(), duration)
-	if err == nil {
-		return db.WriteLease(lease)
+	_, err := db.client.Create(ipKey, lease.MAC.String(), duration)
+	if etcdKeyExists(err) {
+		return ErrLeaseConflict
+	}
+	if err != nil {
+		return err
+	}
+	err = db.WriteLease(lease)
+	if err != nil {
+		_, rollbackErr := db.client.CompareAndDelete(ipKey, lease.MAC.String(), 0)
+		if rollbackErr != nil {
+			etcdLog.Error("lease creation rollback failed", "key", ipKey, "err", rollbackErr)
+		}
 	}
 	return err
 }
@@ -92,10 +122,140 @@ func (db EtcdDB) WriteLease(lease *MACEntry) error {
 	// FIXME: Validate lease
 	// NOTE: This does not save attributes. That should probably happen in a different function.
 	duration := uint64(lease.Duration.Seconds() + 0.5) // Half second jitter to hide network delay
-	// FIXME: Decide what to do if either of these calls returns an error
-	db.client.CreateDir("dhcp/"+lease.MAC.String(), 0)
-	db.client.Set("dhcp/"+lease.MAC.String()+"/ip", lease.IP.String(), duration)
-	return nil
+	_, err := db.client.CreateDir("dhcp/"+lease.MAC.String(), 0)
+	if err != nil && !etcdKeyExists(err) {
+		return err
+	}
+	_, err = db.client.Set("dhcp/"+lease.MAC.String()+"/ip", lease.IP.String(), duration)
+	return err
+}
+
+func (db EtcdDB) ListLeases() ([]*MACEntry, error) {
+	response, err := db.client.Get("dhcp", true, true)
+	if etcdKeyNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var leases []*MACEntry
+	for _, node := range response.Node.Nodes {
+		if !node.Dir {
+			continue
+		}
+		mac, err := net.ParseMAC(path.Base(node.Key))
+		if err != nil {
+			continue
+		}
+		entry := MACEntry{MAC: mac}
+		etcdNodeToMACEntry(node, &entry)
+		if entry.IP != nil {
+			leases = append(leases, &entry)
+		}
+	}
+	sort.Sort(macEntriesByMAC(leases))
+	return leases, nil
+}
+
+// DeleteLease releases the IP address held by mac, keeping any attributes. The
+// IP key is only removed if it still belongs to mac.
+func (db EtcdDB) DeleteLease(mac net.HardwareAddr) error {
+	macKey := "dhcp/" + mac.String() + "/ip"
+	response, err := db.client.Get(macKey, false, false)
+	if etcdKeyNotFound(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = db.client.CompareAndDelete("dhcp/"+response.Node.Value, mac.String(), 0)
+	if err != nil && !etcdKeyNotFound(err) && !etcdCompareFailed(err) {
+		return err
+	}
+	_, err = db.client.CompareAndDelete(macKey, response.Node.Value, response.Node.ModifiedIndex)
+	return err
+}
+
+func (db EtcdDB) CheckLeases(repair bool) (LeaseCheckResult, error) {
+	var result LeaseCheckResult
+	response, err := db.client.Get("dhcp", true, true)
+	if etcdKeyNotFound(err) {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	// Gather both sides of every lease
+	ipKeys := make(map[string]*etcd.Node)  // IP -> dhcp/<ip>
+	macKeys := make(map[string]*etcd.Node) // MAC -> dhcp/<mac>/ip
+	for _, node := range response.Node.Nodes {
+		name := path.Base(node.Key)
+		if !node.Dir {
+			if ip := net.ParseIP(name); ip != nil {
+				ipKeys[ip.String()] = node
+			}
+			continue
+		}
+		mac, err := net.ParseMAC(name)
+		if err != nil {
+			continue
+		}
+		for _, child := range node.Nodes {
+			if !child.Dir && path.Base(child.Key) == "ip" {
+				macKeys[mac.String()] = child
+			}
+		}
+	}
+
+	for ipString, ipNode := range ipKeys {
+		ip := net.ParseIP(ipString)
+		mac, err := net.ParseMAC(ipNode.Value)
+		if err != nil {
+			continue // not something we know how to fix
+		}
+		macNode, ok := macKeys[mac.String()]
+		if ok && net.ParseIP(macNode.Value).Equal(ip) {
+			continue
+		}
+		result.OrphanedIPs = append(result.OrphanedIPs, ip)
+		if !repair {
+			continue
+		}
+		if ok {
+			// The MAC has moved on to another IP, so this one is stale
+			_, err = db.client.CompareAndDelete(ipNode.Key, ipNode.Value, ipNode.ModifiedIndex)
+		} else {
+			// The MAC side of the lease never got written, so restore it
+			err = db.WriteLease(&MACEntry{MAC: mac, IP: ip, Duration: time.Duration(ipNode.TTL) * time.Second})
+			if err == nil {
+				macKeys[mac.String()] = &etcd.Node{Value: ip.String()}
+			}
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+
+	for macString, macNode := range macKeys {
+		ipNode, ok := ipKeys[net.ParseIP(macNode.Value).String()]
+		if ok {
+			if mac, err := net.ParseMAC(ipNode.Value); err == nil && mac.String() == macString {
+				continue
+			}
+		}
+		mac, _ := net.ParseMAC(macString)
+		result.OrphanedMACs = append(result.OrphanedMACs, mac)
+		if !repair {
+			continue
+		}
+		_, err = db.client.CompareAndDelete(macNode.Key, macNode.Value, macNode.ModifiedIndex)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
 }
 
 // TODO: Write function for saving attributes to etcd?
@@ -109,7 +269,7 @@ func etcdNodeToMACEntry(root *etcd.Node, entry *MACEntry) {
 		switch key {
 		case "ip":
 			entry.IP = net.ParseIP(node.Value)
-			entry.Duration = time.Duration(node.TTL)
+			entry.Duration = time.Duration(node.TTL) * time.Second
 		default:
 			if entry.Attr == nil {
 				entry.Attr = make(map[string]string)
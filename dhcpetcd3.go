@@ -0,0 +1,327 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+func (db EtcdV3DB) InitDHCP() {}
+
+func (db EtcdV3DB) GetIP(ip net.IP) (IPEntry, error) {
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Get(ctx, etcdKeyFromIP(ip))
+	if err != nil {
+		return IPEntry{}, err
+	}
+	if len(response.Kvs) == 0 {
+		return IPEntry{}, ErrNotFound
+	}
+	mac, err := net.ParseMAC(string(response.Kvs[0].Value))
+	if err != nil {
+		return IPEntry{}, err
+	}
+	return IPEntry{MAC: mac}, nil
+}
+
+func (db EtcdV3DB) HasIP(ip net.IP) bool {
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Get(ctx, etcdKeyFromIP(ip), clientv3.WithCountOnly())
+	return err == nil && response.Count > 0
+}
+
+func (db EtcdV3DB) GetMAC(mac net.HardwareAddr, cascade bool) (*MACEntry, bool, error) {
+	entry := MACEntry{MAC: mac}
+
+	// Copy cascaded attributes by making recursive calls to this function
+	if cascade && len(mac) > 1 {
+		parent, _, _ := db.GetMAC(mac[0:len(mac)-1], cascade) // Chop off the last byte for each recursive call
+		if parent != nil {
+			entry.Attr = parent.Attr
+		}
+	}
+
+	prefix := etcdKeyFromMAC(mac) + "/"
+	ctx, cancel := etcdV3Context()
+	response, err := db.client.Get(ctx, prefix, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(response.Kvs) == 0 {
+		// NOTE: Retuning the entry is necessary for recursive calls
+		return &entry, false, nil
+	}
+
+	expirations, err := db.leaseExpirations(response.Kvs, func(key string) bool {
+		return key == prefix+"expires"
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	for _, kv := range response.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), prefix)
+		if strings.Contains(key, "/") {
+			continue // Ignore subdirectories
+		}
+		switch key {
+		case "ip":
+			expiration, ok := expirations[kv.Lease]
+			if kv.Lease != 0 && !ok {
+				continue // the lease has run out, so it mustn't look like a reservation
+			}
+			entry.IP = net.ParseIP(string(kv.Value))
+			if ok {
+				entry.Duration = time.Until(expiration).Round(time.Second)
+			}
+		case "expires":
+			// Already read by leaseExpirations
+		default:
+			if entry.Attr == nil {
+				entry.Attr = make(map[string]string)
+			}
+			entry.Attr[key] = string(kv.Value)
+		}
+	}
+
+	return &entry, entry.IP != nil || entry.Attr != nil, nil
+}
+
+func (db EtcdV3DB) RenewLease(lease *MACEntry) error {
+	return db.WriteLease(lease)
+}
+
+func (db EtcdV3DB) CreateLease(lease *MACEntry) error {
+	// FIXME: Validate lease
+	ipKey := etcdKeyFromIP(lease.IP)
+	return db.writeLease(lease, clientv3.Compare(clientv3.CreateRevision(ipKey), "=", 0))
+}
+
+// WriteLease writes the IP and MAC keys for the lease together under a single
+// etcd lease, but only if the IP is already leased to the same MAC address.
+func (db EtcdV3DB) WriteLease(lease *MACEntry) error {
+	// FIXME: Validate lease
+	// NOTE: This does not save attributes. That should probably happen in a different function.
+	ipKey := etcdKeyFromIP(lease.IP)
+	return db.writeLease(lease, clientv3.Compare(clientv3.Value(ipKey), "=", lease.MAC.String()))
+}
+
+// writeLease writes both lease keys in one transaction guarded by cond, so
+// that either both are written or neither is, along with when they expire
+func (db EtcdV3DB) writeLease(lease *MACEntry, cond clientv3.Cmp) error {
+	duration := uint64(lease.Duration.Seconds() + 0.5) // Half second jitter to hide network delay
+	leaseID, renewed, err := db.macLease(lease, duration)
+	if err != nil {
+		return err
+	}
+	opts := leaseOptions(leaseID)
+
+	ops := []clientv3.Op{
+		clientv3.OpPut(etcdKeyFromIP(lease.IP), lease.MAC.String(), opts...),
+		clientv3.OpPut(etcdKeyFromMAC(lease.MAC)+"/ip", lease.IP.String(), opts...),
+	}
+	if leaseID != clientv3.NoLease {
+		ops = append(ops, clientv3.OpPut(etcdKeyFromMAC(lease.MAC)+"/expires", leaseExpires(duration), opts...))
+	} else {
+		ops = append(ops, clientv3.OpDelete(etcdKeyFromMAC(lease.MAC)+"/expires"))
+	}
+
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Txn(ctx).If(cond).Then(ops...).Commit()
+	if err == nil && !response.Succeeded {
+		err = ErrLeaseConflict
+	}
+	if err != nil && !renewed {
+		db.revoke(leaseID) // nothing is attached to it
+	}
+	return err
+}
+
+// macLease returns the etcd lease to write lease on for ttl seconds. That's
+// the one its keys are already on, kept alive, when it's being renewed for
+// the same IP and as long as before, so that each MAC only ever holds one, or
+// otherwise a new one.
+func (db EtcdV3DB) macLease(lease *MACEntry, ttl uint64) (leaseID clientv3.LeaseID, renewed bool, err error) {
+	if ttl == 0 {
+		return clientv3.NoLease, false, nil
+	}
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Get(ctx, etcdKeyFromMAC(lease.MAC)+"/ip")
+	if err != nil {
+		return clientv3.NoLease, false, err
+	}
+	if len(response.Kvs) > 0 && response.Kvs[0].Lease != 0 && net.ParseIP(string(response.Kvs[0].Value)).Equal(lease.IP) {
+		leaseID = clientv3.LeaseID(response.Kvs[0].Lease)
+		// NOTE: A lease that has run out can't be kept alive, and one granted
+		//       for another duration would keep going for that long
+		if alive, err := db.client.KeepAliveOnce(ctx, leaseID); err == nil && alive.TTL == int64(ttl) {
+			return leaseID, true, nil
+		}
+	}
+	leaseID, err = db.grant(ttl)
+	return leaseID, false, err
+}
+
+func (db EtcdV3DB) ListLeases() ([]*MACEntry, error) {
+	ctx, cancel := etcdV3Context()
+	response, err := db.client.Get(ctx, "/dhcp/", clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	var macKeys, expiresKeys []*mvccpb.KeyValue
+	for _, kv := range response.Kvs {
+		parts := strings.Split(strings.TrimPrefix(string(kv.Key), "/dhcp/"), "/")
+		if len(parts) == 2 && parts[1] == "ip" {
+			macKeys = append(macKeys, kv)
+		} else if len(parts) == 2 && parts[1] == "expires" {
+			expiresKeys = append(expiresKeys, kv)
+		}
+	}
+	expirations, err := db.leaseExpirations(append(expiresKeys, macKeys...), func(key string) bool {
+		return strings.HasSuffix(key, "/expires")
+	})
+	if err != nil {
+		return nil, err
+	}
+	var leases []*MACEntry
+	for _, kv := range macKeys {
+		mac, err := net.ParseMAC(strings.Split(strings.TrimPrefix(string(kv.Key), "/dhcp/"), "/")[0])
+		if err != nil {
+			continue
+		}
+		expiration, ok := expirations[kv.Lease]
+		if kv.Lease != 0 && !ok {
+			continue // expired
+		}
+		entry := &MACEntry{MAC: mac, IP: net.ParseIP(string(kv.Value))}
+		if ok {
+			entry.Duration = time.Until(expiration).Round(time.Second)
+		}
+		leases = append(leases, entry)
+	}
+	sort.Sort(macEntriesByMAC(leases))
+	return leases, nil
+}
+
+// DeleteLease releases the IP address held by mac, keeping any attributes. The
+// IP key is only removed if it still belongs to mac.
+func (db EtcdV3DB) DeleteLease(mac net.HardwareAddr) error {
+	macKey := etcdKeyFromMAC(mac) + "/ip"
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Get(ctx, macKey)
+	if err != nil {
+		return err
+	}
+	if len(response.Kvs) == 0 {
+		return ErrNotFound
+	}
+	macKV := response.Kvs[0]
+	ipKey := "/dhcp/" + string(macKV.Value)
+	_, err = db.client.Txn(ctx).If(
+		clientv3.Compare(clientv3.Value(ipKey), "=", mac.String()),
+	).Then(
+		clientv3.OpDelete(ipKey),
+		clientv3.OpDelete(macKey),
+		clientv3.OpDelete(etcdKeyFromMAC(mac)+"/expires"),
+	).Else(
+		clientv3.OpDelete(macKey),
+		clientv3.OpDelete(etcdKeyFromMAC(mac)+"/expires"),
+	).Commit()
+	return err
+}
+
+func (db EtcdV3DB) CheckLeases(repair bool) (LeaseCheckResult, error) {
+	var result LeaseCheckResult
+	ctx, cancel := etcdV3Context()
+	response, err := db.client.Get(ctx, "/dhcp/", clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return result, err
+	}
+
+	// Gather both sides of every lease
+	ipKeys := make(map[string]*mvccpb.KeyValue)  // IP -> /dhcp/<ip>
+	macKeys := make(map[string]*mvccpb.KeyValue) // MAC -> /dhcp/<mac>/ip
+	for _, kv := range response.Kvs {
+		parts := strings.Split(strings.TrimPrefix(string(kv.Key), "/dhcp/"), "/")
+		if len(parts) == 1 {
+			if ip := net.ParseIP(parts[0]); ip != nil {
+				ipKeys[ip.String()] = kv
+			}
+		} else if len(parts) == 2 && parts[1] == "ip" {
+			if mac, err := net.ParseMAC(parts[0]); err == nil {
+				macKeys[mac.String()] = kv
+			}
+		}
+	}
+
+	for ipString, ipKV := range ipKeys {
+		ip := net.ParseIP(ipString)
+		mac, err := net.ParseMAC(string(ipKV.Value))
+		if err != nil {
+			continue // not something we know how to fix
+		}
+		macKV, ok := macKeys[mac.String()]
+		if ok && net.ParseIP(string(macKV.Value)).Equal(ip) {
+			continue
+		}
+		result.OrphanedIPs = append(result.OrphanedIPs, ip)
+		if !repair {
+			continue
+		}
+		ipKey := string(ipKV.Key)
+		macKey := etcdKeyFromMAC(mac) + "/ip"
+		ctx, cancel := etcdV3Context()
+		txn := db.client.Txn(ctx)
+		if ok {
+			// The MAC has moved on to another IP, so this one is stale
+			txn = txn.If(clientv3.Compare(clientv3.ModRevision(ipKey), "=", ipKV.ModRevision)).Then(clientv3.OpDelete(ipKey))
+		} else {
+			// The MAC side of the lease never got written, so restore it under
+			// the same etcd lease as the IP side
+			txn = txn.If(
+				clientv3.Compare(clientv3.ModRevision(ipKey), "=", ipKV.ModRevision),
+				clientv3.Compare(clientv3.CreateRevision(macKey), "=", 0),
+			).Then(clientv3.OpPut(macKey, ip.String(), leaseOptions(clientv3.LeaseID(ipKV.Lease))...))
+			macKeys[mac.String()] = &mvccpb.KeyValue{Key: []byte(macKey), Value: []byte(ip.String())}
+		}
+		_, err = txn.Commit()
+		cancel()
+		if err != nil {
+			return result, err
+		}
+	}
+
+	for macString, macKV := range macKeys {
+		ipKV, ok := ipKeys[net.ParseIP(string(macKV.Value)).String()]
+		if ok {
+			if mac, err := net.ParseMAC(string(ipKV.Value)); err == nil && mac.String() == macString {
+				continue
+			}
+		}
+		mac, _ := net.ParseMAC(macString)
+		result.OrphanedMACs = append(result.OrphanedMACs, mac)
+		if !repair {
+			continue
+		}
+		macKey := string(macKV.Key)
+		ctx, cancel := etcdV3Context()
+		_, err := db.client.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(macKey), "=", macKV.ModRevision)).Then(clientv3.OpDelete(macKey)).Commit()
+		cancel()
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
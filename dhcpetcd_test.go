@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+var errInjected = errors.New("injected failure")
+
+func TestCreateLeaseRollsBackIPKey(t *testing.T) {
+	db, fake := newFakeEtcdDB()
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	ip := net.ParseIP("10.0.0.130").To4()
+
+	fake.fail = func(method string, key string) error {
+		if method == "Set" && key == "/dhcp/"+mac.String()+"/ip" {
+			return errInjected
+		}
+		return nil
+	}
+	if err := db.CreateLease(&MACEntry{MAC: mac, IP: ip, Duration: time.Hour}); err != errInjected {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	if db.HasIP(ip) {
+		t.Error("expected the IP key to be rolled back")
+	}
+
+	fake.fail = nil
+	if err := db.CreateLease(&MACEntry{MAC: mac, IP: ip, Duration: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	entry, found, _ := db.GetMAC(mac, false)
+	if !found || !entry.IP.Equal(ip) {
+		t.Errorf("expected a complete lease, got %+v", entry)
+	}
+}
+
+func TestRenewLeaseRollsBackIPKey(t *testing.T) {
+	db, fake := newFakeEtcdDB()
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	ip := net.ParseIP("10.0.0.130").To4()
+
+	if err := db.CreateLease(&MACEntry{MAC: mac, IP: ip, Duration: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	fake.fail = func(method string, key string) error {
+		if method == "Set" {
+			return errInjected
+		}
+		return nil
+	}
+	if err := db.RenewLease(&MACEntry{MAC: mac, IP: ip, Duration: 5 * time.Hour}); err != errInjected {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	response, err := fake.Get("dhcp/"+ip.String(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Node.TTL > int64(time.Hour.Seconds()) {
+		t.Errorf("expected the IP key to keep its original TTL, got %d", response.Node.TTL)
+	}
+}
+
+func TestCheckLeasesRepairsOrphans(t *testing.T) {
+	db, fake := newFakeEtcdDB()
+	mac1, _ := net.ParseMAC("00:11:22:33:44:01")
+	mac2, _ := net.ParseMAC("00:11:22:33:44:02")
+	mac3, _ := net.ParseMAC("00:11:22:33:44:03")
+
+	// A complete lease that must be left alone
+	if err := db.CreateLease(&MACEntry{MAC: mac1, IP: net.ParseIP("10.0.0.1"), Duration: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	// An IP key whose MAC key was never written
+	fake.Create("dhcp/10.0.0.2", mac2.String(), 3600)
+	// A MAC key whose IP key is gone
+	fake.Set("dhcp/"+mac3.String()+"/ip", "10.0.0.3", 3600)
+	// A stale IP key for a MAC that has since moved to another IP
+	fake.Create("dhcp/10.0.0.4", mac1.String(), 3600)
+
+	result, err := db.CheckLeases(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.OrphanedIPs) != 2 || len(result.OrphanedMACs) != 1 {
+		t.Fatalf("unexpected check result: %+v", result)
+	}
+	if !db.HasIP(net.ParseIP("10.0.0.4")) {
+		t.Fatal("expected a check without repair to change nothing")
+	}
+
+	if _, err := db.CheckLeases(true); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _, _ := db.GetMAC(mac2, false); !entry.IP.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("expected the MAC key to be restored, got %+v", entry)
+	}
+	if entry, _, _ := db.GetMAC(mac3, false); entry.IP != nil {
+		t.Errorf("expected the orphaned MAC key to be removed, got %s", entry.IP)
+	}
+	if db.HasIP(net.ParseIP("10.0.0.4")) {
+		t.Error("expected the stale IP key to be removed")
+	}
+	if entry, _, _ := db.GetMAC(mac1, false); !entry.IP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected the complete lease to be untouched, got %+v", entry)
+	}
+
+	result, err = db.CheckLeases(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.OrphanedIPs) != 0 || len(result.OrphanedMACs) != 0 {
+		t.Errorf("expected no orphans after repair, got %+v", result)
+	}
+}
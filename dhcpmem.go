@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"time"
+)
+
+type memIPEntry struct {
+	mac        net.HardwareAddr
+	expiration *time.Time
+}
+
+type memMACEntry struct {
+	ip         net.IP
+	expiration *time.Time // applies to the IP, not to the MAC or its attributes
+	attr       map[string]string
+}
+
+func (db *MemDB) InitDHCP() {}
+
+func (db *MemDB) GetIP(ip net.IP) (IPEntry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	entry := db.ipEntry(ip)
+	if entry == nil {
+		return IPEntry{}, ErrNotFound
+	}
+	return IPEntry{MAC: append(net.HardwareAddr(nil), entry.mac...)}, nil
+}
+
+func (db *MemDB) HasIP(ip net.IP) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.ipEntry(ip) != nil
+}
+
+func (db *MemDB) GetMAC(mac net.HardwareAddr, cascade bool) (*MACEntry, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	entry, found := db.macEntry(mac, cascade)
+	return entry, found, nil
+}
+
+func (db *MemDB) RenewLease(lease *MACEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	entry := db.ipEntry(lease.IP)
+	if entry == nil {
+		return ErrNotFound
+	}
+	if !bytes.Equal(entry.mac, lease.MAC) {
+		return ErrLeaseConflict
+	}
+	entry.expiration = db.memExpiration(uint64(lease.Duration.Seconds() + 0.5))
+	db.writeLease(lease)
+	return nil
+}
+
+func (db *MemDB) CreateLease(lease *MACEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.ipEntry(lease.IP) != nil {
+		return ErrLeaseConflict
+	}
+	db.ips[lease.IP.String()] = &memIPEntry{
+		mac:        append(net.HardwareAddr(nil), lease.MAC...),
+		expiration: db.memExpiration(uint64(lease.Duration.Seconds() + 0.5)),
+	}
+	db.writeLease(lease)
+	return nil
+}
+
+func (db *MemDB) WriteLease(lease *MACEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.writeLease(lease)
+	return nil
+}
+
+func (db *MemDB) ListLeases() ([]*MACEntry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var leases []*MACEntry
+	for key := range db.macs {
+		mac, err := net.ParseMAC(key)
+		if err != nil {
+			continue
+		}
+		if entry, _ := db.macEntry(mac, false); entry.IP != nil {
+			leases = append(leases, entry)
+		}
+	}
+	sort.Sort(macEntriesByMAC(leases))
+	return leases, nil
+}
+
+// DeleteLease releases the IP address held by mac, keeping any attributes
+func (db *MemDB) DeleteLease(mac net.HardwareAddr) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	entry, ok := db.macs[mac.String()]
+	if !ok || entry.ip == nil || db.memExpired(entry.expiration) {
+		return ErrNotFound
+	}
+	if ipEntry := db.ipEntry(entry.ip); ipEntry != nil && bytes.Equal(ipEntry.mac, mac) {
+		delete(db.ips, entry.ip.String())
+	}
+	entry.ip, entry.expiration = nil, nil
+	return nil
+}
+
+// writeLease records the lease against the MAC address. The caller must hold
+// the lock.
+func (db *MemDB) writeLease(lease *MACEntry) {
+	// NOTE: This does not save attributes, just like the etcd implementation
+	entry, ok := db.macs[lease.MAC.String()]
+	if !ok {
+		entry = &memMACEntry{}
+		db.macs[lease.MAC.String()] = entry
+	}
+	entry.ip = append(net.IP(nil), lease.IP...)
+	entry.expiration = db.memExpiration(uint64(lease.Duration.Seconds() + 0.5))
+}
+
+// ipEntry returns the unexpired lease entry for ip, if there is one. The caller
+// must hold the lock.
+func (db *MemDB) ipEntry(ip net.IP) *memIPEntry {
+	key := ip.String()
+	entry, ok := db.ips[key]
+	if !ok {
+		return nil
+	}
+	if db.memExpired(entry.expiration) {
+		delete(db.ips, key)
+		return nil
+	}
+	return entry
+}
+
+// macEntry assembles the entry for mac, cascading attributes from shorter
+// prefixes of the MAC address when asked to. The caller must hold the lock.
+func (db *MemDB) macEntry(mac net.HardwareAddr, cascade bool) (*MACEntry, bool) {
+	entry := MACEntry{MAC: mac}
+
+	// Copy cascaded attributes by making recursive calls to this function
+	if cascade && len(mac) > 1 {
+		parent, _ := db.macEntry(mac[0:len(mac)-1], cascade) // Chop off the last byte for each recursive call
+		entry.Attr = parent.Attr
+	}
+
+	stored, ok := db.macs[mac.String()]
+	if !ok {
+		return &entry, false
+	}
+
+	if len(stored.attr) > 0 {
+		attr := make(map[string]string, len(entry.Attr)+len(stored.attr))
+		for k, v := range entry.Attr {
+			attr[k] = v
+		}
+		for k, v := range stored.attr {
+			attr[k] = v
+		}
+		entry.Attr = attr
+	}
+
+	if stored.ip != nil {
+		if db.memExpired(stored.expiration) {
+			stored.ip, stored.expiration = nil, nil
+		} else {
+			entry.IP = append(net.IP(nil), stored.ip...)
+			entry.Duration = time.Duration(db.memRemaining(stored.expiration)) * time.Second
+		}
+	}
+
+	return &entry, true
+}
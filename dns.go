@@ -2,11 +2,12 @@ package main
 
 import (
 	"errors"
-	"log"
+	"fmt"
 	"net"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustywilson/dnscache"
@@ -17,13 +18,67 @@ type DNSDB interface {
 	InitDNS()
 	GetDNS(name string, rtype string) (*DNSEntry, error)
 	HasDNS(name string, rtype string) (bool, error)
+	NameExists(name string) (bool, error)
+	Register(fqdn string, rrType string, value string, attrs map[string]string, ttl uint32, expiration uint64) error
 	RegisterA(fqdn string, ip net.IP, exclusive bool, ttl uint32, expiration uint64) error
+	RegisterAAAA(fqdn string, ip net.IP, exclusive bool, ttl uint32, expiration uint64) error
+	Unregister(fqdn string, rrType string, value string) error
+	SetDNSMeta(fqdn string, rrType string, meta map[string]string) error
+	ListDNS(name string) ([]DNSRecord, error)
+}
+
+// DNSWatcher is implemented by backends that can report changes to DNS records
+// as they happen. WatchDNS sends the name of each changed record set, such as
+// "www.example.com", until stop is closed. An empty name means that changes may
+// have been missed and everything should be considered changed.
+type DNSWatcher interface {
+	WatchDNS(stop <-chan struct{}) <-chan string
+}
+
+// NotifyClaimer is implemented by backends shared between netcore instances,
+// so that only one of them sends NOTIFY for each change to a zone. ClaimNotify
+// returns false if another instance has already claimed the serial of zone.
+type NotifyClaimer interface {
+	ClaimNotify(zone string, serial uint32) (bool, error)
+}
+
+// TransferClaimer is implemented by backends shared between netcore instances,
+// so that only one of them transfers each new serial of a zone it is a
+// secondary for. ClaimTransfer returns false if another instance holds the
+// claim on the serial of zone; the instance holding it may claim it again.
+type TransferClaimer interface {
+	ClaimTransfer(zone string, serial uint32) (bool, error)
+}
+
+// SerialKeeper is implemented by backends whose values can expire without
+// anything being written, so that the serials of their zones still go up when
+// they do. KeepSerials raises them as values expire until stop is closed.
+type SerialKeeper interface {
+	KeepSerials(stop <-chan struct{})
 }
 
 type DNSEntry struct {
-	TTL    uint32
-	Values []DNSValue
-	Meta   map[string]string
+	TTL      uint32
+	Values   []DNSValue
+	Meta     map[string]string
+	Modified uint64 // the highest modification index of the keys the entry was read from
+}
+
+// DNSRecord is a record set along with the name and type it is stored under
+type DNSRecord struct {
+	Name  string
+	Type  string
+	Entry *DNSEntry
+}
+
+// dnsRecordsByName sorts record sets in the order they are kept in etcd, so
+// that names within the same domain are listed together
+type dnsRecordsByName []DNSRecord
+
+func (s dnsRecordsByName) Len() int      { return len(s) }
+func (s dnsRecordsByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s dnsRecordsByName) Less(i, j int) bool {
+	return etcdDNSKeyFromFQDN(s[i].Name)+"/@"+s[i].Type < etcdDNSKeyFromFQDN(s[j].Name)+"/@"+s[j].Type
 }
 
 type DNSValue struct {
@@ -31,6 +86,7 @@ type DNSValue struct {
 	TTL        uint32
 	Value      string
 	Attr       map[string]string
+	Owner      string // the netcore instance that registered the value, if any
 }
 
 type dnsEntryResult struct {
@@ -40,196 +96,344 @@ type dnsEntryResult struct {
 }
 
 var (
-	ErrNotFound = errors.New("not found")
+	ErrNotFound          = errors.New("not found")
+	ErrUnsupportedRRType = errors.New("unsupported record type")
 )
 
 const (
 	dnsCacheBufferSize = 512
+	// FIXME: Make the default TTL into a configuration parameter
+	// FIXME: Check whether this default is being applied to unanswered queries
+	dnsDefaultTTL = uint32(10800) // this is the default TTL = 3 hours
+	dnsMaxChain   = 8             // how many CNAME and DNAME records are followed for one question
 )
 
-func dnsSetup(cfg *Config) chan error {
-	log.Println("DNSSETUP")
+// Defaults for the SOA fields that aren't set in the zone's @soa Meta
+const (
+	dnsDefaultRefresh = uint32(3600)   // how often secondaries check for changes
+	dnsDefaultRetry   = uint32(600)    // how soon they check again when that fails
+	dnsDefaultExpire  = uint32(604800) // how long they keep answering without us
+	dnsDefaultMinTTL  = uint32(60)     // how long a miss is cached for, kept short for DHCP clients
+)
 
-	// FIXME: Make the default TTL into a configuration parameter
-	// FIXME: Check whether this default is being applied to unanswered queries
-	defaultTTL := uint32(10800) // this is the default TTL = 3 hours
+func dnsSetup(cfg *Config, secondary *dnsSecondary) service {
+	dnsLog.Debug("setting up")
+
+	newCache := func(maxTTL, missingTTL time.Duration) *dnscache.Cache {
+		return dnscache.New(dnsCacheBufferSize, maxTTL, missingTTL, func(c dnscache.Context, q dns.Question) []dns.RR {
+			if c.Event != dnscache.Renewal {
+				dnsCacheMisses.Inc()
+			}
+			return answerQuestion(cfg, c, &q, dnsDefaultTTL, nil, true).records(uint32(missingTTL.Seconds()))
+		})
+	}
 
-	cache := dnscache.New(dnsCacheBufferSize, cfg.DNSCacheMaxTTL(), cfg.DNSCacheMissingTTL(), func(c dnscache.Context, q dns.Question) []dns.RR {
-		return answerQuestion(cfg, c, &q, defaultTTL, 0)
+	history := newZoneHistory()
+
+	// NOTE: dnscache has no way to stop a cache, so one with new TTLs can't
+	//       replace it until we're restarted
+	maxTTL, missingTTL := cfg.DNSCacheMaxTTL(), cfg.DNSCacheMissingTTL()
+	cache := newCache(maxTTL, missingTTL)
+	cfg.OnChange(func() {
+		if cfg.DNSCacheMaxTTL() != maxTTL || cfg.DNSCacheMissingTTL() != missingTTL {
+			dnsLog.Warn("cache TTLs changed; this takes effect when restarted", "maxttl", cfg.DNSCacheMaxTTL().String(), "missingttl", cfg.DNSCacheMissingTTL().String())
+		}
 	})
 
-	dns.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) { dnsQueryServe(cfg, cache, w, req) })
+	dns.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		dnsQueryServe(cfg, cache, history, secondary, w, req)
+	})
 	cfg.db.InitDNS()
-	exit := make(chan error, 1)
 
-	go func() {
-		exit <- dns.ListenAndServe("0.0.0.0:53", "tcp", nil) // TODO: should use cfg to define the listening ip/port
-	}()
+	var serversLock sync.Mutex
+	var servers []*dns.Server
+	shutdown := func() {
+		serversLock.Lock()
+		defer serversLock.Unlock()
+		for _, server := range servers {
+			server.Shutdown() // waits for the queries being answered
+		}
+		servers = nil
+	}
 
-	go func() {
-		exit <- dns.ListenAndServe("0.0.0.0:53", "udp", nil) // TODO: should use cfg to define the listening ip/port
-	}()
+	return service{
+		name: "dns",
+		run: func(ready func()) error {
+			var started sync.WaitGroup
+			started.Add(2)
+			go func() {
+				started.Wait()
+				ready()
+			}()
+			serversLock.Lock()
+			servers = []*dns.Server{
+				{Addr: "0.0.0.0:53", Net: "tcp", TsigProvider: dnsTSIG{cfg}, NotifyStartedFunc: started.Done}, // TODO: should use cfg to define the listening ip/port
+				{Addr: "0.0.0.0:53", Net: "udp", TsigProvider: dnsTSIG{cfg}, NotifyStartedFunc: started.Done}, // TODO: should use cfg to define the listening ip/port
+			}
+			exit := make(chan error, len(servers))
+			for _, server := range servers {
+				go func(server *dns.Server) {
+					exit <- server.ListenAndServe()
+				}(server)
+			}
+			serversLock.Unlock()
+
+			// If one fails then take the other down with it, so that they can be
+			// restarted together
+			err := <-exit
+			shutdown()
+			return err
+		},
+		stop: shutdown,
+	}
+}
 
-	return exit
+// dnsEnclosingNames returns name and each of the names above it, nearest
+// first, which are where the zone holding name may start
+func dnsEnclosingNames(name string) []string {
+	var names []string
+	for name = cleanFQDN(name); name != ""; {
+		names = append(names, name)
+		i := strings.Index(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return names
 }
 
-func dnsQueryServe(cfg *Config, cache *dnscache.Cache, w dns.ResponseWriter, req *dns.Msg) {
+// dnsZones returns the name of every zone with an SOA in db
+func dnsZones(db DNSDB) ([]string, error) {
+	records, err := db.ListDNS("")
+	if err != nil {
+		return nil, err
+	}
+	var zones []string
+	for _, record := range records {
+		if record.Type == "SOA" {
+			zones = append(zones, record.Name)
+		}
+	}
+	return zones, nil
+}
+
+// serialSetup runs keeper, which raises the serial of each zone whenever a
+// value in it expires
+func serialSetup(keeper SerialKeeper) service {
+	var lock sync.Mutex
+	var stop chan struct{}
+	return service{
+		name: "serials",
+		run: func(ready func()) error {
+			lock.Lock()
+			stop = make(chan struct{})
+			done := stop
+			lock.Unlock()
+			ready()
+			keeper.KeepSerials(done)
+			return nil
+		},
+		stop: func() {
+			lock.Lock()
+			defer lock.Unlock()
+			if stop != nil {
+				close(stop)
+				stop = nil
+			}
+		},
+	}
+}
+
+func dnsQueryServe(cfg *Config, cache *dnscache.Cache, history *zoneHistory, secondary *dnsSecondary, w dns.ResponseWriter, req *dns.Msg) {
 	start := time.Now()
 
 	if req.MsgHdr.Response == true { // supposed responses sent to us are bogus
 		q := req.Question[0]
-		log.Printf("DNS Query IS BOGUS %s %s from %s.\n", q.Name, dns.Type(q.Qtype).String(), w.RemoteAddr())
+		dnsLog.Warn("bogus query, as it's a response", "qname", q.Name, "qtype", dns.Type(q.Qtype).String(), "client", w.RemoteAddr().String())
 		return
 	}
 
-	// TODO: handle AXFR/IXFR (full and incremental) *someday* for use by non-netcore slaves
-	//       ... also if we do that, also handle sending NOTIFY to listed slaves attached to the SOA record
+	// NOTIFY from the primaries of the zones we're a secondary for
+	if req.Opcode == dns.OpcodeNotify {
+		finishQuery(w, serveNotify(cfg, secondary, w, req), start)
+		return
+	}
+
+	// Zone transfers for non-netcore slaves, which are sent NOTIFY by dnsNotifier
+	if len(req.Question) > 0 && (req.Question[0].Qtype == dns.TypeAXFR || req.Question[0].Qtype == dns.TypeIXFR) {
+		finishQuery(w, serveTransfer(cfg, history, w, req), start)
+		return
+	}
 
 	// Process questions in parallel
-	pending := make([]chan []dns.RR, 0, len(req.Question)) // Slice of answer channels
+	pending := make([]chan *dnsAnswer, 0, len(req.Question)) // Slice of answer channels
 	for i := range req.Question {
 		q := &req.Question[i]
-		log.Printf("DNS Query [%d/%d] %s %s from %s\n", i+1, len(req.Question), q.Name, dns.Type(q.Qtype).String(), w.RemoteAddr())
-		pending = append(pending, serveQuestion(cfg, cache, q, start))
+		dnsLog.Debug("query", "qname", q.Name, "qtype", dns.Type(q.Qtype).String(), "client", w.RemoteAddr().String(), "question", i+1, "questions", len(req.Question))
+		pending = append(pending, serveQuestion(cfg, cache, q, req.RecursionDesired, start))
 	}
 
-	// Assemble answers according to the order of the questions
-	var answers []dns.RR
-	for _, ch := range pending {
-		answers = append(answers, <-ch...)
+	// Assemble answers according to the order of the questions, taking the
+	// rcode and authority from the first
+	answer := &dnsAnswer{Rcode: dns.RcodeSuccess}
+	for i, ch := range pending {
+		next := <-ch
+		if i == 0 {
+			answer.Rcode, answer.Authoritative = next.Rcode, next.Authoritative
+		}
+		answer.Answer = append(answer.Answer, next.Answer...)
+		answer.Ns = append(answer.Ns, next.Ns...)
+		answer.Extra = append(answer.Extra, next.Extra...)
 	}
 
-	for _, answer := range answers {
-		log.Printf("  [%9.04fms] ANSWER  %s\n", msElapsed(start, time.Now()), answer.String())
+	for _, rr := range answer.Answer {
+		dnsLog.Debug("answer", "ms", msElapsed(start, time.Now()), "rr", rr.String())
 	}
 
-	if len(answers) > 0 {
-		//log.Printf("OUR DATA: [%+v]\n", answerMsg)
-		answerMsg := prepareAnswerMsg(req, answers)
-		w.WriteMsg(answerMsg)
-		return
+	answerMsg := prepareAnswerMsg(req, answer, forwardingEnabled(cfg.DNSForwarders()))
+	if w.RemoteAddr().Network() == "udp" {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		answerMsg.Truncate(size)
 	}
+	w.WriteMsg(answerMsg)
+	finishQuery(w, answerMsg, start)
+}
 
-	//log.Printf("NO DATA: [%+v]\n", answerMsg)
-
-	failMsg := prepareFailureMsg(req)
-	w.WriteMsg(failMsg)
+// finishQuery logs and counts every question answered by msg
+func finishQuery(w dns.ResponseWriter, msg *dns.Msg, start time.Time) {
+	rcode := dns.RcodeToString[msg.Rcode]
+	for _, q := range msg.Question {
+		dnsQueries.WithLabelValues(dns.Type(q.Qtype).String(), rcode).Inc()
+		dnsLog.Info("answered", "qname", q.Name, "qtype", dns.Type(q.Qtype).String(), "rcode", rcode, "answers", len(msg.Answer), "client", w.RemoteAddr().String(), "ms", msElapsed(start, time.Now()))
+	}
 }
 
-func serveQuestion(cfg *Config, cache *dnscache.Cache, q *dns.Question, start time.Time) chan []dns.RR {
-	output := make(chan []dns.RR)
-	var answers []dns.RR
+// serveQuestion answers q from the cache, or straight from the database if
+// recursion isn't wanted, as the cache forwards anything that isn't ours
+func serveQuestion(cfg *Config, cache *dnscache.Cache, q *dns.Question, recurse bool, start time.Time) chan *dnsAnswer {
+	output := make(chan *dnsAnswer)
+	var wol dns.RR
 
 	// is this a WOL query?
 	if isWOLTrigger(q) {
-		answer := processWOL(cfg, q)
-		answers = append(answers, answer)
+		wol = processWOL(cfg, q)
 	}
 
 	rc := make(chan []dns.RR)
 
-	cache.Lookup(dnscache.Request{
-		Question:     *q,
-		Start:        start,
-		ResponseChan: rc,
-	})
+	if recurse {
+		dnsCacheLookups.Inc()
+		cache.Lookup(dnscache.Request{
+			Question:     *q,
+			Start:        start,
+			ResponseChan: rc,
+		})
+	} else {
+		go func() {
+			rc <- answerQuestion(cfg, dnscache.Context{Event: dnscache.Lookup, Start: start}, q, dnsDefaultTTL, nil, false).records(0)
+		}()
+	}
 
 	go func() {
-		answers = append(answers, <-rc...)
-		output <- answers
+		answer := answerFromRecords(<-rc)
+		if wol != nil {
+			answer.Rcode = dns.RcodeSuccess
+			answer.Answer = append([]dns.RR{wol}, answer.Answer...)
+			answer.Ns = nil
+		}
+		output <- answer
 	}()
 
 	return output
 }
 
-func answerQuestion(cfg *Config, c dnscache.Context, q *dns.Question, defaultTTL, qDepth uint32) []dns.RR {
+// answerQuestion answers q from the database, or otherwise from the forwarders
+// if recurse is set and the name isn't in a zone we have authority for. The
+// chain holds the names that were aliased to q.Name by CNAME or DNAME records
+// on the way, and answering fails if it is too long or goes round in a loop.
+func answerQuestion(cfg *Config, c dnscache.Context, q *dns.Question, defaultTTL uint32, chain []string, recurse bool) *dnsAnswer {
+	qDepth := len(chain)
+	if qDepth > dnsMaxChain {
+		dnsLog.Warn("alias chain is too long", "qname", chain[0], "chain", strings.Join(chain, " "))
+		return &dnsAnswer{Rcode: dns.RcodeServerFailure}
+	}
+	for _, name := range chain {
+		if strings.EqualFold(name, q.Name) {
+			dnsLog.Warn("alias loop", "qname", chain[0], "chain", strings.Join(append(chain, q.Name), " "))
+			return &dnsAnswer{Rcode: dns.RcodeServerFailure}
+		}
+	}
+
 	if c.Event == dnscache.Renewal && qDepth == 0 {
-		log.Printf("DNS Renewal     %s %s\n", q.Name, dns.Type(q.Qtype).String())
+		dnsLog.Debug("cache renewal", "qname", q.Name, "qtype", dns.Type(q.Qtype).String())
 	} else {
-		log.Printf("  [%9.04fms] %-7s %s %s\n", msElapsed(c.Start, time.Now()), strings.ToUpper(c.Event.String()), q.Name, dns.Type(q.Qtype).String())
+		dnsLog.Debug(strings.ToLower(c.Event.String()), "qname", q.Name, "qtype", dns.Type(q.Qtype).String(), "depth", qDepth, "ms", msElapsed(c.Start, time.Now()))
 	}
 	answerTTL := defaultTTL
 	var answers []dns.RR
 	var secondaryAnswers []dns.RR
+	var secondary *dnsAnswer // the answer for the target of a CNAME
 	var wouldLikeForwarder = true
+	zone, soa := findZone(cfg, q.Name)
+	authority := soa != nil
+
+	if authority {
+		// Nothing at or below a zone cut is ours to answer, even if we hold
+		// glue for it
+		cut, delegation, err := findDelegation(cfg, q.Name, zone)
+		if err != nil {
+			dnsLog.Error("lookup failed", "qname", q.Name, "qtype", dns.Type(q.Qtype).String(), "err", err)
+			return &dnsAnswer{Rcode: dns.RcodeServerFailure}
+		}
+		if delegation != nil {
+			return answerDelegation(cfg, c, q, cut, delegation, defaultTTL, recurse)
+		}
+	}
 
 	entry, rrType, err := fetchBestEntry(cfg, q)
+	if err == ErrNotFound {
+		// A DNAME above the name aliases the whole subtree beneath it, which
+		// can't hold anything of its own
+		owner, dname, dnameErr := findDNAME(cfg, q.Name)
+		if dname != nil {
+			return answerViaDNAME(cfg, c, q, owner, dname, defaultTTL, chain, recurse, authority)
+		}
+		if dnameErr != nil {
+			err = dnameErr
+		}
+	}
+	if err != nil && err != ErrNotFound {
+		dnsLog.Error("lookup failed", "qname", q.Name, "qtype", dns.Type(q.Qtype).String(), "err", err)
+		return &dnsAnswer{Rcode: dns.RcodeServerFailure}
+	}
 
 	if err == nil {
 		wouldLikeForwarder = false
 		if entry.TTL > 0 {
 			answerTTL = entry.TTL
 		}
-		log.Printf("  [%9.04fms] FOUND   %s %s\n", msElapsed(c.Start, time.Now()), q.Name, dns.Type(rrType).String())
+		dnsLog.Debug("found", "qname", q.Name, "qtype", dns.Type(rrType).String(), "ms", msElapsed(c.Start, time.Now()))
 
 		switch q.Qtype {
 		case dns.TypeSOA:
-			answer := answerSOA(q, entry)
+			answer := answerSOA(q, entry, soaSerial(entry))
 			answers = append(answers, answer)
 		default:
 			// ... for answers that have values
-			for i := range entry.Values {
-				value := &entry.Values[i]
-				if value.Expiration != nil {
-					expiration := value.Expiration.Unix()
-					now := time.Now().Unix()
-					if expiration < now {
-						//log.Printf("[Lookup [%s] [%s] (is expired)]\n", q.Name, qType)
-						continue
-					}
-					remaining := uint32(expiration - now)
-					if remaining < answerTTL {
-						answerTTL = remaining
-						log.Printf("  [%9.04fms] EXPIRES %d\n", msElapsed(c.Start, time.Now()), remaining)
-					}
-				}
-				if value.TTL > 0 && value.TTL < answerTTL {
-					answerTTL = value.TTL
-				}
-				switch rrType {
-				// FIXME: Add more RR types!
-				//        http://godoc.org/github.com/miekg/dns has info as well as
-				//        http://en.wikipedia.org/wiki/List_of_DNS_record_types
-				case dns.TypeTXT:
-					answer := answerTXT(q, value)
-					answers = append(answers, answer)
-				case dns.TypeA:
-					answer := answerA(q, value)
-					answers = append(answers, answer)
-				case dns.TypeAAAA:
-					answer := answerAAAA(q, value)
-					answers = append(answers, answer)
-				case dns.TypeNS:
-					answer := answerNS(q, value)
-					answers = append(answers, answer)
-				case dns.TypeCNAME:
-					answer, target := answerCNAME(q, value)
-					answers = append(answers, answer)
-					q2 := q
-					q2.Name = target // replace question's name with new name
-					secondaryAnswers = append(secondaryAnswers, answerQuestion(cfg, c, q2, defaultTTL, qDepth+1)...)
-				case dns.TypeDNAME:
-					answer := answerDNAME(q, value)
-					answers = append(answers, answer)
-					wouldLikeForwarder = true
-				case dns.TypePTR:
-					answer := answerPTR(q, value)
-					answers = append(answers, answer)
-				case dns.TypeMX:
-					answer := answerMX(q, value)
-					// FIXME: are we supposed to be returning these in prio ordering?
-					//        ... or maybe it does that for us?  or maybe it's the enduser's problem?
-					answers = append(answers, answer)
-				case dns.TypeSRV:
-					answer := answerSRV(q, value)
-					// FIXME: are we supposed to be returning these rando-weighted and in priority ordering?
-					//        ... or maybe it does that for us?  or maybe it's the enduser's problem?
-					answers = append(answers, answer)
-				case dns.TypeSSHFP:
-					// TODO: implement SSHFP
-					//       http://godoc.org/github.com/miekg/dns#SSHFP
-					//       NOTE: we must implement DNSSEC before using this RR type
+			answers, answerTTL = entryRecords(q.Name, rrType, entry, answerTTL)
+			for _, answer := range answers {
+				cname, ok := answer.(*dns.CNAME)
+				if !ok || q.Qtype == dns.TypeCNAME {
+					continue // they asked for the CNAME itself
 				}
+				// the target is looked up here or forwarded like any other name
+				q2 := &dns.Question{Name: cname.Target, Qtype: q.Qtype, Qclass: q.Qclass}
+				secondary = answerQuestion(cfg, c, q2, defaultTTL, append(chain[:qDepth:qDepth], q.Name), recurse)
+				secondaryAnswers = append(secondaryAnswers, secondary.Answer...)
 			}
 		}
 	}
@@ -245,12 +449,331 @@ func answerQuestion(cfg *Config, c dnscache.Context, q *dns.Question, defaultTTL
 	// check to see if we host this zone; if yes, don't allow use of ext forwarders
 	// ... also, check to see if we hit a DNAME so we can handle that aliasing
 	// FIXME: Only forward if we are configured as a forwarder
-	if wouldLikeForwarder && !haveAuthority(cfg, q) {
-		log.Printf("  [%9.04fms] FORWARD %s %s\n", msElapsed(c.Start, time.Now()), q.Name, dns.Type(q.Qtype).String())
-		answers = append(answers, forwardQuestion(q, cfg.DNSForwarders())...)
+	if wouldLikeForwarder && !authority {
+		if !recurse {
+			return &dnsAnswer{Rcode: dns.RcodeRefused, Answer: answers}
+		}
+		dnsLog.Debug("forward", "qname", q.Name, "qtype", dns.Type(q.Qtype).String(), "ms", msElapsed(c.Start, time.Now()))
+		m, err := forwardQuestion(q, cfg.DNSForwarders())
+		if err == ErrNoForwarders {
+			return &dnsAnswer{Rcode: dns.RcodeRefused, Answer: answers}
+		}
+		if err != nil {
+			return &dnsAnswer{Rcode: dns.RcodeServerFailure, Answer: answers}
+		}
+		return forwardedAnswer(m, answers)
+	}
+
+	// The final answer of a CNAME chain decides the rcode (RFC 2308 section 2.1)
+	if secondary != nil {
+		return &dnsAnswer{Rcode: chainRcode(secondary), Authoritative: authority, Answer: answers, Ns: secondary.Ns, Extra: secondary.Extra}
+	}
+	if len(answers) == 0 {
+		return negativeAnswer(cfg, q, defaultTTL)
+	}
+	return &dnsAnswer{Rcode: dns.RcodeSuccess, Authoritative: authority, Answer: answers, Extra: additionalRecords(cfg, answers, defaultTTL)}
+}
+
+// entryRecords builds the records of type rrType held in entry for name,
+// leaving out values that have expired, and returns them along with the
+// shortest of their TTLs, which is no longer than ttl
+func entryRecords(name string, rrType uint16, entry *DNSEntry, ttl uint32) ([]dns.RR, uint32) {
+	q := &dns.Question{Name: name, Qtype: rrType, Qclass: dns.ClassINET}
+	var records []dns.RR
+	for i := range entry.Values {
+		value := &entry.Values[i]
+		remaining, ok := valueTTL(value, ttl)
+		if !ok {
+			//log.Printf("[Lookup [%s] [%s] (is expired)]\n", q.Name, qType)
+			continue
+		}
+		ttl = remaining
+		switch rrType {
+		// FIXME: Add more RR types!
+		//        http://godoc.org/github.com/miekg/dns has info as well as
+		//        http://en.wikipedia.org/wiki/List_of_DNS_record_types
+		case dns.TypeTXT:
+			records = append(records, answerTXT(q, value))
+		case dns.TypeA:
+			records = append(records, answerA(q, value))
+		case dns.TypeAAAA:
+			records = append(records, answerAAAA(q, value))
+		case dns.TypeNS:
+			records = append(records, answerNS(q, value))
+		case dns.TypeCNAME:
+			answer, _ := answerCNAME(q, value)
+			records = append(records, answer)
+		case dns.TypeDNAME:
+			records = append(records, answerDNAME(q, value))
+		case dns.TypePTR:
+			records = append(records, answerPTR(q, value))
+		case dns.TypeMX:
+			// FIXME: are we supposed to be returning these in prio ordering?
+			//        ... or maybe it does that for us?  or maybe it's the enduser's problem?
+			records = append(records, answerMX(q, value))
+		case dns.TypeSRV:
+			// FIXME: are we supposed to be returning these rando-weighted and in priority ordering?
+			//        ... or maybe it does that for us?  or maybe it's the enduser's problem?
+			records = append(records, answerSRV(q, value))
+		case dns.TypeSSHFP:
+			// TODO: implement SSHFP
+			//       http://godoc.org/github.com/miekg/dns#SSHFP
+			//       NOTE: we must implement DNSSEC before using this RR type
+		}
+	}
+	for _, rr := range records {
+		rr.Header().Ttl = ttl
+	}
+	return records, ttl
+}
+
+// valueTTL returns how long value can be cached for, which is no longer than
+// ttl, or false if it has expired
+func valueTTL(value *DNSValue, ttl uint32) (uint32, bool) {
+	if value.Expiration != nil {
+		expiration := value.Expiration.Unix()
+		now := time.Now().Unix()
+		if expiration < now {
+			return 0, false
+		}
+		if remaining := uint32(expiration - now); remaining < ttl {
+			ttl = remaining
+		}
+	}
+	if value.TTL > 0 && value.TTL < ttl {
+		ttl = value.TTL
+	}
+	return ttl, true
+}
+
+// additionalRecords returns the addresses we hold for the targets of any NS,
+// MX and SRV records in answers, for the additional section (RFC 1034 section
+// 3.7), so that clients don't need to ask for them separately
+func additionalRecords(cfg *Config, answers []dns.RR, defaultTTL uint32) []dns.RR {
+	var extra []dns.RR
+	seen := make(map[string]bool)
+	for _, answer := range answers {
+		var target string
+		switch rr := answer.(type) {
+		case *dns.NS:
+			target = rr.Ns
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		default:
+			continue
+		}
+		if target == "." || seen[strings.ToLower(target)] {
+			continue
+		}
+		seen[strings.ToLower(target)] = true
+		extra = append(extra, addressRecords(cfg, target, defaultTTL)...)
+	}
+	return extra
+}
+
+// addressRecords returns the A and AAAA records we hold for name, if any
+func addressRecords(cfg *Config, name string, defaultTTL uint32) []dns.RR {
+	var records []dns.RR
+	for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		entry, err := cfg.db.GetDNS(name, dns.Type(rrType).String())
+		if err != nil {
+			continue // they're only a convenience
+		}
+		ttl := defaultTTL
+		if entry.TTL > 0 {
+			ttl = entry.TTL
+		}
+		rrset, _ := entryRecords(name, rrType, entry, ttl)
+		records = append(records, rrset...)
+	}
+	return records
+}
+
+// findDNAME looks for a DNAME at each of the names above name (RFC 6672
+// section 2.3: a DNAME doesn't alias its own name), closest first, and returns
+// the name it is at along with the entry, which is nil if there isn't one
+func findDNAME(cfg *Config, name string) (string, *DNSEntry, error) {
+	nameParts := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := 1; i < len(nameParts); i++ {
+		owner := strings.Join(nameParts[i:], ".") + "."
+		entry, err := cfg.db.GetDNS(owner, "DNAME")
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if len(entry.Values) > 0 {
+			return owner, entry, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// answerViaDNAME answers q, which is below the DNAME at owner, with the DNAME
+// and a CNAME synthesized from it (RFC 6672 section 3.1) to the same name
+// below the DNAME's target, followed by the answer for that name, which is
+// found the same way as any other
+func answerViaDNAME(cfg *Config, c dnscache.Context, q *dns.Question, owner string, entry *DNSEntry, defaultTTL uint32, chain []string, recurse bool, authority bool) *dnsAnswer {
+	ttl := defaultTTL
+	if entry.TTL > 0 {
+		ttl = entry.TTL
+	}
+	dname := answerDNAME(&dns.Question{Name: owner, Qtype: dns.TypeDNAME, Qclass: q.Qclass}, &entry.Values[0]).(*dns.DNAME)
+	dname.Hdr.Ttl = ttl
+
+	prefix := strings.TrimSuffix(q.Name, owner) // owner was taken from q.Name, so this keeps its case
+	target := prefix + dname.Target
+	if dname.Target == "." {
+		target = prefix
+	}
+	if _, ok := dns.IsDomainName(target); !ok || len(target) > 255 {
+		// The synthesized name would be too long (RFC 6672 section 2.2)
+		return &dnsAnswer{Rcode: dns.RcodeYXDomain, Authoritative: authority, Answer: []dns.RR{dname}}
+	}
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+		Target: target,
+	}
+	dnsLog.Debug("dname", "qname", q.Name, "dname", owner, "target", target)
+
+	next := answerQuestion(cfg, c, &dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}, defaultTTL, append(chain[:len(chain):len(chain)], q.Name), recurse)
+	return &dnsAnswer{
+		Rcode:         chainRcode(next),
+		Authoritative: authority,
+		Answer:        append([]dns.RR{dname, cname}, next.Answer...),
+		Ns:            next.Ns,
+		Extra:         next.Extra,
+	}
+}
+
+// chainRcode returns the rcode of an answer whose CNAME or DNAME led to next,
+// which is that of next unless the target is outside our authority and
+// couldn't be forwarded, when the chain so far is a complete answer of ours
+func chainRcode(next *dnsAnswer) int {
+	if next.Rcode == dns.RcodeRefused {
+		return dns.RcodeSuccess
+	}
+	return next.Rcode
+}
+
+// findDelegation looks for NS records at each of the names between the apex of
+// zone and name, including name, closest to the apex first, as the highest zone
+// cut is the one that takes the rest out of our hands. It returns the name the
+// NS records are at along with the entry, which is nil if there isn't one.
+func findDelegation(cfg *Config, name string, zone string) (string, *DNSEntry, error) {
+	prefix := strings.TrimSuffix(strings.TrimSuffix(name, zone), ".")
+	if prefix == "" {
+		return "", nil, nil // the apex NS records are our own
+	}
+	nameParts := strings.Split(prefix, ".")
+	for i := len(nameParts) - 1; i >= 0; i-- {
+		cut := strings.Join(nameParts[i:], ".") + "." + zone
+		entry, err := cfg.db.GetDNS(cut, "NS")
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if len(entry.Values) > 0 {
+			return cut, entry, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// answerDelegation answers q, which is at or below the zone cut to the name
+// servers in entry, by asking those servers if recursion is wanted and we
+// forward at all, or otherwise with a referral to them: their NS records in
+// the authority section and any glue we hold for them (RFC 1034 section 4.3.2)
+func answerDelegation(cfg *Config, c dnscache.Context, q *dns.Question, cut string, entry *DNSEntry, defaultTTL uint32, recurse bool) *dnsAnswer {
+	ttl := defaultTTL
+	if entry.TTL > 0 {
+		ttl = entry.TTL
 	}
+	ns, _ := entryRecords(cut, dns.TypeNS, entry, ttl)
+	glue := additionalRecords(cfg, ns, defaultTTL)
 
-	return answers
+	if !recurse || !forwardingEnabled(cfg.DNSForwarders()) {
+		dnsLog.Debug("referral", "qname", q.Name, "cut", cut)
+		return &dnsAnswer{Rcode: dns.RcodeSuccess, Ns: ns, Extra: glue}
+	}
+
+	servers := nameServerAddresses(ns, glue)
+	dnsLog.Debug("forward to delegation", "qname", q.Name, "qtype", dns.Type(q.Qtype).String(), "cut", cut, "ms", msElapsed(c.Start, time.Now()))
+	m, err := forwardQuestion(q, servers)
+	if err != nil {
+		return &dnsAnswer{Rcode: dns.RcodeServerFailure}
+	}
+	return forwardedAnswer(m, nil)
+}
+
+// nameServerAddresses returns the host:port of each of the name servers in ns,
+// using the addresses in glue where there are any and their names otherwise
+func nameServerAddresses(ns []dns.RR, glue []dns.RR) []string {
+	var servers []string
+	glued := make(map[string]bool)
+	for _, rr := range glue {
+		switch rr := rr.(type) {
+		case *dns.A:
+			servers = append(servers, net.JoinHostPort(rr.A.String(), "53"))
+		case *dns.AAAA:
+			servers = append(servers, net.JoinHostPort(rr.AAAA.String(), "53"))
+		}
+		glued[strings.ToLower(rr.Header().Name)] = true
+	}
+	for _, rr := range ns {
+		if target := rr.(*dns.NS).Ns; !glued[strings.ToLower(target)] {
+			servers = append(servers, net.JoinHostPort(strings.TrimSuffix(target, "."), "53"))
+		}
+	}
+	return servers
+}
+
+// forwardedAnswer turns the response to a forwarded question into an answer,
+// following any answers we already have
+func forwardedAnswer(m *dns.Msg, answers []dns.RR) *dnsAnswer {
+	// The upstream OPT record describes its connection to us, not ours to the
+	// client
+	var extra []dns.RR
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	return &dnsAnswer{Rcode: m.Rcode, Answer: append(answers, m.Answer...), Ns: m.Ns, Extra: extra}
+}
+
+// negativeAnswer says that there's nothing for q: NXDOMAIN if nothing at all
+// is held for the name or below it, or otherwise NODATA (RFC 2308 section
+// 2.2), with the SOA of the zone holding the name in the authority section to
+// say how long that can be cached for
+func negativeAnswer(cfg *Config, q *dns.Question, defaultTTL uint32) *dnsAnswer {
+	exists, err := cfg.db.NameExists(q.Name)
+	if err != nil {
+		dnsLog.Error("lookup failed", "qname", q.Name, "err", err)
+		return &dnsAnswer{Rcode: dns.RcodeServerFailure}
+	}
+	answer := &dnsAnswer{Rcode: dns.RcodeNameError}
+	if exists {
+		answer.Rcode = dns.RcodeSuccess
+	}
+	if zone, entry := findZone(cfg, q.Name); entry != nil {
+		soa := answerSOA(&dns.Question{Name: zone, Qtype: dns.TypeSOA, Qclass: dns.ClassINET}, entry, soaSerial(entry)).(*dns.SOA)
+		soa.Hdr.Ttl = defaultTTL
+		if entry.TTL > 0 {
+			soa.Hdr.Ttl = entry.TTL
+		}
+		if soa.Minttl < soa.Hdr.Ttl {
+			soa.Hdr.Ttl = soa.Minttl // RFC 2308 section 3
+		}
+		answer.Ns = []dns.RR{soa}
+		answer.Authoritative = true
+	}
+	return answer
 }
 
 // msElapsed returns the number of milliseconds that have elapsed between now
@@ -286,11 +809,8 @@ func fetchRelatedEntries(cfg *Config, q *dns.Question) []chan dnsEntryResult {
 	if q.Qtype != dns.TypeCNAME {
 		entries = append(entries, fetchEntry(cfg, q, q.Qtype))
 	}
-	if q.Qtype != dns.TypeDNAME {
-		// TODO: Check for DNAME entries for the given name and for each parent for
-		//       which we have authority.
-		//queries = append(queries, fetchEntry(cfg, q, dns.TypeDNAME))
-	}
+	// NOTE: DNAME entries above the name are only looked for by findDNAME when
+	//       nothing is found here, as nothing can be held below a DNAME
 	return entries
 }
 
@@ -307,28 +827,24 @@ func fetchEntry(cfg *Config, q *dns.Question, rrType uint16) chan dnsEntryResult
 	return out
 }
 
-func prepareAnswerMsg(req *dns.Msg, answers []dns.RR) *dns.Msg {
+// prepareAnswerMsg builds the response to req. AA is only set for answers from
+// zones we have authority for, and RA when we forward what isn't ours.
+func prepareAnswerMsg(req *dns.Msg, answer *dnsAnswer, recursionAvailable bool) *dns.Msg {
 	answerMsg := new(dns.Msg)
 	answerMsg.Id = req.Id
+	answerMsg.Opcode = req.Opcode
 	answerMsg.Response = true
-	answerMsg.Authoritative = true
+	answerMsg.Authoritative = answer.Authoritative
+	answerMsg.RecursionDesired = req.RecursionDesired
+	answerMsg.RecursionAvailable = recursionAvailable
 	answerMsg.Question = req.Question
-	answerMsg.Answer = answers
-	answerMsg.Rcode = dns.RcodeSuccess
-	answerMsg.Extra = []dns.RR{}
+	answerMsg.Answer = answer.Answer
+	answerMsg.Ns = answer.Ns
+	answerMsg.Extra = answer.Extra
+	answerMsg.Rcode = answer.Rcode
 	return answerMsg
 }
 
-func prepareFailureMsg(req *dns.Msg) *dns.Msg {
-	failMsg := new(dns.Msg)
-	failMsg.Id = req.Id
-	failMsg.Response = true
-	failMsg.Authoritative = true
-	failMsg.Question = req.Question
-	failMsg.Rcode = dns.RcodeNameError
-	return failMsg
-}
-
 func isWOLTrigger(q *dns.Question) bool {
 	wolMatcher := regexp.MustCompile(`^_wol\.`)
 	return q.Qclass == dns.ClassINET && q.Qtype == dns.TypeTXT && wolMatcher.MatchString(q.Name)
@@ -341,7 +857,7 @@ func getWOLHostname(q *dns.Question) string {
 
 func processWOL(cfg *Config, q *dns.Question) dns.RR {
 	hostname := getWOLHostname(q)
-	log.Printf("WoL requested for %s", hostname)
+	dnsLog.Info("wake-on-LAN requested", "host", hostname)
 	err := wakeByHostname(cfg, hostname)
 	status := "OKAY"
 	if err != nil {
@@ -355,30 +871,97 @@ func processWOL(cfg *Config, q *dns.Question) dns.RR {
 	return answer
 }
 
-func answerSOA(q *dns.Question, e *DNSEntry) dns.RR {
+// answerSOA builds the SOA of the zone q.Name from the Meta of its @soa entry,
+// using the defaults for the timers that aren't set there
+func answerSOA(q *dns.Question, e *DNSEntry, serial uint32) dns.RR {
 	answer := new(dns.SOA)
 	answer.Header().Name = q.Name
 	answer.Header().Rrtype = dns.TypeSOA
 	answer.Header().Class = dns.ClassINET
 	answer.Ns = strings.TrimSuffix(e.Meta["ns"], ".") + "."
 	answer.Mbox = strings.TrimSuffix(e.Meta["mbox"], ".") + "."
-	answer.Serial = uint32(time.Now().Unix())
-	answer.Refresh = uint32(60) // only used for master->slave timing
-	answer.Retry = uint32(60)   // only used for master->slave timing
-	answer.Expire = uint32(60)  // only used for master->slave timing
-	answer.Minttl = uint32(60)  // how long caching resolvers should cache a miss (NXDOMAIN status)
+	answer.Serial = serial
+	answer.Refresh = soaField(q, e, "refresh", dnsDefaultRefresh)
+	answer.Retry = soaField(q, e, "retry", dnsDefaultRetry)
+	answer.Expire = soaField(q, e, "expire", dnsDefaultExpire)
+	answer.Minttl = soaField(q, e, "minttl", dnsDefaultMinTTL)
 	return answer
 }
 
+// soaField returns the named SOA field from the Meta of e, or def if it isn't
+// set or isn't a number
+func soaField(q *dns.Question, e *DNSEntry, field string, def uint32) uint32 {
+	value, ok := e.Meta[field]
+	if !ok {
+		return def
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		dnsLog.Warn("invalid SOA field", "zone", q.Name, "field", field, "value", value)
+		return def
+	}
+	return uint32(n)
+}
+
+// zoneSerial returns the serial number of zone
+func zoneSerial(cfg *Config, zone string) (uint32, error) {
+	entry, err := cfg.db.GetDNS(zone, "SOA")
+	if err != nil {
+		return 0, err
+	}
+	return soaSerial(entry), nil
+}
+
+// soaSerial returns the serial number kept in the "serial" Meta of a zone's
+// @soa entry. The backend raises it whenever anything in the zone changes,
+// including values expiring but not registrations being renewed, apart from in
+// zones copied from a primary, which keep the primary's serial. A zone that
+// hasn't been written to since it was set up falls back to the modification
+// index of the entry.
+func soaSerial(entry *DNSEntry) uint32 {
+	if serial, err := strconv.ParseUint(entry.Meta["serial"], 10, 32); err == nil {
+		return uint32(serial)
+	}
+	return uint32(entry.Modified) // serial arithmetic (RFC 1982) copes when this wraps
+}
+
 func answerTXT(q *dns.Question, v *DNSValue) dns.RR {
 	answer := new(dns.TXT)
 	answer.Header().Name = q.Name
 	answer.Header().Rrtype = dns.TypeTXT
 	answer.Header().Class = dns.ClassINET
-	answer.Txt = []string{v.Value}
+	strs, err := txtStrings(v.Value, v.Attr)
+	if err != nil {
+		strs = []string{v.Value}
+	}
+	answer.Txt = strs
 	return answer
 }
 
+// txtStrings splits the value of a TXT record into its character strings at
+// the byte lengths in its comma-separated "lengths" attribute, which is only
+// kept for records of more than one string (RFC 1035 section 3.3.14)
+func txtStrings(value string, attrs map[string]string) ([]string, error) {
+	lengths, ok := attrs["lengths"]
+	if !ok {
+		return []string{value}, nil
+	}
+	var strs []string
+	rest := value
+	for _, field := range strings.Split(lengths, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 0 || n > 255 || n > len(rest) {
+			return nil, fmt.Errorf("invalid TXT record lengths: %q", lengths)
+		}
+		strs = append(strs, rest[:n])
+		rest = rest[n:]
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid TXT record lengths: %q leaves %d bytes over", lengths, len(rest))
+	}
+	return strs, nil
+}
+
 func answerA(q *dns.Question, v *DNSValue) dns.RR {
 	answer := new(dns.A)
 	answer.Header().Name = q.Name
@@ -417,13 +1000,9 @@ func answerCNAME(q *dns.Question, v *DNSValue) (dns.RR, string) {
 }
 
 func answerDNAME(q *dns.Question, v *DNSValue) dns.RR {
-	// FIXME: This is not being used correctly.  See the notes about
-	//        fixing CNAME and then consider that DNAME takes it a
-	//        big step forward and aliases an entire subtree, not just
-	//        a single name in the tree.  Note that this is for pointing
-	//        to subtree, not to the self-equivalent.  See the Wikipedia
-	//        article about it, linked below.  See also CNAME above.
-	//				... http://en.wikipedia.org/wiki/CNAME_record#DNAME_record
+	// Info: http://en.wikipedia.org/wiki/CNAME_record#DNAME_record
+	// NOTE: This aliases the subtree below q.Name, not q.Name itself, so
+	//       it is only answered as is when asked for; see answerViaDNAME
 	answer := new(dns.DNAME)
 	answer.Header().Name = q.Name
 	answer.Header().Rrtype = dns.TypeDNAME
@@ -494,63 +1073,197 @@ func answerSRV(q *dns.Question, v *DNSValue) dns.RR {
 	return answer
 }
 
-// haveAuthority returns true if we are an authority for the zone containing
-// the given key
-func haveAuthority(cfg *Config, q *dns.Question) bool {
-	nameParts := strings.Split(strings.TrimSuffix(q.Name, "."), ".") // breakup the queryed name
-	// Check for authority at each level (but ignore the TLD)
-	for i := 0; i < len(nameParts)-1; i++ {
-		name := strings.Join(nameParts[i:], ".")
-		// Test for an SOA (which tells us we have authority)
-		found, err := cfg.db.HasDNS(name, "SOA")
-		if err == nil && found {
-			return true
+// registerAddress writes an address record of the given type for fqdn along
+// with the matching PTR record for ip
+func registerAddress(db DNSDB, rrType string, fqdn string, ip net.IP, exclusive bool, ttl uint32, expiration uint64) error {
+	// FIXME: Honor exclusive by removing any other addresses for this name
+	err := db.Register(fqdn, rrType, ip.String(), nil, ttl, expiration)
+	if err != nil {
+		return err
+	}
+	return db.Register(arpaNameFromIP(ip), "PTR", cleanFQDN(fqdn), nil, ttl, expiration)
+}
+
+// registerChanges reports whether registering value with attrs and ttl
+// changes what entry holds, which is nil if nothing is held yet. When the
+// registration expires doesn't count, so that renewing one leaves the serial
+// of its zone alone.
+func registerChanges(entry *DNSEntry, value string, attrs map[string]string, ttl uint32) bool {
+	if entry == nil || ttl != 0 && entry.TTL != ttl {
+		return true
+	}
+	for _, v := range entry.Values {
+		if v.Value != value {
+			continue
 		}
-		// Test for a DNAME which has special handling for aliasing of subdomains within
-		found, err = cfg.db.HasDNS(name, "DNAME")
-		if err == nil && found {
-			// FIXME!  THIS NEEDS TO HANDLE DNAME ALIASING CORRECTLY INSTEAD OF IGNORING IT...
-			log.Printf("DNAME EXISTS!  WE NEED TO HANDLE THIS CORRECTLY... FIXME\n")
+		if len(v.Attr) != len(attrs) {
 			return true
 		}
+		for name, a := range attrs {
+			if held, ok := v.Attr[name]; !ok || held != a {
+				return true
+			}
+		}
+		return false
 	}
-	return false
+	return true
 }
 
-func forwardQuestion(q *dns.Question, forwarders []string) []dns.RR {
+// validateDNSValue checks that the given value and attributes are suitable for
+// storage as a record of the given type. The rrType is case-insensitive.
+func validateDNSValue(rrType string, value string, attrs map[string]string) error {
+	switch strings.ToUpper(rrType) {
+	case "A":
+		ip := net.ParseIP(value)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid A record value: %q is not an IPv4 address", value)
+		}
+	case "AAAA":
+		ip := net.ParseIP(value)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid AAAA record value: %q is not an IPv6 address", value)
+		}
+	case "CNAME", "DNAME", "NS", "PTR":
+		if _, ok := dns.IsDomainName(value); !ok || value == "" {
+			return fmt.Errorf("invalid %s record value: %q is not a domain name", strings.ToUpper(rrType), value)
+		}
+	case "TXT":
+		if _, ok := attrs["lengths"]; !ok && len(value) > 255 {
+			return fmt.Errorf("invalid TXT record value: %d bytes exceeds the 255 byte limit", len(value))
+		}
+		if _, err := txtStrings(value, attrs); err != nil {
+			return err
+		}
+	case "MX":
+		target := value
+		if t, ok := attrs["target"]; ok {
+			target = t
+		}
+		if _, ok := dns.IsDomainName(target); !ok || target == "" {
+			return fmt.Errorf("invalid MX record target: %q is not a domain name", target)
+		}
+		if err := validateUint16Attr("MX", attrs, "priority"); err != nil {
+			return err
+		}
+	case "SRV":
+		target := value
+		if t, ok := attrs["target"]; ok {
+			target = t
+		} else if parts := strings.Split(value, ":"); len(parts) == 2 {
+			// allows for simplified setting of "target:port"
+			target = parts[0]
+			if _, err := strconv.ParseUint(parts[1], 10, 16); err != nil {
+				return fmt.Errorf("invalid SRV record port: %q", parts[1])
+			}
+		}
+		if _, ok := dns.IsDomainName(target); !ok || target == "" {
+			return fmt.Errorf("invalid SRV record target: %q is not a domain name", target)
+		}
+		for _, attr := range []string{"priority", "weight", "port"} {
+			if err := validateUint16Attr("SRV", attrs, attr); err != nil {
+				return err
+			}
+		}
+	default:
+		return ErrUnsupportedRRType
+	}
+	return nil
+}
+
+// validateUint16Attr returns an error if the given attribute is present but
+// is not an unsigned 16-bit integer
+func validateUint16Attr(rrType string, attrs map[string]string, attr string) error {
+	value, ok := attrs[attr]
+	if !ok {
+		return nil
+	}
+	if _, err := strconv.ParseUint(value, 10, 16); err != nil {
+		return fmt.Errorf("invalid %s record %s: %q", rrType, attr, value)
+	}
+	return nil
+}
+
+// arpaNameFromIP returns the reverse lookup name for the given IP address,
+// in in-addr.arpa form for IPv4 and in ip6.arpa nibble form for IPv6
+func arpaNameFromIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	const hexDigits = "0123456789abcdef"
+	nibbles := make([]string, 0, 2*net.IPv6len+2)
+	for i := net.IPv6len - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(hexDigits[ip16[i]&0x0f]), string(hexDigits[ip16[i]>>4]))
+	}
+	nibbles = append(nibbles, "ip6", "arpa")
+	return strings.Join(nibbles, ".")
+}
+
+// findZone returns the name of the closest zone holding name that we have the
+// SOA for, along with the SOA, or nil if there isn't one
+func findZone(cfg *Config, name string) (string, *DNSEntry) {
+	nameParts := strings.Split(strings.TrimSuffix(name, "."), ".")
+	// Check each level (but ignore the TLD)
+	for i := 0; i < len(nameParts)-1; i++ {
+		zone := strings.Join(nameParts[i:], ".") + "."
+		entry, err := cfg.db.GetDNS(zone, "SOA")
+		if err == nil {
+			return zone, entry
+		}
+	}
+	return "", nil
+}
+
+// ErrNoForwarders is returned when forwarding is disabled, either because no
+// forwarders are configured or because the first one is "!"
+var ErrNoForwarders = errors.New("no forwarders")
+
+// forwardingEnabled returns false if there are no forwarders, or if we've been
+// told explicitly not to pass anything along to any upstreams with "!"
+func forwardingEnabled(forwarders []string) bool {
+	return len(forwarders) > 0 && strings.TrimSpace(forwarders[0]) != "!"
+}
+
+// forwardQuestion asks each forwarder in turn until one of them answers
+func forwardQuestion(q *dns.Question, forwarders []string) (*dns.Msg, error) {
 	//qType := dns.Type(q.Qtype).String() // query type
 	//log.Printf("[Forwarder Lookup [%s] [%s]]\n", q.Name, qType)
 
 	myReq := new(dns.Msg)
 	myReq.SetQuestion(q.Name, q.Qtype)
 
-	if len(forwarders) == 0 {
-		// we have no upstreams, so we'll just not use any
-	} else if strings.TrimSpace(forwarders[0]) == "!" {
-		// we've been told explicitly to not pass anything along to any upsteams
-	} else {
-		c := new(dns.Client)
-		for _, server := range forwarders {
-			c.Net = "udp"
-			m, _, err := c.Exchange(myReq, strings.TrimSpace(server))
-
-			if m != nil && m.MsgHdr.Truncated {
-				c.Net = "tcp"
-				m, _, err = c.Exchange(myReq, strings.TrimSpace(server))
-			}
-
-			// FIXME: Cache misses.  And cache hits, too.
+	if !forwardingEnabled(forwarders) {
+		return nil, ErrNoForwarders
+	}
 
-			if err != nil {
-				//log.Printf("[Forwarder Lookup [%s] [%s] failed: [%s]]\n", q.Name, qType, err)
-				log.Println(err)
-			} else {
-				//log.Printf("[Forwarder Lookup [%s] [%s] success]\n", q.Name, qType)
-				return m.Answer
-			}
+	var err error
+	c := new(dns.Client)
+	for _, server := range forwarders {
+		server = strings.TrimSpace(server)
+		start := time.Now()
+		c.Net = "udp"
+		var m *dns.Msg
+		m, _, err = c.Exchange(myReq, server)
+
+		if m != nil && m.MsgHdr.Truncated {
+			c.Net = "tcp"
+			m, _, err = c.Exchange(myReq, server)
+		}
+		dnsForwarderDuration.WithLabelValues(server).Observe(time.Since(start).Seconds())
+
+		if err != nil {
+			//log.Printf("[Forwarder Lookup [%s] [%s] failed: [%s]]\n", q.Name, qType, err)
+			dnsLog.Warn("forwarder failed", "forwarder", server, "qname", q.Name, "qtype", dns.Type(q.Qtype).String(), "err", err)
+			dnsForwarderErrors.WithLabelValues(server).Inc()
+		} else {
+			//log.Printf("[Forwarder Lookup [%s] [%s] success]\n", q.Name, qType)
+			return m, nil
 		}
 	}
-	return nil
+	return nil, err
 }
 
 // FIXME: please support DNSSEC, verification, signing, etc...
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/dustywilson/dnscache"
 	"github.com/miekg/dns"
 )
 
@@ -11,3 +15,324 @@ func TestWOL(t *testing.T) {
 	m := new(dns.Msg)
 	m.SetQuestion("_wol.test", dns.TypeTXT)
 }
+
+// newTestDNS returns a config for a memory database holding the example.com
+// zone, which doesn't forward anything
+func newTestDNS(t *testing.T) (*Config, *MemDB) {
+	db := NewMemDB()
+	db.owner = ""
+	db.dns[memDNSKey("example.com", "SOA")] = &memRRSet{
+		ttl:    3600,
+		meta:   map[string]string{"ns": "ns1.example.com", "mbox": "hostmaster.example.com"},
+		values: make(map[string]*memDNSValue),
+	}
+	for _, record := range []struct{ name, rrType, value string }{
+		{"www.example.com", "A", "10.0.0.1"},
+		{"host.lab.example.com", "A", "10.0.0.2"},
+	} {
+		if err := db.Register(record.name, record.rrType, record.value, nil, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &Config{db: db, hostname: "core1", dnsForwarders: []string{"!"}}
+	return cfg, db
+}
+
+// ask answers a question the way the cache would, passing the answer through
+// the records the cache keeps
+func ask(cfg *Config, name string, qtype uint16) *dnsAnswer {
+	q := &dns.Question{Name: dns.Fqdn(name), Qtype: qtype, Qclass: dns.ClassINET}
+	answer := answerQuestion(cfg, dnscache.Context{Event: dnscache.Lookup, Start: time.Now()}, q, dnsDefaultTTL, nil, true)
+	return answerFromRecords(answer.records(60))
+}
+
+func TestNegativeAnswers(t *testing.T) {
+	cfg, _ := newTestDNS(t)
+
+	for _, test := range []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		soa     bool
+	}{
+		{"www.example.com", dns.TypeA, dns.RcodeSuccess, 1, false},
+		{"www.example.com", dns.TypeAAAA, dns.RcodeSuccess, 0, true}, // NODATA
+		{"lab.example.com", dns.TypeA, dns.RcodeSuccess, 0, true},    // exists, as there's something below it
+		{"nope.example.com", dns.TypeA, dns.RcodeNameError, 0, true}, // NXDOMAIN
+		{"www.example.org", dns.TypeA, dns.RcodeRefused, 0, false},   // not ours, and forwarding is off
+	} {
+		answer := ask(cfg, test.name, test.qtype)
+		if answer.Rcode != test.rcode || len(answer.Answer) != test.answers {
+			t.Errorf("%s %s: expected %s with %d answers, got %s with %v", test.name, dns.Type(test.qtype), dns.RcodeToString[test.rcode], test.answers, dns.RcodeToString[answer.Rcode], answer.Answer)
+		}
+		if !test.soa {
+			if len(answer.Ns) != 0 {
+				t.Errorf("%s %s: unexpected authority %v", test.name, dns.Type(test.qtype), answer.Ns)
+			}
+			continue
+		}
+		if len(answer.Ns) != 1 {
+			t.Errorf("%s %s: expected the SOA as the authority, got %v", test.name, dns.Type(test.qtype), answer.Ns)
+			continue
+		}
+		soa, ok := answer.Ns[0].(*dns.SOA)
+		if !ok || soa.Hdr.Name != "example.com." || soa.Hdr.Ttl != soa.Minttl {
+			t.Errorf("%s %s: unexpected authority %v", test.name, dns.Type(test.qtype), answer.Ns[0])
+		}
+	}
+}
+
+func TestForwarderFailure(t *testing.T) {
+	cfg, _ := newTestDNS(t)
+	cfg.dnsForwarders = []string{"127.0.0.1:1"} // nothing listens there
+
+	if answer := ask(cfg, "www.example.org", dns.TypeA); answer.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL when no forwarder answers, got %s", dns.RcodeToString[answer.Rcode])
+	}
+	if answer := answerFromRecords(nil); answer.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL without an answer from the cache, got %s", dns.RcodeToString[answer.Rcode])
+	}
+}
+
+// fakeUpstream answers every question with an A record, along with authority
+// and additional records, until it is shut down
+func fakeUpstream(t *testing.T) (*dns.Server, string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		name := req.Question[0].Name
+		a, _ := dns.NewRR(name + " 300 IN A 192.0.2.10")
+		ns, _ := dns.NewRR(name + " 300 IN NS ns.example.org.")
+		glue, _ := dns.NewRR("ns.example.org. 300 IN A 192.0.2.53")
+		m.Answer, m.Ns, m.Extra = []dns.RR{a}, []dns.RR{ns}, []dns.RR{glue}
+		m.SetEdns0(4096, false)
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	return server, pc.LocalAddr().String()
+}
+
+func TestResponseFlags(t *testing.T) {
+	cfg, _ := newTestDNS(t)
+	upstream, addr := fakeUpstream(t)
+	defer upstream.Shutdown()
+	cfg.dnsForwarders = []string{addr}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	msg := prepareAnswerMsg(req, ask(cfg, "www.example.com", dns.TypeA), forwardingEnabled(cfg.DNSForwarders()))
+	if !msg.Authoritative || !msg.RecursionAvailable || !msg.RecursionDesired {
+		t.Errorf("expected AA, RA and RD for our own name, got %s", msg.MsgHdr.String())
+	}
+
+	forwarded := ask(cfg, "www.example.org", dns.TypeA)
+	if forwarded.Authoritative || len(forwarded.Answer) != 1 || len(forwarded.Ns) != 1 || len(forwarded.Extra) != 1 {
+		t.Errorf("expected the upstream sections without AA or the OPT record, got %+v", forwarded)
+	}
+
+	q := &dns.Question{Name: "www.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if answer := answerQuestion(cfg, dnscache.Context{Start: time.Now()}, q, dnsDefaultTTL, nil, false); answer.Rcode != dns.RcodeRefused {
+		t.Errorf("expected names that aren't ours to be refused without recursion, got %s", dns.RcodeToString[answer.Rcode])
+	}
+	if answer := answerQuestion(cfg, dnscache.Context{Start: time.Now()}, &dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, dnsDefaultTTL, nil, false); answer.Rcode != dns.RcodeSuccess || !answer.Authoritative {
+		t.Errorf("expected our own names to be answered without recursion, got %s", dns.RcodeToString[answer.Rcode])
+	}
+}
+
+func TestDNAME(t *testing.T) {
+	cfg, db := newTestDNS(t)
+	if err := db.Register("old.example.com", "DNAME", "lab.example.com", nil, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	answer := ask(cfg, "host.old.example.com", dns.TypeA)
+	if answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != 3 {
+		t.Fatalf("expected the DNAME, CNAME and A records, got %s with %v", dns.RcodeToString[answer.Rcode], answer.Answer)
+	}
+	dname, ok := answer.Answer[0].(*dns.DNAME)
+	if !ok || dname.Hdr.Name != "old.example.com." || dname.Target != "lab.example.com." {
+		t.Errorf("unexpected DNAME: %v", answer.Answer[0])
+	}
+	cname, ok := answer.Answer[1].(*dns.CNAME)
+	if !ok || cname.Hdr.Name != "host.old.example.com." || cname.Target != "host.lab.example.com." {
+		t.Errorf("unexpected CNAME: %v", answer.Answer[1])
+	}
+	if a, ok := answer.Answer[2].(*dns.A); !ok || a.Hdr.Name != "host.lab.example.com." || a.A.String() != "10.0.0.2" {
+		t.Errorf("unexpected A: %v", answer.Answer[2])
+	}
+
+	// The target is looked up like any other name, so a missing one is NXDOMAIN
+	if answer := ask(cfg, "nope.old.example.com", dns.TypeA); answer.Rcode != dns.RcodeNameError || len(answer.Answer) != 2 {
+		t.Errorf("expected NXDOMAIN after the DNAME and CNAME, got %s with %v", dns.RcodeToString[answer.Rcode], answer.Answer)
+	}
+
+	// The DNAME doesn't alias its own name
+	if answer := ask(cfg, "old.example.com", dns.TypeDNAME); len(answer.Answer) != 1 || answer.Answer[0].Header().Rrtype != dns.TypeDNAME {
+		t.Errorf("expected just the DNAME itself, got %v", answer.Answer)
+	}
+}
+
+func TestCNAMEChains(t *testing.T) {
+	cfg, db := newTestDNS(t)
+	upstream, addr := fakeUpstream(t)
+	defer upstream.Shutdown()
+	cfg.dnsForwarders = []string{addr}
+
+	register := func(name string, target string) {
+		if err := db.Register(name, "CNAME", target, nil, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	register("loop1.example.com", "loop2.example.com")
+	register("loop2.example.com", "loop1.example.com")
+	for i := 0; i < dnsMaxChain+1; i++ {
+		register(fmt.Sprintf("chain%d.example.com", i), fmt.Sprintf("chain%d.example.com", i+1))
+	}
+	register(fmt.Sprintf("chain%d.example.com", dnsMaxChain+1), "www.example.com")
+	register("short.example.com", "chain5.example.com")
+	register("outside.example.com", "www.example.org")
+
+	for _, name := range []string{"loop1.example.com", "chain0.example.com"} {
+		if answer := ask(cfg, name, dns.TypeA); answer.Rcode != dns.RcodeServerFailure {
+			t.Errorf("%s: expected SERVFAIL, got %s", name, dns.RcodeToString[answer.Rcode])
+		}
+	}
+	if answer := ask(cfg, "short.example.com", dns.TypeA); answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != dnsMaxChain-1 {
+		t.Errorf("expected the chain to be followed, got %s with %v", dns.RcodeToString[answer.Rcode], answer.Answer)
+	}
+	if answer := ask(cfg, "loop1.example.com", dns.TypeCNAME); answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != 1 {
+		t.Errorf("expected just the CNAME when it's asked for, got %v", answer.Answer)
+	}
+
+	q := &dns.Question{Name: "outside.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	answer := answerQuestion(cfg, dnscache.Context{Start: time.Now()}, q, dnsDefaultTTL, nil, true)
+	if q.Name != "outside.example.com." {
+		t.Errorf("the question was changed to %s", q.Name)
+	}
+	if answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != 2 || answer.Answer[1].Header().Name != "www.example.org." {
+		t.Errorf("expected the CNAME and the forwarded answer for its target, got %v", answer.Answer)
+	}
+
+	// Without recursion, or with forwarding turned off, the CNAME is the answer
+	answer = answerQuestion(cfg, dnscache.Context{Start: time.Now()}, q, dnsDefaultTTL, nil, false)
+	if answer.Rcode != dns.RcodeSuccess || !answer.Authoritative || len(answer.Answer) != 1 {
+		t.Errorf("expected just the CNAME without recursion, got %s with %v", dns.RcodeToString[answer.Rcode], answer.Answer)
+	}
+	cfg.dnsForwarders = []string{"!"}
+	if answer = ask(cfg, "outside.example.com", dns.TypeA); answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != 1 {
+		t.Errorf("expected just the CNAME with forwarding off, got %s with %v", dns.RcodeToString[answer.Rcode], answer.Answer)
+	}
+}
+
+func TestAdditionalRecords(t *testing.T) {
+	cfg, db := newTestDNS(t)
+	for _, record := range []struct {
+		name, rrType, value string
+		attrs               map[string]string
+	}{
+		{"example.com", "MX", "mail.example.com", map[string]string{"priority": "10"}},
+		{"example.com", "NS", "ns1.example.com", nil},
+		{"mail.example.com", "A", "10.0.0.25", nil},
+		{"ns1.example.com", "A", "10.0.0.53", nil},
+		{"_sip._udp.example.com", "SRV", "pbx.example.com:5060", nil},
+		{"pbx.example.com", "A", "10.0.0.60", nil},
+		{"pbx.example.com", "AAAA", "2001:db8::60", nil},
+	} {
+		if err := db.Register(record.name, record.rrType, record.value, record.attrs, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		qtype  uint16
+		expect []string
+	}{
+		{"example.com", dns.TypeMX, []string{"mail.example.com. A"}},
+		{"example.com", dns.TypeNS, []string{"ns1.example.com. A"}},
+		{"_sip._udp.example.com", dns.TypeSRV, []string{"pbx.example.com. A", "pbx.example.com. AAAA"}},
+		{"www.example.com", dns.TypeA, nil},
+	} {
+		answer := ask(cfg, test.name, test.qtype)
+		var extra []string
+		for _, rr := range answer.Extra {
+			extra = append(extra, rr.Header().Name+" "+dns.Type(rr.Header().Rrtype).String())
+		}
+		if fmt.Sprint(extra) != fmt.Sprint(test.expect) {
+			t.Errorf("%s %s: expected additional %v, got %v", test.name, dns.Type(test.qtype), test.expect, extra)
+		}
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	cfg, db := newTestDNS(t)
+	for _, record := range []struct{ name, rrType, value string }{
+		{"example.com", "NS", "ns1.example.com"},
+		{"ns1.example.com", "A", "10.0.0.53"},
+		{"child.example.com", "NS", "ns1.child.example.com"},
+		{"ns1.child.example.com", "A", "10.0.0.99"},
+	} {
+		if err := db.Register(record.name, record.rrType, record.value, nil, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The glue and the cut's own NS records belong to the child too
+	for _, name := range []string{"host.child.example.com", "ns1.child.example.com", "child.example.com"} {
+		answer := ask(cfg, name, dns.TypeA)
+		if answer.Rcode != dns.RcodeSuccess || answer.Authoritative || len(answer.Answer) != 0 {
+			t.Errorf("%s: expected a referral, got %s %v aa=%v", name, dns.RcodeToString[answer.Rcode], answer.Answer, answer.Authoritative)
+			continue
+		}
+		if len(answer.Ns) != 1 || answer.Ns[0].(*dns.NS).Hdr.Name != "child.example.com." || answer.Ns[0].(*dns.NS).Ns != "ns1.child.example.com." {
+			t.Errorf("%s: expected the child's NS records, got %v", name, answer.Ns)
+		}
+		if len(answer.Extra) != 1 || answer.Extra[0].(*dns.A).A.String() != "10.0.0.99" {
+			t.Errorf("%s: expected the glue, got %v", name, answer.Extra)
+		}
+	}
+
+	// The apex NS records aren't a delegation
+	if answer := ask(cfg, "example.com", dns.TypeNS); !answer.Authoritative || len(answer.Answer) != 1 {
+		t.Errorf("expected our own NS records, got %v aa=%v", answer.Answer, answer.Authoritative)
+	}
+}
+
+func TestSOA(t *testing.T) {
+	cfg, db := newTestDNS(t)
+	db.dns[memDNSKey("example.com", "SOA")].meta["refresh"] = "7200"
+	db.dns[memDNSKey("example.com", "SOA")].meta["retry"] = "soon"
+
+	soa := func() *dns.SOA {
+		answer := ask(cfg, "example.com", dns.TypeSOA)
+		if len(answer.Answer) != 1 {
+			t.Fatalf("expected the SOA, got %v", answer.Answer)
+		}
+		return answer.Answer[0].(*dns.SOA)
+	}
+	first := soa()
+	if first.Refresh != 7200 || first.Retry != dnsDefaultRetry || first.Expire != dnsDefaultExpire || first.Minttl != dnsDefaultMinTTL {
+		t.Errorf("expected the refresh from the Meta and defaults for the rest, got %v", first)
+	}
+
+	if serial := soa().Serial; serial != first.Serial {
+		t.Errorf("expected the serial to stay at %d without changes, got %d", first.Serial, serial)
+	}
+	if err := db.Register("www.example.org", "A", "10.0.1.1", nil, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if serial := soa().Serial; serial != first.Serial {
+		t.Errorf("expected the serial to stay at %d after a change to another zone, got %d", first.Serial, serial)
+	}
+	if err := db.Register("new.example.com", "A", "10.0.0.3", nil, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if serial := soa().Serial; serial <= first.Serial {
+		t.Errorf("expected the serial to go up from %d after a change, got %d", first.Serial, serial)
+	}
+}
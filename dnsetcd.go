@@ -3,8 +3,9 @@ package main
 import (
 	"crypto/sha1"
 	"fmt"
-	"log"
 	"net"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -21,15 +22,19 @@ func (db EtcdDB) GetDNS(name string, rrType string) (*DNSEntry, error) {
 	key := etcdDNSKeyFromFQDN(name) + "/@" + rrType // structure the lookup key
 
 	response, err := db.client.Get(key, true, true) // do the lookup
+	if etcdKeyNotFound(err) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	if response != nil && response.Node != nil && len(response.Node.Nodes) > 0 {
-		if rrType == "cname" {
-			// FIXME: Check for infinite recursion?
+		// NOTE: CNAME loops are caught by answerQuestion
+		entry := etcdNodeToDNSEntry(response.Node)
+		if len(entry.Values) > 0 || len(entry.Meta) > 0 {
+			return entry, nil
 		}
-		return etcdNodeToDNSEntry(response.Node), nil
 	}
 
 	return nil, ErrNotFound
@@ -40,6 +45,9 @@ func (db EtcdDB) HasDNS(name string, rrType string) (bool, error) {
 	key := etcdDNSKeyFromFQDN(name) + "/@" + rrType // structure the lookup key
 
 	response, err := db.client.Get(key, false, false) // do the lookup
+	if etcdKeyNotFound(err) {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
@@ -51,53 +59,314 @@ func (db EtcdDB) HasDNS(name string, rrType string) (bool, error) {
 	return false, nil
 }
 
-func (db EtcdDB) RegisterA(fqdn string, ip net.IP, exclusive bool, ttl uint32, expiration uint64) error {
-	fqdn = cleanFQDN(fqdn)
-	ipString := ip.String()
-	ttlString := fmt.Sprintf("%d", ttl)
-	ipHash := fmt.Sprintf("%x", sha1.Sum([]byte(ipString))) // hash the IP address so we can have a unique key name (no other reason for this, honestly)
-	fqdnHash := fmt.Sprintf("%x", sha1.Sum([]byte(fqdn)))   // hash the hostname so we can have a unique key name (no other reason for this, honestly)
-
-	// Register the A record
-	aKey := etcdDNSKeyFromFQDN(fqdn) + "/@a"
-	log.Printf("[REGISTER] [%s %d] %s. %d IN A %s\n", aKey, expiration, fqdn, ttl, ipString)
-	_, err := db.client.Set(aKey+"/val/"+ipHash, ipString, expiration)
+// NameExists reports whether anything is held for name or the names below it,
+// from the directory of name alone
+func (db EtcdDB) NameExists(name string) (bool, error) {
+	response, err := db.client.Get(strings.TrimSuffix(etcdDNSKeyFromFQDN(name), "/"), false, false)
+	if etcdKeyNotFound(err) {
+		return false, nil
+	}
 	if err != nil {
+		return false, err
+	}
+	return response.Node != nil && response.Node.Dir && len(response.Node.Nodes) > 0, nil
+}
+
+// Register writes a single value for the given name and record type. When
+// attrs are provided the value is stored as a directory holding the attributes
+// alongside the value itself. Every record type, including the PTR records
+// written by RegisterA and RegisterAAAA, is written through here so that TTL,
+// expiration and ownership are always stored the same way.
+func (db EtcdDB) Register(fqdn string, rrType string, value string, attrs map[string]string, ttl uint32, expiration uint64) error {
+	if err := validateDNSValue(rrType, value, attrs); err != nil {
+		return err
+	}
+	fqdn = cleanFQDN(fqdn)
+	rrType = strings.ToLower(rrType)
+	valueHash := fmt.Sprintf("%x", sha1.Sum([]byte(value))) // hash the value so we can have a unique key name (no other reason for this, honestly)
+
+	key := etcdDNSKeyFromFQDN(fqdn) + "/@" + rrType
+	valKey := key + "/val/" + valueHash
+	dnsLog.Info("register", "qname", cleanFQDN(fqdn), "qtype", strings.ToUpper(rrType), "value", value, "ttl", ttl, "expiration", expiration, "key", key)
+
+	previous, err := db.GetDNS(fqdn, rrType)
+	if err != nil && err != ErrNotFound {
 		return err
 	}
+
+	if len(attrs) == 0 {
+		_, err := db.client.Set(valKey, value, expiration)
+		if err != nil {
+			return err
+		}
+	} else {
+		// The directory carries the expiration so that the attributes expire with it
+		_, err := db.client.UpdateDir(valKey, expiration)
+		if etcdKeyNotFound(err) {
+			_, err = db.client.CreateDir(valKey, expiration)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = db.client.Set(valKey+"/value", value, 0)
+		if err != nil {
+			return err
+		}
+		for attr, attrValue := range attrs {
+			_, err = db.client.Set(valKey+"/"+attr, attrValue, 0)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Record ownership and TTL alongside the value with the same expiration so
+	// that they live exactly as long as the value does
+	if db.owner != "" {
+		_, err := db.client.Set(key+"/own/"+valueHash, db.owner, expiration)
+		if err != nil {
+			return err
+		}
+	}
 	if ttl != 0 {
-		_, err := db.client.Set(aKey+"/ttl", ttlString, expiration)
+		_, err := db.client.Set(key+"/ttl", fmt.Sprintf("%d", ttl), expiration)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Register the PTR record
-	ptrKey := etcdDNSArpaKeyFromIP(ip) + "/@ptr"
-	log.Printf("[REGISTER] [%s %d] %s. %d IN A %s\n", ptrKey, expiration, fqdn, ttl, ipString)
-	_, err = db.client.Set(ptrKey+"/val/"+fqdnHash, fqdn, expiration)
+	if !registerChanges(previous, value, attrs, ttl) {
+		return nil // only renewed
+	}
+	return db.bumpSerial(fqdn, 0)
+}
+
+// RegisterA writes an A record for the given name and a PTR record for the
+// given IPv4 address
+func (db EtcdDB) RegisterA(fqdn string, ip net.IP, exclusive bool, ttl uint32, expiration uint64) error {
+	return registerAddress(db, "A", fqdn, ip, exclusive, ttl, expiration)
+}
+
+// RegisterAAAA writes an AAAA record for the given name and a PTR record for
+// the given IPv6 address in ip6.arpa
+func (db EtcdDB) RegisterAAAA(fqdn string, ip net.IP, exclusive bool, ttl uint32, expiration uint64) error {
+	return registerAddress(db, "AAAA", fqdn, ip, exclusive, ttl, expiration)
+}
+
+// Unregister removes a single value for the given name and record type, or the
+// whole record set if value is empty
+func (db EtcdDB) Unregister(fqdn string, rrType string, value string) error {
+	key := etcdDNSKeyFromFQDN(fqdn) + "/@" + strings.ToLower(rrType)
+	dnsLog.Info("unregister", "qname", cleanFQDN(fqdn), "qtype", strings.ToUpper(rrType), "value", value, "key", key)
+	if value == "" {
+		_, err := db.client.Delete(key, true)
+		if etcdKeyNotFound(err) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return db.bumpSerial(fqdn, 0)
+	}
+	valueHash := fmt.Sprintf("%x", sha1.Sum([]byte(value)))
+	_, err := db.client.Delete(key+"/val/"+valueHash, true)
+	if etcdKeyNotFound(err) {
+		return ErrNotFound
+	}
 	if err != nil {
 		return err
 	}
-	if ttl != 0 {
-		_, err := db.client.Set(aKey+"/ttl", ttlString, expiration)
+	_, err = db.client.Delete(key+"/own/"+valueHash, false)
+	if err != nil && !etcdKeyNotFound(err) {
+		return err
+	}
+	return db.bumpSerial(fqdn, 0)
+}
+
+// SetDNSMeta writes each of meta alongside the values for the given name and
+// record type, leaving any other Meta as it is
+func (db EtcdDB) SetDNSMeta(fqdn string, rrType string, meta map[string]string) error {
+	key := etcdDNSKeyFromFQDN(fqdn) + "/@" + strings.ToLower(rrType)
+	for name, value := range meta {
+		_, err := db.client.Set(key+"/"+name, value, 0)
 		if err != nil {
 			return err
 		}
 	}
+	if _, ok := meta["serial"]; ok {
+		return nil // copied from a primary
+	}
+	return db.bumpSerial(fqdn, 0)
+}
+
+// bumpSerial raises the serial of the zone holding name with compare-and-swap,
+// unless the zone is a copy of a primary's or, when index isn't zero, its
+// serial has been raised since that index already
+func (db EtcdDB) bumpSerial(name string, index uint64) error {
+	for _, zone := range dnsEnclosingNames(name) {
+		key := etcdDNSKeyFromFQDN(zone) + "/@soa"
+		for {
+			response, err := db.client.Get(key, false, false)
+			if etcdKeyNotFound(err) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			var serial *etcd.Node
+			held := false
+			for _, node := range response.Node.Nodes {
+				switch path.Base(node.Key) {
+				case "serial":
+					serial = node
+				case "primary":
+					if node.Value != "" {
+						return nil
+					}
+					held = true
+				default:
+					held = true
+				}
+			}
+			if !held {
+				break // only the serial of a removed zone is left
+			}
+			if serial == nil {
+				// Start where a zone that has never been written would be
+				_, err = db.client.Create(key+"/serial", strconv.FormatUint(uint64(uint32(response.EtcdIndex)+1), 10), 0)
+			} else {
+				if index != 0 && serial.ModifiedIndex > index {
+					return nil
+				}
+				n, _ := strconv.ParseUint(serial.Value, 10, 32)
+				_, err = db.client.CompareAndSwap(key+"/serial", strconv.FormatUint(uint64(uint32(n)+1), 10), 0, "", serial.ModifiedIndex)
+			}
+			if etcdKeyExists(err) || etcdCompareFailed(err) {
+				continue // raised by another instance in the meantime
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// KeepSerials raises the serial of a zone whenever one of its values expires.
+// Every instance does, but only the first to see each expiry gets to.
+func (db EtcdDB) KeepSerials(stop <-chan struct{}) {
+	db.watchDirEvents("dns", stop, func(response *etcd.Response) {
+		var err error
+		switch {
+		case response == nil: // anything may have expired
+			var zones []string
+			if zones, err = dnsZones(db); err == nil {
+				for _, zone := range zones {
+					if err = db.bumpSerial(zone, 0); err != nil {
+						break
+					}
+				}
+			}
+		case response.Action == "expire":
+			err = db.bumpSerial(etcdDNSNameFromKey(response.Node.Key), response.Node.ModifiedIndex)
+		}
+		if err != nil {
+			dnsLog.Warn("raising serial failed", "err", err)
+		}
+	})
+}
+
+// ListDNS returns every record set for name and the names below it, or every
+// record set of all if name is empty
+func (db EtcdDB) ListDNS(name string) ([]DNSRecord, error) {
+	response, err := db.client.Get(strings.TrimSuffix(etcdDNSKeyFromFQDN(name), "/"), true, true)
+	if etcdKeyNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []DNSRecord
+	var walk func(node *etcd.Node, labels []string)
+	walk = func(node *etcd.Node, labels []string) {
+		for _, child := range node.Nodes {
+			if !child.Dir {
+				continue
+			}
+			base := path.Base(child.Key)
+			if !strings.HasPrefix(base, "@") {
+				walk(child, append([]string{base}, labels...))
+				continue
+			}
+			entry := etcdNodeToDNSEntry(child)
+			if len(entry.Values) > 0 || len(entry.Meta) > 0 {
+				records = append(records, DNSRecord{Name: strings.Join(labels, "."), Type: strings.ToUpper(base[1:]), Entry: entry})
+			}
+		}
+	}
+	var labels []string
+	if name := cleanFQDN(name); name != "" {
+		labels = strings.Split(name, ".")
+	}
+	walk(response.Node, labels)
+	sort.Sort(dnsRecordsByName(records))
+	return records, nil
+}
+
+func (db EtcdDB) WatchDNS(stop <-chan struct{}) <-chan string {
+	changed := make(chan string)
+	go func() {
+		defer close(changed)
+		db.watchDir("dns", stop, func(key string) {
+			select {
+			case changed <- etcdDNSNameFromKey(key):
+			case <-stop:
+			}
+		})
+	}()
+	return changed
+}
+
+// ClaimNotify creates a key for the serial of zone that expires after
+// dnsNotifyClaimTTL, which only the first instance to try can do
+func (db EtcdDB) ClaimNotify(zone string, serial uint32) (bool, error) {
+	_, err := db.client.Create(etcdNotifyKey(zone, serial), db.owner, dnsNotifyClaimTTL)
+	if etcdKeyExists(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
 
-	return err
+// ClaimTransfer creates a key for the serial of zone that expires after
+// dnsSecondaryClaimTTL, which only the first instance to try can do, though
+// it can then claim it again to retry a transfer that failed
+func (db EtcdDB) ClaimTransfer(zone string, serial uint32) (bool, error) {
+	key := etcdTransferKey(zone, serial)
+	_, err := db.client.Create(key, db.owner, dnsSecondaryClaimTTL)
+	if !etcdKeyExists(err) {
+		return err == nil, err
+	}
+	response, err := db.client.Get(key, false, false)
+	if etcdKeyNotFound(err) {
+		return false, nil // it lapsed just now, and can be claimed next time
+	}
+	if err != nil {
+		return false, err
+	}
+	return response.Node.Value == db.owner, nil
 }
 
 func etcdNodeToDNSEntry(root *etcd.Node) *DNSEntry {
-	entry := &DNSEntry{}
+	entry := &DNSEntry{Modified: etcdModifiedIndex(root)}
+	var valueNodes etcd.Nodes
+	owners := make(map[string]string)
 	for _, node := range root.Nodes {
 		key := strings.Replace(node.Key, root.Key+"/", "", 1)
 		if node.Dir {
-			if key == "val" {
-				entry.Values = make([]DNSValue, len(node.Nodes))
-				for i, child := range node.Nodes {
-					etcdNodeToDNSValue(child, &entry.Values[i])
+			switch key {
+			case "val":
+				valueNodes = node.Nodes
+			case "own":
+				for _, child := range node.Nodes {
+					owners[strings.Replace(child.Key, node.Key+"/", "", 1)] = child.Value
 				}
 			}
 		} else {
@@ -115,9 +384,28 @@ func etcdNodeToDNSEntry(root *etcd.Node) *DNSEntry {
 			}
 		}
 	}
+	if valueNodes != nil {
+		entry.Values = make([]DNSValue, len(valueNodes))
+		for i, child := range valueNodes {
+			etcdNodeToDNSValue(child, &entry.Values[i])
+			entry.Values[i].Owner = owners[path.Base(child.Key)]
+		}
+	}
 	return entry
 }
 
+// etcdModifiedIndex returns the highest modification index of node and
+// everything below it
+func etcdModifiedIndex(node *etcd.Node) uint64 {
+	modified := node.ModifiedIndex
+	for _, child := range node.Nodes {
+		if index := etcdModifiedIndex(child); index > modified {
+			modified = index
+		}
+	}
+	return modified
+}
+
 func etcdNodeToDNSValue(node *etcd.Node, value *DNSValue) {
 	value.Expiration = node.Expiration
 
@@ -131,6 +419,10 @@ func etcdNodeToDNSValue(node *etcd.Node, value *DNSValue) {
 		value.Attr = make(map[string]string)
 		for _, attrNode := range node.Nodes {
 			key := strings.Replace(attrNode.Key, node.Key+"/", "", 1)
+			if key == "value" {
+				value.Value = attrNode.Value // written by Register when attributes are present
+				continue
+			}
 			value.Attr[key] = attrNode.Value
 		}
 	}
@@ -146,8 +438,27 @@ func etcdDNSKeyFromFQDN(fqdn string) string {
 	return "/dns/" + path
 }
 
-func etcdDNSArpaKeyFromIP(ip net.IP) string {
-	// FIXME: Support IPv6 addresses
-	slashedIP := strings.Replace(ip.To4().String(), ".", "/", -1)
-	return "dns/arpa/in-addr/" + slashedIP
+// etcdDNSNameFromKey returns the name of the record set that a key in the DNS
+// tree belongs to, such as "www.example.com" for "/dns/com/example/www/@a/ttl"
+func etcdDNSNameFromKey(key string) string {
+	var labels []string
+	for _, label := range strings.Split(strings.TrimPrefix(key, "/dns/"), "/") {
+		if strings.HasPrefix(label, "@") {
+			break
+		}
+		labels = append(labels, label)
+	}
+	return strings.Join(reverseSlice(labels), ".")
+}
+
+// etcdNotifyKey returns the key claimed by the instance sending NOTIFY for the
+// serial of zone, which is kept outside the DNS tree
+func etcdNotifyKey(zone string, serial uint32) string {
+	return "/dnsnotify/" + cleanFQDN(zone) + "/" + strconv.FormatUint(uint64(serial), 10)
+}
+
+// etcdTransferKey returns the key claimed by the instance transferring the
+// serial of zone from its primary, which is kept outside the DNS tree
+func etcdTransferKey(zone string, serial uint32) string {
+	return "/dnssecondary/" + cleanFQDN(zone) + "/" + strconv.FormatUint(uint64(serial), 10)
 }
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+func (db EtcdV3DB) InitDNS() {}
+
+func (db EtcdV3DB) GetDNS(name string, rrType string) (*DNSEntry, error) {
+	prefix := etcdDNSKeyFromFQDN(name) + "/@" + strings.ToLower(rrType) + "/"
+
+	ctx, cancel := etcdV3Context()
+	response, err := db.client.Get(ctx, prefix, clientv3.WithPrefix()) // results are sorted by key
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &DNSEntry{}
+	values := make(map[string]*DNSValue)
+	var hashes []string
+	owners := make(map[string]string)
+	expirations, err := db.leaseExpirations(response.Kvs, func(key string) bool {
+		return strings.HasPrefix(key, prefix+"exp/")
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range response.Kvs {
+		if _, ok := expirations[kv.Lease]; kv.Lease != 0 && !ok {
+			continue // expired
+		}
+		if uint64(kv.ModRevision) > entry.Modified {
+			entry.Modified = uint64(kv.ModRevision)
+		}
+		parts := strings.Split(strings.TrimPrefix(string(kv.Key), prefix), "/")
+		switch {
+		case len(parts) == 1 && parts[0] == "ttl":
+			ttl, _ := strconv.Atoi(string(kv.Value))
+			if ttl > 0 {
+				entry.TTL = uint32(ttl)
+			}
+		case len(parts) == 1:
+			if entry.Meta == nil {
+				entry.Meta = make(map[string]string)
+			}
+			entry.Meta[parts[0]] = string(kv.Value) // NOTE: the keys are case-sensitive
+		case len(parts) == 2 && parts[0] == "own":
+			owners[parts[1]] = string(kv.Value)
+		case len(parts) == 2 && parts[0] == "exp":
+			// Already read by leaseExpirations
+		case parts[0] == "val" && (len(parts) == 2 || len(parts) == 3):
+			hash := parts[1]
+			value, ok := values[hash]
+			if !ok {
+				value = &DNSValue{}
+				values[hash] = value
+				hashes = append(hashes, hash)
+			}
+			if kv.Lease != 0 {
+				expiration := expirations[kv.Lease]
+				value.Expiration = &expiration
+				value.TTL = uint32(time.Until(expiration) / time.Second)
+			}
+			if len(parts) == 2 || parts[2] == "value" {
+				value.Value = string(kv.Value)
+				continue
+			}
+			if value.Attr == nil {
+				value.Attr = make(map[string]string)
+			}
+			value.Attr[parts[2]] = string(kv.Value)
+		}
+	}
+
+	for _, hash := range hashes {
+		value := values[hash]
+		value.Owner = owners[hash]
+		entry.Values = append(entry.Values, *value)
+	}
+
+	if len(entry.Values) == 0 && len(entry.Meta) == 0 {
+		return nil, ErrNotFound
+	}
+	return entry, nil
+}
+
+func (db EtcdV3DB) HasDNS(name string, rrType string) (bool, error) {
+	prefix := etcdDNSKeyFromFQDN(name) + "/@" + strings.ToLower(rrType) + "/"
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+	return response.Count > 0, nil
+}
+
+// NameExists reports whether anything is held for name or the names below it,
+// by looking for a single key under it
+func (db EtcdV3DB) NameExists(name string) (bool, error) {
+	prefix := strings.TrimSuffix(etcdDNSKeyFromFQDN(name), "/") + "/"
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly(), clientv3.WithLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return len(response.Kvs) > 0, nil
+}
+
+// Register writes a single value for the given name and record type. The
+// value, its attributes, its ownership and the TTL are written in a single
+// transaction and share one etcd lease, so they expire together.
+func (db EtcdV3DB) Register(fqdn string, rrType string, value string, attrs map[string]string, ttl uint32, expiration uint64) error {
+	if err := validateDNSValue(rrType, value, attrs); err != nil {
+		return err
+	}
+	fqdn = cleanFQDN(fqdn)
+	rrType = strings.ToLower(rrType)
+	valueHash := fmt.Sprintf("%x", sha1.Sum([]byte(value))) // hash the value so we can have a unique key name (no other reason for this, honestly)
+
+	key := etcdDNSKeyFromFQDN(fqdn) + "/@" + rrType
+	valKey := key + "/val/" + valueHash
+	dnsLog.Info("register", "qname", cleanFQDN(fqdn), "qtype", strings.ToUpper(rrType), "value", value, "ttl", ttl, "expiration", expiration, "key", key)
+
+	previous, err := db.GetDNS(fqdn, rrType)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	leaseID, err := db.grant(expiration)
+	if err != nil {
+		return err
+	}
+	opts := leaseOptions(leaseID)
+
+	var ops []clientv3.Op
+	if len(attrs) == 0 {
+		ops = append(ops,
+			clientv3.OpDelete(valKey+"/", clientv3.WithPrefix()),
+			clientv3.OpPut(valKey, value, opts...))
+	} else {
+		// NOTE: etcd rejects a transaction that deletes a range it also writes
+		//       to, so attributes left over from an earlier registration of
+		//       this value are only replaced, not removed
+		ops = append(ops,
+			clientv3.OpDelete(valKey),
+			clientv3.OpPut(valKey+"/value", value, opts...))
+		for attr, attrValue := range attrs {
+			ops = append(ops, clientv3.OpPut(valKey+"/"+attr, attrValue, opts...))
+		}
+	}
+	if db.owner != "" {
+		ops = append(ops, clientv3.OpPut(key+"/own/"+valueHash, db.owner, opts...))
+	}
+	if leaseID != clientv3.NoLease {
+		ops = append(ops, clientv3.OpPut(key+"/exp/"+valueHash, leaseExpires(expiration), opts...))
+	} else {
+		ops = append(ops, clientv3.OpDelete(key+"/exp/"+valueHash))
+	}
+	if ttl != 0 {
+		ops = append(ops, clientv3.OpPut(key+"/ttl", fmt.Sprintf("%d", ttl), opts...))
+	}
+
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	_, err = db.client.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		db.revoke(leaseID)
+		return err
+	}
+	if !registerChanges(previous, value, attrs, ttl) {
+		return nil // only renewed
+	}
+	return db.bumpSerial(fqdn, 0)
+}
+
+// Unregister removes a single value for the given name and record type, or the
+// whole record set if value is empty
+func (db EtcdV3DB) Unregister(fqdn string, rrType string, value string) error {
+	key := etcdDNSKeyFromFQDN(fqdn) + "/@" + strings.ToLower(rrType)
+	dnsLog.Info("unregister", "qname", cleanFQDN(fqdn), "qtype", strings.ToUpper(rrType), "value", value, "key", key)
+	prefix := key + "/"
+	var ops []clientv3.Op
+	if value != "" {
+		valueHash := fmt.Sprintf("%x", sha1.Sum([]byte(value)))
+		prefix = key + "/val/" + valueHash
+		ops = append(ops, clientv3.OpDelete(key+"/own/"+valueHash), clientv3.OpDelete(key+"/exp/"+valueHash))
+	}
+	ops = append(ops, clientv3.OpDelete(prefix, clientv3.WithPrefix()))
+
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return err
+	}
+	if response.Count == 0 {
+		return ErrNotFound
+	}
+	if _, err = db.client.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return err
+	}
+	return db.bumpSerial(fqdn, 0)
+}
+
+// SetDNSMeta writes each of meta alongside the values for the given name and
+// record type in a single transaction, leaving any other Meta as it is
+func (db EtcdV3DB) SetDNSMeta(fqdn string, rrType string, meta map[string]string) error {
+	key := etcdDNSKeyFromFQDN(fqdn) + "/@" + strings.ToLower(rrType)
+	var ops []clientv3.Op
+	for name, value := range meta {
+		ops = append(ops, clientv3.OpPut(key+"/"+name, value))
+	}
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	if _, err := db.client.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return err
+	}
+	if _, ok := meta["serial"]; ok {
+		return nil // copied from a primary
+	}
+	return db.bumpSerial(fqdn, 0)
+}
+
+// bumpSerial raises the serial of the zone holding name in a transaction that
+// only succeeds if nobody else has raised it first, unless the zone is a copy
+// of a primary's or, when rev isn't zero, its serial has been raised since that
+// revision already
+func (db EtcdV3DB) bumpSerial(name string, rev int64) error {
+	for _, zone := range dnsEnclosingNames(name) {
+		prefix := etcdDNSKeyFromFQDN(zone) + "/@soa/"
+		key := prefix + "serial"
+		for {
+			ctx, cancel := etcdV3Context()
+			response, err := db.client.Get(ctx, prefix, clientv3.WithPrefix())
+			cancel()
+			if err != nil {
+				return err
+			}
+			var serial *mvccpb.KeyValue
+			held := false
+			for _, kv := range response.Kvs {
+				switch strings.TrimPrefix(string(kv.Key), prefix) {
+				case "serial":
+					serial = kv
+				case "primary":
+					if len(kv.Value) > 0 {
+						return nil
+					}
+					held = true
+				default:
+					held = true
+				}
+			}
+			if !held {
+				break // no zone here, or only the serial of a removed one
+			}
+			next := uint32(response.Header.Revision) + 1 // where a zone that has never been written starts
+			var modRevision int64
+			if serial != nil {
+				if rev != 0 && serial.ModRevision > rev {
+					return nil
+				}
+				n, _ := strconv.ParseUint(string(serial.Value), 10, 32)
+				next, modRevision = uint32(n)+1, serial.ModRevision
+			}
+			ctx, cancel = etcdV3Context()
+			txn, err := db.client.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).Then(
+				clientv3.OpPut(key, strconv.FormatUint(uint64(next), 10)),
+			).Commit()
+			cancel()
+			if err != nil {
+				return err
+			}
+			if txn.Succeeded {
+				return nil
+			}
+			// Raised by another instance in the meantime
+		}
+	}
+	return nil
+}
+
+// KeepSerials raises the serial of a zone whenever keys in it are deleted, as
+// they are when their lease runs out. Every instance does, but only the first
+// to see each deletion gets to, and none do after Unregister has.
+func (db EtcdV3DB) KeepSerials(stop <-chan struct{}) {
+	var rev int64
+	ctx, cancel := etcdV3Context()
+	response, err := db.client.Get(ctx, "/dns/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	cancel()
+	if err == nil {
+		rev = response.Header.Revision
+	}
+
+	db.watchPrefix("/dns/", rev, stop, func(event *clientv3.Event) {
+		var err error
+		switch {
+		case event == nil: // anything may have expired
+			var zones []string
+			if zones, err = dnsZones(db); err == nil {
+				for _, zone := range zones {
+					if err = db.bumpSerial(zone, 0); err != nil {
+						break
+					}
+				}
+			}
+		case event.Type == mvccpb.DELETE:
+			err = db.bumpSerial(etcdDNSNameFromKey(string(event.Kv.Key)), event.Kv.ModRevision)
+		}
+		if err != nil {
+			dnsLog.Warn("raising serial failed", "err", err)
+		}
+	})
+}
+
+func (db EtcdV3DB) WatchDNS(stop <-chan struct{}) <-chan string {
+	changed := make(chan string)
+	notify := func(event *clientv3.Event) {
+		name := "" // a nil event means that anything may have changed
+		if event != nil {
+			name = etcdDNSNameFromKey(string(event.Kv.Key))
+		}
+		select {
+		case changed <- name:
+		case <-stop:
+		}
+	}
+
+	var rev int64
+	ctx, cancel := etcdV3Context()
+	response, err := db.client.Get(ctx, "/dns/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	cancel()
+	if err == nil {
+		rev = response.Header.Revision
+	}
+
+	go func() {
+		defer close(changed)
+		if err != nil {
+			notify(nil) // we don't know where we are, so assume it all changed
+		}
+		db.watchPrefix("/dns/", rev, stop, notify)
+	}()
+	return changed
+}
+
+// ClaimNotify creates a key for the serial of zone, on a lease that expires
+// after dnsNotifyClaimTTL, unless it already exists
+func (db EtcdV3DB) ClaimNotify(zone string, serial uint32) (bool, error) {
+	key := etcdNotifyKey(zone, serial)
+	leaseID, err := db.grant(dnsNotifyClaimTTL)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Txn(ctx).If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).Then(
+		clientv3.OpPut(key, db.owner, leaseOptions(leaseID)...),
+	).Commit()
+	if err != nil || !response.Succeeded {
+		db.revoke(leaseID) // nothing is attached to it
+	}
+	if err != nil {
+		return false, err
+	}
+	return response.Succeeded, nil
+}
+
+// ClaimTransfer creates a key for the serial of zone, on a lease that expires
+// after dnsSecondaryClaimTTL, unless another instance already holds it
+func (db EtcdV3DB) ClaimTransfer(zone string, serial uint32) (bool, error) {
+	key := etcdTransferKey(zone, serial)
+	leaseID, err := db.grant(dnsSecondaryClaimTTL)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Txn(ctx).If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).Then(
+		clientv3.OpPut(key, db.owner, leaseOptions(leaseID)...),
+	).Commit()
+	if err != nil || !response.Succeeded {
+		db.revoke(leaseID) // nothing is attached to it
+	}
+	if err != nil {
+		return false, err
+	}
+	if response.Succeeded {
+		return true, nil
+	}
+	held, err := db.client.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return len(held.Kvs) == 1 && string(held.Kvs[0].Value) == db.owner, nil
+}
+
+// ListDNS returns every record set for name and the names below it, or every
+// record set of all if name is empty
+func (db EtcdV3DB) ListDNS(name string) ([]DNSRecord, error) {
+	prefix := strings.TrimSuffix(etcdDNSKeyFromFQDN(name), "/") + "/"
+	ctx, cancel := etcdV3Context()
+	response, err := db.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	// Find each distinct record set and then look it up in full
+	seen := make(map[string]bool)
+	var records []DNSRecord
+	for _, kv := range response.Kvs {
+		parts := strings.Split(strings.TrimPrefix(string(kv.Key), "/dns/"), "/")
+		for i, part := range parts {
+			if !strings.HasPrefix(part, "@") {
+				continue
+			}
+			record := DNSRecord{Name: strings.Join(reverseSlice(parts[:i]), "."), Type: strings.ToUpper(part[1:])}
+			if !seen[record.Name+"/"+record.Type] {
+				seen[record.Name+"/"+record.Type] = true
+				records = append(records, record)
+			}
+			break
+		}
+	}
+	listed := records[:0]
+	for _, record := range records {
+		entry, err := db.GetDNS(record.Name, record.Type)
+		if err == ErrNotFound {
+			continue // expired since we looked
+		}
+		if err != nil {
+			return nil, err
+		}
+		record.Entry = entry
+		listed = append(listed, record)
+	}
+	sort.Sort(dnsRecordsByName(listed))
+	return listed, nil
+}
+
+func (db EtcdV3DB) RegisterA(fqdn string, ip net.IP, exclusive bool, ttl uint32, expiration uint64) error {
+	return registerAddress(db, "A", fqdn, ip, exclusive, ttl, expiration)
+}
+
+func (db EtcdV3DB) RegisterAAAA(fqdn string, ip net.IP, exclusive bool, ttl uint32, expiration uint64) error {
+	return registerAddress(db, "AAAA", fqdn, ip, exclusive, ttl, expiration)
+}
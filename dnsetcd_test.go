@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRegisterAWritesPTRTTL(t *testing.T) {
+	db, fake := newFakeEtcdDB()
+	if err := db.RegisterA("host.example.com", net.ParseIP("10.1.2.3"), false, 300, 3600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"/dns/com/example/host/@a/ttl", "/dns/arpa/in-addr/10/1/2/3/@ptr/ttl"} {
+		response, err := fake.Get(key, false, false)
+		if err != nil {
+			t.Fatalf("%s: %s", key, err)
+		}
+		if response.Node.Value != "300" {
+			t.Errorf("%s: expected TTL 300, got %q", key, response.Node.Value)
+		}
+	}
+
+	entry, err := db.GetDNS("3.2.1.10.in-addr.arpa.", "PTR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.TTL != 300 {
+		t.Errorf("expected PTR TTL 300, got %d", entry.TTL)
+	}
+}
+
+func TestRegisterAAAAWritesNibblePTR(t *testing.T) {
+	db, _ := newFakeEtcdDB()
+	if err := db.RegisterAAAA("host.example.com.", net.ParseIP("2001:db8::1"), false, 60, 3600); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := db.GetDNS("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", "PTR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entry.Values) != 1 || entry.Values[0].Value != "host.example.com" {
+		t.Fatalf("unexpected PTR values: %+v", entry.Values)
+	}
+
+	if err := db.RegisterAAAA("host.example.com", net.ParseIP("10.1.2.3"), false, 60, 3600); err == nil {
+		t.Error("expected an IPv4 address to be rejected for AAAA")
+	}
+}
+
+func TestRegisterStoresMetadataUniformly(t *testing.T) {
+	db, _ := newFakeEtcdDB()
+	records := []struct {
+		name   string
+		rrType string
+		value  string
+		attrs  map[string]string
+	}{
+		{"host.example.com", "A", "10.1.2.3", nil},
+		{"host.example.com", "AAAA", "2001:db8::1", nil},
+		{"3.2.1.10.in-addr.arpa", "PTR", "host.example.com", nil},
+		{"www.example.com", "CNAME", "host.example.com", nil},
+		{"example.com", "TXT", "v=spf1 -all", nil},
+		{"example.com", "MX", "mail.example.com", map[string]string{"priority": "10"}},
+		{"_sip._udp.example.com", "SRV", "pbx.example.com", map[string]string{"port": "5060"}},
+	}
+
+	var modified uint64
+	for _, r := range records {
+		if err := db.Register(r.name, r.rrType, r.value, r.attrs, 120, 600); err != nil {
+			t.Fatalf("%s %s: %s", r.name, r.rrType, err)
+		}
+		entry, err := db.GetDNS(r.name, r.rrType)
+		if err != nil {
+			t.Fatalf("%s %s: %s", r.name, r.rrType, err)
+		}
+		if entry.TTL != 120 {
+			t.Errorf("%s %s: expected TTL 120, got %d", r.name, r.rrType, entry.TTL)
+		}
+		if entry.Modified <= modified {
+			t.Errorf("%s %s: expected a modification index above %d, got %d", r.name, r.rrType, modified, entry.Modified)
+		}
+		modified = entry.Modified
+		if len(entry.Values) != 1 {
+			t.Fatalf("%s %s: expected 1 value, got %d", r.name, r.rrType, len(entry.Values))
+		}
+		value := entry.Values[0]
+		if value.Value != r.value {
+			t.Errorf("%s %s: expected value %q, got %q", r.name, r.rrType, r.value, value.Value)
+		}
+		if value.Expiration == nil {
+			t.Errorf("%s %s: expected an expiration", r.name, r.rrType)
+		}
+		if value.Owner != "test-owner" {
+			t.Errorf("%s %s: expected owner %q, got %q", r.name, r.rrType, "test-owner", value.Owner)
+		}
+		for k, v := range r.attrs {
+			if value.Attr[k] != v {
+				t.Errorf("%s %s: expected attribute %s=%q, got %q", r.name, r.rrType, k, v, value.Attr[k])
+			}
+		}
+	}
+}
+
+func TestRegisterRejectsInvalidValues(t *testing.T) {
+	db, _ := newFakeEtcdDB()
+	if err := db.Register("host.example.com", "A", "not-an-ip", nil, 0, 0); err == nil {
+		t.Error("expected an invalid A value to be rejected")
+	}
+	if err := db.Register("example.com", "MX", "mail.example.com", map[string]string{"priority": "high"}, 0, 0); err == nil {
+		t.Error("expected an invalid MX priority to be rejected")
+	}
+	if err := db.Register("example.com", "BOGUS", "value", nil, 0, 0); err != ErrUnsupportedRRType {
+		t.Errorf("expected ErrUnsupportedRRType, got %v", err)
+	}
+}
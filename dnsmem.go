@@ -0,0 +1,409 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type memRRSet struct {
+	ttl           uint32
+	ttlExpiration *time.Time
+	meta          map[string]string
+	values        map[string]*memDNSValue // keyed by a hash of the value
+	modified      uint64                  // the value of dnsIndex when the set was last written
+}
+
+// memDNSWatcher is a caller of WatchDNS along with the changes still to be sent
+// to it, which are guarded by the lock
+type memDNSWatcher struct {
+	changes chan string
+	pending []string
+	wake    chan struct{}
+}
+
+// memDNSWatchBacklog is how many changes can wait for a watcher before it is
+// told that everything may have changed instead
+const memDNSWatchBacklog = 64
+
+type memDNSValue struct {
+	value      string
+	attr       map[string]string
+	owner      string
+	expiration *time.Time
+}
+
+func (db *MemDB) InitDNS() {}
+
+func (db *MemDB) GetDNS(name string, rrType string) (*DNSEntry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireDNS()
+	return db.getDNS(name, rrType)
+}
+
+// getDNS reads the entry for the given name and type. The caller must hold the
+// lock.
+func (db *MemDB) getDNS(name string, rrType string) (*DNSEntry, error) {
+	rrset := db.rrset(name, rrType)
+	if rrset == nil {
+		return nil, ErrNotFound
+	}
+
+	entry := &DNSEntry{TTL: rrset.ttl, Modified: rrset.modified}
+	if len(rrset.meta) > 0 {
+		entry.Meta = make(map[string]string, len(rrset.meta))
+		for k, v := range rrset.meta {
+			entry.Meta[k] = v
+		}
+	}
+
+	hashes := make([]string, 0, len(rrset.values))
+	for hash := range rrset.values {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes) // match the ordering of a sorted etcd lookup
+	for _, hash := range hashes {
+		v := rrset.values[hash]
+		value := DNSValue{
+			Value: v.value,
+			Owner: v.owner,
+		}
+		if v.expiration != nil {
+			expiration := *v.expiration
+			value.Expiration = &expiration
+			value.TTL = uint32(db.memRemaining(v.expiration))
+		}
+		if len(v.attr) > 0 {
+			value.Attr = make(map[string]string, len(v.attr))
+			for k, a := range v.attr {
+				value.Attr[k] = a
+			}
+		}
+		entry.Values = append(entry.Values, value)
+	}
+
+	return entry, nil
+}
+
+func (db *MemDB) HasDNS(name string, rrType string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.rrset(name, rrType) != nil, nil
+}
+
+// NameExists reports whether anything is held for name or the names below it
+func (db *MemDB) NameExists(name string) (bool, error) {
+	name = cleanFQDN(name)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for key := range db.dns {
+		recordName := key[:strings.LastIndex(key, "/@")]
+		if name != "" && recordName != name && !strings.HasSuffix(recordName, "."+name) {
+			continue
+		}
+		if db.rrset(recordName, key[strings.LastIndex(key, "/@")+2:]) != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (db *MemDB) Register(fqdn string, rrType string, value string, attrs map[string]string, ttl uint32, expiration uint64) error {
+	if err := validateDNSValue(rrType, value, attrs); err != nil {
+		return err
+	}
+	fqdn = cleanFQDN(fqdn)
+	dnsLog.Info("register", "qname", cleanFQDN(fqdn), "qtype", strings.ToUpper(rrType), "value", value, "ttl", ttl, "expiration", expiration)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	previous, _ := db.getDNS(fqdn, rrType) // nil if nothing is held yet
+	key := memDNSKey(fqdn, rrType)
+	rrset, ok := db.dns[key]
+	if !ok {
+		rrset = &memRRSet{values: make(map[string]*memDNSValue)}
+		db.dns[key] = rrset
+	}
+
+	v := &memDNSValue{
+		value:      value,
+		owner:      db.owner,
+		expiration: db.memExpiration(expiration),
+	}
+	if len(attrs) > 0 {
+		v.attr = make(map[string]string, len(attrs))
+		for k, a := range attrs {
+			v.attr[k] = a
+		}
+	}
+	rrset.values[fmt.Sprintf("%x", sha1.Sum([]byte(value)))] = v
+	db.dnsIndex++
+	rrset.modified = db.dnsIndex
+	db.dnsChanged(fqdn)
+	if registerChanges(previous, value, attrs, ttl) {
+		db.bumpSerial(fqdn)
+	}
+
+	if ttl != 0 {
+		rrset.ttl = ttl
+		rrset.ttlExpiration = db.memExpiration(expiration)
+	}
+
+	return nil
+}
+
+func (db *MemDB) RegisterA(fqdn string, ip net.IP, exclusive bool, ttl uint32, expiration uint64) error {
+	return registerAddress(db, "A", fqdn, ip, exclusive, ttl, expiration)
+}
+
+func (db *MemDB) RegisterAAAA(fqdn string, ip net.IP, exclusive bool, ttl uint32, expiration uint64) error {
+	return registerAddress(db, "AAAA", fqdn, ip, exclusive, ttl, expiration)
+}
+
+// Unregister removes a single value for the given name and record type, or the
+// whole record set if value is empty
+func (db *MemDB) Unregister(fqdn string, rrType string, value string) error {
+	dnsLog.Info("unregister", "qname", cleanFQDN(fqdn), "qtype", strings.ToUpper(rrType), "value", value)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rrset := db.rrset(fqdn, rrType)
+	if rrset == nil {
+		return ErrNotFound
+	}
+	if value == "" {
+		delete(db.dns, memDNSKey(fqdn, rrType))
+	} else {
+		hash := fmt.Sprintf("%x", sha1.Sum([]byte(value)))
+		if _, ok := rrset.values[hash]; !ok {
+			return ErrNotFound
+		}
+		delete(rrset.values, hash)
+	}
+	db.dnsChanged(fqdn)
+	db.bumpSerial(fqdn)
+	return nil
+}
+
+// SetDNSMeta writes each of meta for the given name and record type, leaving
+// any other Meta as it is
+func (db *MemDB) SetDNSMeta(fqdn string, rrType string, meta map[string]string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := memDNSKey(fqdn, rrType)
+	rrset, ok := db.dns[key]
+	if !ok {
+		rrset = &memRRSet{values: make(map[string]*memDNSValue)}
+		db.dns[key] = rrset
+	}
+	if rrset.meta == nil {
+		rrset.meta = make(map[string]string, len(meta))
+	}
+	for name, value := range meta {
+		rrset.meta[name] = value
+	}
+	db.dnsIndex++
+	rrset.modified = db.dnsIndex
+	db.dnsChanged(fqdn)
+	if _, ok := meta["serial"]; !ok {
+		db.bumpSerial(fqdn)
+	}
+	return nil
+}
+
+// bumpSerial raises the serial of the zone holding name, unless the zone is a
+// copy of a primary's. The caller must hold the lock.
+func (db *MemDB) bumpSerial(name string) {
+	for _, zone := range dnsEnclosingNames(name) {
+		soa, ok := db.dns[memDNSKey(zone, "SOA")]
+		if !ok || len(soa.values) == 0 && len(soa.meta) == 0 {
+			continue
+		}
+		if soa.meta == nil {
+			soa.meta = make(map[string]string)
+		}
+		if soa.meta["primary"] != "" {
+			return
+		}
+		serial := uint32(db.dnsIndex) // where a zone that has never been written starts
+		if n, err := strconv.ParseUint(soa.meta["serial"], 10, 32); err == nil {
+			serial = uint32(n)
+		}
+		soa.meta["serial"] = strconv.FormatUint(uint64(serial+1), 10)
+		db.dnsIndex++
+		soa.modified = db.dnsIndex
+		return
+	}
+}
+
+func (db *MemDB) WatchDNS(stop <-chan struct{}) <-chan string {
+	w := &memDNSWatcher{changes: make(chan string), wake: make(chan struct{}, 1)}
+	db.mu.Lock()
+	db.dnsWatchers = append(db.dnsWatchers, w)
+	db.mu.Unlock()
+
+	go func() {
+		defer func() {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			for i, watcher := range db.dnsWatchers {
+				if watcher == w {
+					db.dnsWatchers = append(db.dnsWatchers[:i], db.dnsWatchers[i+1:]...)
+					break
+				}
+			}
+			close(w.changes)
+		}()
+		for {
+			select {
+			case <-w.wake:
+			case <-stop:
+				return
+			}
+			for {
+				db.mu.Lock()
+				if len(w.pending) == 0 {
+					db.mu.Unlock()
+					break
+				}
+				name := w.pending[0]
+				w.pending = w.pending[1:]
+				db.mu.Unlock()
+				select {
+				case w.changes <- name:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+
+	return w.changes
+}
+
+// dnsChanged queues name for the watchers. A watcher that has fallen too far
+// behind is sent "" instead, to say that anything may have changed. The caller
+// must hold the lock.
+func (db *MemDB) dnsChanged(name string) {
+	for _, w := range db.dnsWatchers {
+		switch {
+		case len(w.pending) == 1 && w.pending[0] == "":
+			// Already told to consider everything changed
+		case len(w.pending) >= memDNSWatchBacklog:
+			w.pending = []string{""}
+		default:
+			w.pending = append(w.pending, cleanFQDN(name))
+		}
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ClaimNotify only matters when instances share a database, but the claims
+// are kept all the same so that each serial is only sent once
+func (db *MemDB) ClaimNotify(zone string, serial uint32) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := cleanFQDN(zone) + "/" + fmt.Sprint(serial)
+	if expiration, ok := db.notifyClaims[key]; ok && !db.memExpired(expiration) {
+		return false, nil
+	}
+	for k, expiration := range db.notifyClaims {
+		if db.memExpired(expiration) {
+			delete(db.notifyClaims, k)
+		}
+	}
+	db.notifyClaims[key] = db.memExpiration(dnsNotifyClaimTTL)
+	return true, nil
+}
+
+// ListDNS returns every record set for name and the names below it, or every
+// record set of all if name is empty
+func (db *MemDB) ListDNS(name string) ([]DNSRecord, error) {
+	name = cleanFQDN(name)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireDNS()
+	var keys []string
+	for key := range db.dns {
+		recordName := key[:strings.LastIndex(key, "/@")]
+		if name == "" || recordName == name || strings.HasSuffix(recordName, "."+name) {
+			keys = append(keys, key)
+		}
+	}
+
+	var records []DNSRecord
+	for _, key := range keys {
+		i := strings.LastIndex(key, "/@")
+		record := DNSRecord{Name: key[:i], Type: strings.ToUpper(key[i+2:])}
+		entry, err := db.getDNS(record.Name, record.Type)
+		if err == ErrNotFound {
+			continue // expired
+		}
+		if err != nil {
+			return nil, err
+		}
+		record.Entry = entry
+		records = append(records, record)
+	}
+	sort.Sort(dnsRecordsByName(records))
+	return records, nil
+}
+
+// rrset returns the record set for the given name and type after discarding
+// anything that has expired, or nil if nothing is left. The caller must hold
+// the lock.
+func (db *MemDB) rrset(name string, rrType string) *memRRSet {
+	key := memDNSKey(name, rrType)
+	rrset, ok := db.dns[key]
+	if !ok {
+		return nil
+	}
+	db.discardExpired(name, rrset)
+	if db.memExpired(rrset.ttlExpiration) {
+		rrset.ttl, rrset.ttlExpiration = 0, nil
+	}
+	if len(rrset.values) == 0 && len(rrset.meta) == 0 {
+		if rrset.ttl == 0 {
+			delete(db.dns, key)
+		}
+		return nil
+	}
+	return rrset
+}
+
+// expireDNS discards every value that has expired. The caller must hold the
+// lock.
+func (db *MemDB) expireDNS() {
+	for key, rrset := range db.dns {
+		db.discardExpired(key[:strings.LastIndex(key, "/@")], rrset)
+	}
+}
+
+// discardExpired removes the values of rrset, which is held for name, that
+// have expired, raising the serial of its zone if there were any, as etcd
+// would. The caller must hold the lock.
+func (db *MemDB) discardExpired(name string, rrset *memRRSet) {
+	expired := false
+	for hash, v := range rrset.values {
+		if db.memExpired(v.expiration) {
+			delete(rrset.values, hash)
+			expired = true
+		}
+	}
+	if expired {
+		db.dnsChanged(name)
+		db.bumpSerial(name)
+	}
+}
+
+func memDNSKey(name string, rrType string) string {
+	return cleanFQDN(name) + "/@" + strings.ToLower(rrType)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsNotifyDelay    = 5 * time.Second // how long a zone has to go without changes before its secondaries are told
+	dnsNotifyMaxDelay = time.Minute     // how long a zone that keeps changing goes before they're told anyway
+	dnsNotifyRetry    = 5 * time.Second // how long to wait before telling a secondary again, doubling each time
+	dnsNotifyRetries  = 5               // how many more times a secondary is told when it doesn't answer
+	dnsNotifyTimeout  = 2 * time.Second // how long a secondary has to answer
+	dnsNotifyClaimTTL = 3600            // how many seconds a claim to send NOTIFY for a serial is kept for
+)
+
+// dnsNotifier tells the secondaries of our zones when records in them change
+// (RFC 1996), once the changes stop coming for a little while. Only the
+// instance that claims each new serial sends NOTIFY for it.
+type dnsNotifier struct {
+	cfg     *Config
+	watcher DNSWatcher
+	delay   time.Duration
+	retry   time.Duration
+	lock    sync.Mutex
+	stop    chan struct{}
+}
+
+func notifySetup(cfg *Config, watcher DNSWatcher) service {
+	n := &dnsNotifier{cfg: cfg, watcher: watcher, delay: dnsNotifyDelay, retry: dnsNotifyRetry}
+	return service{name: "notify", run: n.run, stop: n.shutdown}
+}
+
+func (n *dnsNotifier) run(ready func()) error {
+	stop := make(chan struct{})
+	n.lock.Lock()
+	n.stop = stop
+	n.lock.Unlock()
+
+	changes := n.watcher.WatchDNS(stop)
+	ready()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	first := make(map[string]time.Time) // when the changes still to be sent began
+	timers := make(map[string]*time.Timer)
+	due := make(chan string)
+	for {
+		select {
+		case name, ok := <-changes:
+			if !ok {
+				return nil
+			}
+			for _, zone := range n.zones(name) {
+				if timer, ok := timers[zone]; ok {
+					if time.Since(first[zone]) < dnsNotifyMaxDelay {
+						timer.Reset(n.delay)
+					}
+					continue
+				}
+				first[zone] = time.Now()
+				timers[zone] = time.AfterFunc(n.delay, func() {
+					select {
+					case due <- zone:
+					case <-stop:
+					}
+				})
+			}
+		case zone := <-due:
+			delete(first, zone)
+			delete(timers, zone)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				n.notify(zone, stop)
+			}()
+		case <-stop:
+			for _, timer := range timers {
+				timer.Stop()
+			}
+			return nil
+		}
+	}
+}
+
+func (n *dnsNotifier) shutdown() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.stop != nil {
+		close(n.stop)
+		n.stop = nil
+	}
+}
+
+// zones returns the zone holding name, or every zone if name is empty
+func (n *dnsNotifier) zones(name string) []string {
+	if name != "" {
+		if zone, entry := findZone(n.cfg, name); entry != nil {
+			return []string{zone}
+		}
+		return nil
+	}
+	zones, err := dnsZones(n.cfg.db)
+	if err != nil {
+		dnsLog.Error("lookup failed", "qtype", "SOA", "err", err)
+		return nil
+	}
+	for i, zone := range zones {
+		zones[i] = dns.Fqdn(zone)
+	}
+	return zones
+}
+
+// notify sends NOTIFY with the current SOA of zone to each of its secondaries
+// at once, unless another instance has already claimed its serial
+func (n *dnsNotifier) notify(zone string, stop <-chan struct{}) {
+	entry, err := n.cfg.db.GetDNS(zone, "SOA")
+	if err == ErrNotFound {
+		return // the zone went away
+	}
+	if err != nil {
+		dnsLog.Error("lookup failed", "qname", zone, "qtype", "SOA", "err", err)
+		return
+	}
+	serial, err := zoneSerial(n.cfg, zone)
+	if err != nil {
+		dnsLog.Error("lookup failed", "qname", zone, "qtype", "SOA", "err", err)
+		return
+	}
+	secondaries := notifyTargets(n.cfg, zone, entry)
+	if len(secondaries) == 0 {
+		return
+	}
+	if claimer, ok := n.cfg.db.(NotifyClaimer); ok {
+		claimed, err := claimer.ClaimNotify(zone, serial)
+		if err != nil {
+			dnsLog.Error("notify claim failed", "zone", zone, "serial", serial, "err", err)
+			return
+		}
+		if !claimed {
+			dnsLog.Debug("notify sent by another instance", "zone", zone, "serial", serial)
+			return
+		}
+	}
+
+	soa := answerSOA(&dns.Question{Name: zone, Qtype: dns.TypeSOA, Qclass: dns.ClassINET}, entry, serial)
+	soa.Header().Ttl = dnsDefaultTTL
+	if entry.TTL > 0 {
+		soa.Header().Ttl = entry.TTL
+	}
+	dnsLog.Info("notify", "zone", zone, "serial", serial, "secondaries", strings.Join(secondaries, " "))
+	var wg sync.WaitGroup
+	for _, secondary := range secondaries {
+		wg.Add(1)
+		go func(secondary string) {
+			defer wg.Done()
+			n.send(zone, soa, secondary, stop)
+		}(secondary)
+	}
+	wg.Wait()
+}
+
+// send tells secondary that zone has changed to soa, trying again with a
+// growing wait until it answers
+func (n *dnsNotifier) send(zone string, soa dns.RR, secondary string, stop <-chan struct{}) {
+	m := new(dns.Msg)
+	m.SetNotify(zone)
+	m.Answer = []dns.RR{soa}
+	c := &dns.Client{Timeout: dnsNotifyTimeout}
+	wait := n.retry
+	for attempt := 0; ; attempt++ {
+		r, _, err := c.Exchange(m, secondary)
+		if err == nil {
+			if r.Rcode != dns.RcodeSuccess {
+				// Asking again won't change its mind
+				dnsLog.Warn("notify refused", "zone", zone, "secondary", secondary, "rcode", dns.RcodeToString[r.Rcode])
+			} else {
+				dnsLog.Debug("notify acknowledged", "zone", zone, "secondary", secondary)
+			}
+			return
+		}
+		if attempt == dnsNotifyRetries {
+			dnsLog.Warn("notify failed", "zone", zone, "secondary", secondary, "err", err)
+			return
+		}
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+		wait *= 2
+	}
+}
+
+// notifyTargets returns the host:port of each secondary of zone: the name
+// servers in its NS records apart from the primary named in its SOA (RFC 1996
+// section 3.6), and anything listed in the "also-notify" Meta of its @soa
+// entry. When we're a secondary for zone ourselves, its name servers are left
+// to its primary.
+func notifyTargets(cfg *Config, zone string, entry *DNSEntry) []string {
+	var targets []string
+	if nsEntry, err := cfg.db.GetDNS(zone, "NS"); err == nil && entry.Meta["primary"] == "" {
+		nsRecords, _ := entryRecords(zone, dns.TypeNS, nsEntry, dnsDefaultTTL)
+		var ns []dns.RR
+		for _, rr := range nsRecords {
+			if dns.CanonicalName(rr.(*dns.NS).Ns) != dns.CanonicalName(entry.Meta["ns"]) {
+				ns = append(ns, rr)
+			}
+		}
+		targets = nameServerAddresses(ns, additionalRecords(cfg, ns, dnsDefaultTTL))
+	}
+	targets = append(targets, parseDNSForwarders(entry.Meta["also-notify"])...)
+
+	var unique []string
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		if !seen[target] {
+			seen[target] = true
+			unique = append(unique, target)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeSecondary acknowledges every NOTIFY, sending the serial of each to the
+// channel returned
+func fakeSecondary(t *testing.T) (*dns.Server, string, <-chan uint32) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notified := make(chan uint32, 16)
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Opcode == dns.OpcodeNotify && len(req.Answer) == 1 {
+			notified <- req.Answer[0].(*dns.SOA).Serial
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	return server, pc.LocalAddr().String(), notified
+}
+
+func TestNotify(t *testing.T) {
+	cfg, db := newTestDNS(t)
+	server, addr, notified := fakeSecondary(t)
+	defer server.Shutdown()
+	db.dns[memDNSKey("example.com", "SOA")].meta["also-notify"] = addr
+
+	// Two instances sharing the database, only one of which should send
+	var ready atomic.Int32
+	for i := 0; i < 2; i++ {
+		n := &dnsNotifier{cfg: cfg, watcher: db, delay: 50 * time.Millisecond, retry: 10 * time.Millisecond}
+		go n.run(func() { ready.Add(1) })
+		defer n.shutdown()
+	}
+	for ready.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A burst of changes is sent once
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		if err := db.Register(name, "A", "10.0.0.3", nil, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Register("www.example.org", "A", "10.0.1.1", nil, 0, 0); err != nil {
+		t.Fatal(err) // not ours
+	}
+	serial, err := zoneSerial(cfg, "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-notified:
+		if got != serial {
+			t.Errorf("expected NOTIFY for serial %d, got %d", serial, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected NOTIFY")
+	}
+	select {
+	case got := <-notified:
+		t.Errorf("expected a single NOTIFY, got another for %d", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWatchDNSOverflow(t *testing.T) {
+	db := NewMemDB()
+	stop := make(chan struct{})
+	defer close(stop)
+	changes := db.WatchDNS(stop)
+
+	// More changes than are kept for a watcher that isn't reading
+	for i := 0; i < memDNSWatchBacklog+10; i++ {
+		if err := db.Register(fmt.Sprintf("host%d.example.com", i), "A", "10.0.0.3", nil, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		select {
+		case name := <-changes:
+			if name == "" {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal(`expected "" once changes were dropped`)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// dnsAnswer is the response to a single question, apart from the header
+type dnsAnswer struct {
+	Rcode         int
+	Authoritative bool // the name is in a zone we have authority for
+	Answer        []dns.RR
+	Ns            []dns.RR
+	Extra         []dns.RR
+}
+
+// dnsServFailTTL is how long a failure to answer is cached for (RFC 2308
+// section 7 allows up to five minutes)
+const dnsServFailTTL = 5
+
+// dnsResultType is a private use RR type (RFC 6895) for the record that carries
+// the rcode, the AA flag and the authority and additional sections of an answer through
+// dnscache, which only keeps a list of records for each question. It never
+// leaves netcore.
+const dnsResultType = 0xFF4E
+
+var errDNSResultInternal = errors.New("netcore result records are never sent")
+
+func init() {
+	dns.PrivateHandle("NETCORERESULT", dnsResultType, func() dns.PrivateRdata { return new(dnsResult) })
+}
+
+// dnsResult is the data of a dnsResultType record
+type dnsResult struct {
+	rcode         int
+	authoritative bool
+	ns            []dns.RR
+	extra         []dns.RR
+}
+
+func (r *dnsResult) String() string             { return dns.RcodeToString[r.rcode] }
+func (r *dnsResult) Parse([]string) error       { return errDNSResultInternal }
+func (r *dnsResult) Pack([]byte) (int, error)   { return 0, errDNSResultInternal }
+func (r *dnsResult) Unpack([]byte) (int, error) { return 0, errDNSResultInternal }
+func (r *dnsResult) Len() int                   { return 0 }
+
+func (r *dnsResult) Copy(dest dns.PrivateRdata) error {
+	d, ok := dest.(*dnsResult)
+	if !ok {
+		return errDNSResultInternal
+	}
+	*d = *r
+	return nil
+}
+
+// records turns the answer into the list kept by dnscache: the answer records
+// followed by a result record. The result record's TTL is the shortest of the
+// records' so that the cache keeps a negative answer for as long as its SOA
+// allows, or missingTTL (in seconds) if there's nothing to go by.
+func (a *dnsAnswer) records(missingTTL uint32) []dns.RR {
+	ttl := uint32(0)
+	for _, rr := range append(append(a.Answer[:len(a.Answer):len(a.Answer)], a.Ns...), a.Extra...) {
+		if ttl == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	if a.Rcode == dns.RcodeServerFailure {
+		ttl = dnsServFailTTL
+	} else if ttl == 0 {
+		ttl = missingTTL
+	}
+
+	result := dns.TypeToRR[dnsResultType]().(*dns.PrivateRR)
+	result.Hdr = dns.RR_Header{Name: ".", Rrtype: dnsResultType, Class: dns.ClassINET, Ttl: ttl}
+	result.Data = &dnsResult{rcode: a.Rcode, authoritative: a.Authoritative, ns: a.Ns, extra: a.Extra}
+	return append(a.Answer[:len(a.Answer):len(a.Answer)], result)
+}
+
+// answerFromRecords reverses records. A list without a result record, which
+// means that no answer was found in time, is a server failure unless it holds
+// answers.
+func answerFromRecords(records []dns.RR) *dnsAnswer {
+	answer := &dnsAnswer{Rcode: dns.RcodeServerFailure}
+	found := false
+	for _, rr := range records {
+		if private, ok := rr.(*dns.PrivateRR); ok && private.Hdr.Rrtype == dnsResultType {
+			result := private.Data.(*dnsResult)
+			answer.Rcode, answer.Authoritative = result.rcode, result.authoritative
+			answer.Ns, answer.Extra = result.ns, result.extra
+			found = true
+			continue
+		}
+		answer.Answer = append(answer.Answer, rr)
+	}
+	if !found && len(answer.Answer) > 0 {
+		answer.Rcode = dns.RcodeSuccess
+	}
+	return answer
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsSecondaryCheck    = time.Second      // how often the zones are looked over for any due a refresh
+	dnsSecondaryTimeout  = 10 * time.Second // how long a primary has to answer
+	dnsSecondaryClaimTTL = 600              // how many seconds a claim to transfer a serial is kept for, before another instance may take over
+)
+
+var ErrNoPrimarySOA = errors.New("the primary did not answer with an SOA")
+
+// dnsSecondary keeps a copy of each zone in the dnssecondaries setting in the
+// database, asking its primary whether it has changed whenever the refresh
+// time in its SOA has passed, or straight away when the primary sends NOTIFY.
+// Every instance asks, but only the one that claims each new serial transfers
+// it, and the others find the copy up to date once it has. Each zone is
+// refreshed on its own, so that a primary that doesn't answer holds up only
+// its own zones.
+type dnsSecondary struct {
+	cfg      *Config
+	check    time.Duration
+	notified chan string
+	lock     sync.Mutex
+	stop     chan struct{}
+}
+
+func newDNSSecondary(cfg *Config) *dnsSecondary {
+	return &dnsSecondary{cfg: cfg, check: dnsSecondaryCheck, notified: make(chan string, 16)}
+}
+
+func secondarySetup(s *dnsSecondary) service {
+	return service{name: "secondary", run: s.run, stop: s.shutdown}
+}
+
+func (s *dnsSecondary) run(ready func()) error {
+	stop := make(chan struct{})
+	s.lock.Lock()
+	s.stop = stop
+	s.lock.Unlock()
+	ready()
+
+	type refreshed struct {
+		zone string
+		wait time.Duration
+	}
+	ticker := time.NewTicker(s.check)
+	defer ticker.Stop()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	due := make(map[string]time.Time)   // when each zone is next refreshed
+	refreshing := make(map[string]bool) // the zones being refreshed, and whether NOTIFY came meanwhile
+	done := make(chan refreshed)
+	for {
+		primaries := s.cfg.DNSSecondaries()
+		for zone := range due {
+			if _, ok := primaries[zone]; !ok {
+				delete(due, zone) // no longer a secondary, though the copy is kept
+			}
+		}
+		for zone, primary := range primaries {
+			if _, ok := refreshing[zone]; ok {
+				continue
+			}
+			if at, ok := due[zone]; !ok || !time.Now().Before(at) {
+				refreshing[zone] = false
+				wg.Add(1)
+				go func(zone string, primary string) {
+					defer wg.Done()
+					wait := s.refresh(zone, primary)
+					select {
+					case done <- refreshed{zone, wait}:
+					case <-stop:
+					}
+				}(zone, primary)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case r := <-done:
+			if refreshing[r.zone] {
+				delete(due, r.zone) // the primary has changed it again since
+			} else {
+				due[r.zone] = time.Now().Add(r.wait)
+			}
+			delete(refreshing, r.zone)
+		case zone := <-s.notified:
+			if _, ok := refreshing[zone]; ok {
+				refreshing[zone] = true
+			}
+			delete(due, zone)
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func (s *dnsSecondary) shutdown() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// notify has zone refreshed as soon as possible
+func (s *dnsSecondary) notify(zone string) {
+	select {
+	case s.notified <- zone:
+	default:
+		// Plenty are waiting already, and will be refreshed soon enough
+	}
+}
+
+// refresh brings the copy of zone up to date with primary if the serial there
+// has moved on, returning how long to wait before asking again
+func (s *dnsSecondary) refresh(zone string, primary string) time.Duration {
+	// FIXME: A zone whose primary can't be reached for longer than its expire
+	//        time should stop being answered (RFC 1034 section 4.3.5), but the
+	//        copy is kept and answered until the primary comes back
+	q := &dns.Question{Name: zone, Qtype: dns.TypeSOA, Qclass: dns.ClassINET}
+	entry, err := s.cfg.db.GetDNS(zone, "SOA")
+	if err != nil && err != ErrNotFound {
+		dnsLog.Error("lookup failed", "qname", zone, "qtype", "SOA", "err", err)
+		return secondaryWait(dnsDefaultRetry)
+	}
+	retry := dnsDefaultRetry
+	var serial *uint32 // the serial of the copy, if we have one
+	if entry != nil {
+		retry = soaField(q, entry, "retry", dnsDefaultRetry)
+		if n, err := strconv.ParseUint(entry.Meta["serial"], 10, 32); err == nil && entry.Meta["primary"] != "" {
+			held := uint32(n)
+			serial = &held
+		}
+	}
+
+	soa, err := primarySOA(zone, primary)
+	if err != nil {
+		dnsLog.Warn("secondary refresh failed", "zone", zone, "primary", primary, "err", err)
+		return secondaryWait(retry)
+	}
+	if serial != nil && !serialBefore(*serial, soa.Serial) {
+		dnsLog.Debug("secondary up to date", "zone", zone, "primary", primary, "serial", *serial)
+		return secondaryWait(soa.Refresh)
+	}
+	if claimer, ok := s.cfg.db.(TransferClaimer); ok {
+		claimed, err := claimer.ClaimTransfer(zone, soa.Serial)
+		if err != nil {
+			dnsLog.Error("secondary claim failed", "zone", zone, "serial", soa.Serial, "err", err)
+			return secondaryWait(retry)
+		}
+		if !claimed {
+			// Look again once the instance that claimed it has had a chance
+			dnsLog.Debug("secondary transfer claimed by another instance", "zone", zone, "serial", soa.Serial)
+			return secondaryWait(soa.Retry)
+		}
+	}
+	if err := s.transfer(zone, primary, entry, serial); err != nil {
+		dnsLog.Warn("secondary transfer failed", "zone", zone, "primary", primary, "err", err)
+		return secondaryWait(soa.Retry)
+	}
+	return secondaryWait(soa.Refresh)
+}
+
+// transfer copies zone from primary, asking for just the changes since serial
+// when there is one, and then records the SOA it was sent with
+func (s *dnsSecondary) transfer(zone string, primary string, entry *DNSEntry, serial *uint32) error {
+	req := new(dns.Msg)
+	if serial != nil {
+		req.SetIxfr(zone, *serial, dns.Fqdn(entry.Meta["ns"]), dns.Fqdn(entry.Meta["mbox"]))
+	} else {
+		req.SetAxfr(zone)
+	}
+	tr := &dns.Transfer{DialTimeout: dnsSecondaryTimeout, ReadTimeout: dnsSecondaryTimeout}
+	envelopes, err := tr.In(req, primary)
+	if err != nil {
+		return err
+	}
+	var records []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			err = envelope.Error
+		}
+		records = append(records, envelope.RR...)
+	}
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return ErrNoPrimarySOA
+	}
+	soa, ok := records[0].(*dns.SOA)
+	if !ok {
+		return ErrNoPrimarySOA
+	}
+
+	// An IXFR is answered with a lone SOA when nothing has changed, with the
+	// changes between pairs of SOAs, or otherwise like an AXFR (RFC 1995)
+	kind := "none"
+	if len(records) > 1 {
+		_, incremental := records[1].(*dns.SOA)
+		if incremental && req.Question[0].Qtype == dns.TypeIXFR && len(records) > 2 {
+			kind = "incremental"
+			err = s.applyChanges(records[1 : len(records)-1])
+		} else {
+			kind = "full"
+			err = s.replace(zone, records[1:len(records)-1])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	dnsLog.Info("secondary transfer", "zone", zone, "primary", primary, "serial", soa.Serial, "kind", kind, "records", len(records))
+
+	// The serial goes last, so that a transfer cut short is tried again
+	return s.cfg.db.SetDNSMeta(zone, "SOA", map[string]string{
+		"primary": primary,
+		"ns":      strings.TrimSuffix(soa.Ns, "."),
+		"mbox":    strings.TrimSuffix(soa.Mbox, "."),
+		"refresh": strconv.FormatUint(uint64(soa.Refresh), 10),
+		"retry":   strconv.FormatUint(uint64(soa.Retry), 10),
+		"expire":  strconv.FormatUint(uint64(soa.Expire), 10),
+		"minttl":  strconv.FormatUint(uint64(soa.Minttl), 10),
+		"serial":  strconv.FormatUint(uint64(soa.Serial), 10),
+	})
+}
+
+// applyChanges applies the difference sequences of an incremental transfer in
+// order, each one an old SOA, the records deleted, a new SOA and the records
+// added
+func (s *dnsSecondary) applyChanges(records []dns.RR) error {
+	adding := true
+	for _, rr := range records {
+		if _, ok := rr.(*dns.SOA); ok {
+			adding = !adding
+			continue
+		}
+		var err error
+		if adding {
+			err = s.register(rr)
+		} else {
+			err = s.unregister(rr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace makes the copy of zone hold exactly records, leaving alone anything
+// in zones below it that have their own SOA
+func (s *dnsSecondary) replace(zone string, records []dns.RR) error {
+	list, err := s.cfg.db.ListDNS(zone)
+	if err != nil {
+		return err
+	}
+	var subzones []string
+	for _, record := range list {
+		if record.Type == "SOA" && dns.Fqdn(record.Name) != zone {
+			subzones = append(subzones, dns.Fqdn(record.Name))
+		}
+	}
+	var held []dns.RR
+	for _, record := range list {
+		name := dns.Fqdn(record.Name)
+		rrType, ok := dns.StringToType[record.Type]
+		if !ok || rrType == dns.TypeSOA || inZones(name, subzones) {
+			continue
+		}
+		held = append(held, transferRecords(name, rrType, record.Entry)...)
+	}
+
+	// Compare the records as they would be answered from the copy
+	var wanted []dns.RR
+	for _, rr := range records {
+		if rr = storedRecord(rr); rr != nil && !inZones(rr.Header().Name, subzones) {
+			wanted = append(wanted, rr)
+		}
+	}
+	deleted, added := diffRecords(held, wanted)
+	for _, rr := range deleted {
+		if err := s.unregister(rr); err != nil {
+			return err
+		}
+	}
+	for _, rr := range added {
+		if err := s.register(rr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *dnsSecondary) register(rr dns.RR) error {
+	value, attrs, ok := transferValue(rr)
+	if !ok {
+		dnsLog.Debug("secondary record skipped", "rr", rr.String())
+		return nil
+	}
+	rrType := dns.Type(rr.Header().Rrtype).String()
+	if err := validateDNSValue(rrType, value, attrs); err != nil {
+		// Something we can't hold, such as a TXT record too long for us
+		dnsLog.Warn("secondary record skipped", "rr", rr.String(), "err", err)
+		return nil
+	}
+	return s.cfg.db.Register(rr.Header().Name, rrType, value, attrs, rr.Header().Ttl, 0)
+}
+
+func (s *dnsSecondary) unregister(rr dns.RR) error {
+	value, _, ok := transferValue(rr)
+	if !ok {
+		return nil
+	}
+	err := s.cfg.db.Unregister(rr.Header().Name, dns.Type(rr.Header().Rrtype).String(), value)
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// storedRecord returns rr as it would be answered once held, or nil if it
+// can't be held
+func storedRecord(rr dns.RR) dns.RR {
+	value, attrs, ok := transferValue(rr)
+	if !ok {
+		return nil
+	}
+	entry := &DNSEntry{Values: []DNSValue{{Value: value, Attr: attrs}}}
+	records, _ := entryRecords(dns.CanonicalName(rr.Header().Name), rr.Header().Rrtype, entry, rr.Header().Ttl)
+	if len(records) != 1 {
+		return nil
+	}
+	return records[0]
+}
+
+// transferValue returns the value and attributes that rr is held as, or false
+// if its type isn't one we hold
+func transferValue(rr dns.RR) (string, map[string]string, bool) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A.String(), nil, true
+	case *dns.AAAA:
+		return rr.AAAA.String(), nil, true
+	case *dns.NS:
+		return strings.TrimSuffix(rr.Ns, "."), nil, true
+	case *dns.CNAME:
+		return strings.TrimSuffix(rr.Target, "."), nil, true
+	case *dns.DNAME:
+		return strings.TrimSuffix(rr.Target, "."), nil, true
+	case *dns.PTR:
+		return strings.TrimSuffix(rr.Ptr, "."), nil, true
+	case *dns.TXT:
+		if len(rr.Txt) == 1 {
+			return rr.Txt[0], nil, true
+		}
+		lengths := make([]string, len(rr.Txt))
+		for i, s := range rr.Txt {
+			lengths[i] = strconv.Itoa(len(s))
+		}
+		return strings.Join(rr.Txt, ""), map[string]string{"lengths": strings.Join(lengths, ",")}, true
+	case *dns.MX:
+		return strings.TrimSuffix(rr.Mx, "."), map[string]string{"priority": fmt.Sprint(rr.Preference)}, true
+	case *dns.SRV:
+		return strings.TrimSuffix(rr.Target, "."), map[string]string{
+			"priority": fmt.Sprint(rr.Priority),
+			"weight":   fmt.Sprint(rr.Weight),
+			"port":     fmt.Sprint(rr.Port),
+		}, true
+	}
+	return "", nil, false
+}
+
+// primarySOA asks primary for the SOA of zone
+func primarySOA(zone string, primary string) (*dns.SOA, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeSOA)
+	c := &dns.Client{Timeout: dnsSecondaryTimeout}
+	r, _, err := c.Exchange(m, primary)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("the primary answered %s", dns.RcodeToString[r.Rcode])
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && dns.CanonicalName(soa.Hdr.Name) == zone {
+			return soa, nil
+		}
+	}
+	return nil, ErrNoPrimarySOA
+}
+
+// secondaryWait turns an SOA timer into how long to wait, falling back to the
+// default retry time when the timer is zero
+func secondaryWait(seconds uint32) time.Duration {
+	if seconds == 0 {
+		seconds = dnsDefaultRetry
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// serveNotify answers NOTIFY (RFC 1996) for one of the zones we're a secondary
+// for, having it refreshed straight away if it came from the zone's primary.
+// It returns the message that was sent, to be logged.
+func serveNotify(cfg *Config, secondary *dnsSecondary, w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Opcode = dns.OpcodeNotify
+	m.Authoritative = true
+	client := w.RemoteAddr().String()
+	if len(req.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		w.WriteMsg(m)
+		return m
+	}
+	zone := dns.CanonicalName(req.Question[0].Name)
+	primary, ok := cfg.DNSSecondaries()[zone]
+	switch {
+	case !ok:
+		m.Rcode = dns.RcodeNotAuth
+	case !fromPrimary(w.RemoteAddr(), primary):
+		dnsLog.Warn("notify refused", "zone", zone, "primary", primary, "client", client)
+		m.Rcode = dns.RcodeRefused
+	default:
+		dnsLog.Info("notified", "zone", zone, "client", client)
+		secondary.notify(zone)
+	}
+	w.WriteMsg(m)
+	return m
+}
+
+// fromPrimary reports whether addr is one of the addresses of primary
+func fromPrimary(addr net.Addr, primary string) bool {
+	client, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(primary)
+	if err != nil {
+		return false
+	}
+	hosts := []string{host}
+	if net.ParseIP(host) == nil {
+		if hosts, err = net.LookupHost(host); err != nil {
+			return false
+		}
+	}
+	for _, host := range hosts {
+		if net.ParseIP(host).Equal(net.ParseIP(client)) {
+			return true
+		}
+	}
+	return false
+}
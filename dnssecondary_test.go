@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// primaryServer answers SOA questions over UDP and zone transfers over TCP,
+// both from cfg, on the same port until it is shut down
+func primaryServer(t *testing.T, cfg *Config) (func(), string) {
+	tcp, addr := transferServer(t, cfg)
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = ask(cfg, req.Question[0].Name, req.Question[0].Qtype).Answer
+		w.WriteMsg(m)
+	})}
+	go udp.ActivateAndServe()
+	return func() { tcp.Shutdown(); udp.Shutdown() }, addr
+}
+
+func TestSecondary(t *testing.T) {
+	primaryCfg, primaryDB := newTestDNS(t)
+	primaryDB.dns[memDNSKey("example.com", "SOA")].meta["allow-transfer"] = "127.0.0.1"
+	if err := primaryDB.Register("example.com", "MX", "mail.example.com", map[string]string{"priority": "10"}, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := primaryDB.Register("example.com", "TXT", "v=spf1 -all", map[string]string{"lengths": "7,4"}, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	shutdown, addr := primaryServer(t, primaryCfg)
+	defer shutdown()
+
+	// A primary that never answers holds up only its own zone
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	db := NewMemDB()
+	cfg := &Config{db: db, hostname: "core2", dnsForwarders: []string{"!"}, dnsSecondaries: map[string]string{
+		"example.com.": addr,
+		"example.net.": silent.LocalAddr().String(),
+	}}
+	s := newDNSSecondary(cfg)
+	s.check = time.Hour // only refreshed when started and when notified
+	go s.run(func() {})
+	defer s.shutdown()
+
+	// The whole zone, served as our own
+	wait := func(name string, qtype uint16, answers int) *dnsAnswer {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			answer := ask(cfg, name, qtype)
+			if len(answer.Answer) == answers {
+				return answer
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d answers for %s, got %v", answers, name, answer.Answer)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	answer := wait("www.example.com", dns.TypeA, 1)
+	if !answer.Authoritative || answer.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("expected an authoritative answer of 10.0.0.1, got %v", answer)
+	}
+	if mx := wait("example.com", dns.TypeMX, 1).Answer[0].(*dns.MX); mx.Preference != 10 || mx.Mx != "mail.example.com." {
+		t.Errorf("expected the MX record, got %v", mx)
+	}
+	if txt := wait("example.com", dns.TypeTXT, 1).Answer[0].(*dns.TXT); len(txt.Txt) != 2 || txt.Txt[0] != "v=spf1 " || txt.Txt[1] != "-all" {
+		t.Errorf("expected the TXT record's two strings, got %v", txt)
+	}
+	primarySerial, _ := zoneSerial(primaryCfg, "example.com.")
+	if soa := wait("example.com", dns.TypeSOA, 1).Answer[0].(*dns.SOA); soa.Serial != primarySerial || soa.Ns != "ns1.example.com." {
+		t.Errorf("expected the primary's SOA with serial %d, got %v", primarySerial, soa)
+	}
+
+	// Just the changes, once the primary says there are some
+	if err := primaryDB.Register("new.example.com", "A", "10.0.0.3", nil, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := primaryDB.Unregister("www.example.com", "A", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	s.notify("example.com.")
+	wait("new.example.com", dns.TypeA, 1)
+	wait("www.example.com", dns.TypeA, 0)
+	wait("host.lab.example.com", dns.TypeA, 1)
+}
+
+func TestParseDNSSecondaries(t *testing.T) {
+	secondaries, err := parseDNSSecondaries("AD.example.com@10.0.0.5, corp.example.com@dc1.corp.example.com:5353")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secondaries["ad.example.com."] != "10.0.0.5:53" || secondaries["corp.example.com."] != "dc1.corp.example.com:5353" {
+		t.Errorf("unexpected secondaries %v", secondaries)
+	}
+	if _, err := parseDNSSecondaries("ad.example.com"); err == nil {
+		t.Error("expected an error for a zone without a primary")
+	}
+}
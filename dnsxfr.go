@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsXFRHistory = 8   // how many versions of each zone are kept for IXFR
+	dnsXFRChunk   = 100 // how many records are sent in each message of a transfer
+)
+
+// dnsTSIG signs and verifies messages with the TSIG keys in the config, so
+// that changes to the keys apply straight away
+type dnsTSIG struct {
+	cfg *Config
+}
+
+func (t dnsTSIG) Generate(msg []byte, tsig *dns.TSIG) ([]byte, error) {
+	secret, ok := t.cfg.DNSTSIGKeys()[dns.CanonicalName(tsig.Hdr.Name)]
+	if !ok {
+		return nil, dns.ErrSecret
+	}
+	raw, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	var h hash.Hash
+	switch dns.CanonicalName(tsig.Algorithm) {
+	case dns.HmacSHA1:
+		h = hmac.New(sha1.New, raw)
+	case dns.HmacSHA224:
+		h = hmac.New(sha256.New224, raw)
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, raw)
+	case dns.HmacSHA384:
+		h = hmac.New(sha512.New384, raw)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, raw)
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func (t dnsTSIG) Verify(msg []byte, tsig *dns.TSIG) error {
+	expected, err := t.Generate(msg, tsig)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(tsig.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// zoneVersion is the content of a zone at one serial, apart from its SOA
+type zoneVersion struct {
+	serial  uint32
+	records []dns.RR
+}
+
+// zoneHistory keeps the last few versions of each zone that was transferred,
+// so that a secondary asking for what changed since the version it was sent
+// last can be given just that (RFC 1995)
+type zoneHistory struct {
+	lock  sync.Mutex
+	zones map[string][]zoneVersion
+}
+
+func newZoneHistory() *zoneHistory {
+	return &zoneHistory{zones: make(map[string][]zoneVersion)}
+}
+
+// add records version of zone, dropping the oldest version once there are
+// more than dnsXFRHistory
+func (h *zoneHistory) add(zone string, version zoneVersion) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	versions := h.zones[zone]
+	if n := len(versions); n > 0 && versions[n-1].serial == version.serial {
+		return
+	}
+	versions = append(versions, version)
+	if len(versions) > dnsXFRHistory {
+		versions = versions[len(versions)-dnsXFRHistory:]
+	}
+	h.zones[zone] = versions
+}
+
+// find returns the version of zone at serial, if it is still kept
+func (h *zoneHistory) find(zone string, serial uint32) (zoneVersion, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, version := range h.zones[zone] {
+		if version.serial == serial {
+			return version, true
+		}
+	}
+	return zoneVersion{}, false
+}
+
+// serveTransfer answers an AXFR (RFC 5936) or IXFR (RFC 1995) request for one
+// of our zones. The client must either have an address listed in the
+// comma-separated "allow-transfer" Meta of the zone's @soa entry, or sign the
+// request with a key named in its "transfer-keys". An IXFR is answered with
+// the whole zone when the client's version is no longer kept. It returns the
+// message that was sent, or a stand-in for a transfer, to be logged.
+func serveTransfer(cfg *Config, history *zoneHistory, w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	fail := func(rcode int) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetRcode(req, rcode)
+		w.WriteMsg(m)
+		return m
+	}
+	if len(req.Question) != 1 {
+		return fail(dns.RcodeFormatError)
+	}
+	q := req.Question[0]
+	zone := dns.CanonicalName(q.Name)
+	client := w.RemoteAddr().String()
+
+	entry, err := cfg.db.GetDNS(zone, "SOA")
+	if err == ErrNotFound {
+		return fail(dns.RcodeNotAuth)
+	}
+	if err != nil {
+		dnsLog.Error("lookup failed", "qname", zone, "qtype", "SOA", "err", err)
+		return fail(dns.RcodeServerFailure)
+	}
+	if !transferAllowed(w, req, entry) {
+		dnsLog.Warn("zone transfer refused", "zone", zone, "qtype", dns.Type(q.Qtype).String(), "client", client)
+		return fail(dns.RcodeRefused)
+	}
+	if q.Qtype == dns.TypeAXFR && w.RemoteAddr().Network() != "tcp" {
+		return fail(dns.RcodeRefused) // AXFR is only carried over TCP (RFC 5936 section 4.2)
+	}
+
+	records, soa, err := zoneRecords(cfg, zone, entry)
+	if err != nil {
+		dnsLog.Error("lookup failed", "qname", zone, "qtype", dns.Type(q.Qtype).String(), "err", err)
+		return fail(dns.RcodeServerFailure)
+	}
+	history.add(zone, zoneVersion{serial: soa.Serial, records: records})
+
+	// The whole zone goes between two copies of its SOA
+	transfer := append(append([]dns.RR{soa}, records...), soa)
+	kind := "full"
+	if q.Qtype == dns.TypeIXFR {
+		var clientSOA *dns.SOA
+		for _, rr := range req.Ns {
+			if rr, ok := rr.(*dns.SOA); ok {
+				clientSOA = rr
+			}
+		}
+		if clientSOA == nil {
+			return fail(dns.RcodeFormatError)
+		}
+		old, found := history.find(zone, clientSOA.Serial)
+		switch {
+		case !serialBefore(clientSOA.Serial, soa.Serial) || w.RemoteAddr().Network() != "tcp":
+			// A lone SOA says that the client is up to date, or otherwise
+			// that it needs to ask again over TCP (RFC 1995 section 2)
+			transfer, kind = []dns.RR{soa}, "none"
+		case found:
+			oldSOA := dns.Copy(soa).(*dns.SOA)
+			oldSOA.Serial = old.serial
+			deleted, added := diffRecords(old.records, records)
+			transfer = append([]dns.RR{soa, oldSOA}, deleted...)
+			transfer = append(append(append(transfer, soa), added...), soa)
+			kind = "incremental"
+		}
+	}
+	dnsLog.Info("zone transfer", "zone", zone, "qtype", dns.Type(q.Qtype).String(), "serial", soa.Serial, "kind", kind, "records", len(transfer), "client", client)
+
+	ch := make(chan *dns.Envelope)
+	go func() {
+		defer close(ch)
+		for rrs := transfer; len(rrs) > 0; {
+			n := min(len(rrs), dnsXFRChunk)
+			ch <- &dns.Envelope{RR: rrs[:n]}
+			rrs = rrs[n:]
+		}
+	}()
+	if err := new(dns.Transfer).Out(w, req, ch); err != nil {
+		dnsLog.Warn("zone transfer failed", "zone", zone, "client", client, "err", err)
+	}
+	for range ch {
+		// let the sender finish if the client went away
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = transfer
+	return m
+}
+
+// transferAllowed reports whether the client that sent req may transfer the
+// zone with the SOA entry given
+func transferAllowed(w dns.ResponseWriter, req *dns.Msg, entry *DNSEntry) bool {
+	if tsig := req.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		for _, key := range splitMeta(entry.Meta["transfer-keys"]) {
+			if dns.CanonicalName(key) == dns.CanonicalName(tsig.Hdr.Name) {
+				return true
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, allowed := range splitMeta(entry.Meta["allow-transfer"]) {
+		if _, subnet, err := net.ParseCIDR(allowed); err == nil && subnet.Contains(ip) {
+			return true
+		}
+		if net.ParseIP(allowed).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneRecords returns every record in zone, leaving out its SOA and anything
+// in zones below it that have their own SOA, along with the zone's SOA
+func zoneRecords(cfg *Config, zone string, entry *DNSEntry) ([]dns.RR, *dns.SOA, error) {
+	list, err := cfg.db.ListDNS(zone)
+	if err != nil {
+		return nil, nil, err
+	}
+	var subzones []string
+	for _, record := range list {
+		if record.Type == "SOA" && dns.Fqdn(record.Name) != zone {
+			subzones = append(subzones, dns.Fqdn(record.Name))
+		}
+	}
+
+	var records []dns.RR
+	for _, record := range list {
+		name := dns.Fqdn(record.Name)
+		rrType, ok := dns.StringToType[record.Type]
+		if !ok || rrType == dns.TypeSOA || inZones(name, subzones) {
+			continue
+		}
+		records = append(records, transferRecords(name, rrType, record.Entry)...)
+	}
+
+	soa := answerSOA(&dns.Question{Name: zone, Qtype: dns.TypeSOA, Qclass: dns.ClassINET}, entry, soaSerial(entry)).(*dns.SOA)
+	soa.Hdr.Ttl = dnsDefaultTTL
+	if entry.TTL > 0 {
+		soa.Hdr.Ttl = entry.TTL
+	}
+	return records, soa, nil
+}
+
+// transferRecords builds the records of type rrType held in entry for name as
+// they're transferred: with the TTL of the set, rather than however long is
+// left until each value expires, which would change from one transfer to the
+// next and be kept by secondaries as if it didn't
+func transferRecords(name string, rrType uint16, entry *DNSEntry) []dns.RR {
+	ttl := dnsDefaultTTL
+	if entry.TTL > 0 {
+		ttl = entry.TTL
+	}
+	held := *entry
+	held.Values = make([]DNSValue, 0, len(entry.Values))
+	for _, value := range entry.Values {
+		if value.Expiration != nil && !value.Expiration.After(time.Now()) {
+			continue // expired
+		}
+		value.Expiration, value.TTL = nil, 0
+		held.Values = append(held.Values, value)
+	}
+	records, _ := entryRecords(name, rrType, &held, ttl)
+	return records
+}
+
+// inZones reports whether name is at or below any of zones
+func inZones(name string, zones []string) bool {
+	for _, zone := range zones {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffRecords returns the records in old that aren't in current, and those in
+// current that weren't in old. Records are compared without their TTLs, so one
+// whose TTL alone has changed is in neither.
+func diffRecords(old []dns.RR, current []dns.RR) (deleted []dns.RR, added []dns.RR) {
+	index := func(records []dns.RR) map[string]bool {
+		keys := make(map[string]bool, len(records))
+		for _, rr := range records {
+			keys[recordKey(rr)] = true
+		}
+		return keys
+	}
+	oldKeys, currentKeys := index(old), index(current)
+	for _, rr := range old {
+		if !currentKeys[recordKey(rr)] {
+			deleted = append(deleted, rr)
+		}
+	}
+	for _, rr := range current {
+		if !oldKeys[recordKey(rr)] {
+			added = append(added, rr)
+		}
+	}
+	return deleted, added
+}
+
+// recordKey returns rr as text without its TTL
+func recordKey(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	return rr.String()
+}
+
+// serialBefore reports whether serial a comes before serial b, allowing for
+// them wrapping around (RFC 1982)
+func serialBefore(a uint32, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
+
+// splitMeta splits a comma-separated Meta value into its items
+func splitMeta(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
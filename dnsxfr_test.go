@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// transferServer serves zone transfers from cfg over TCP until it is shut down
+func transferServer(t *testing.T, cfg *Config) (*dns.Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := newZoneHistory()
+	server := &dns.Server{Listener: l, TsigProvider: dnsTSIG{cfg}, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		serveTransfer(cfg, history, w, req)
+	})}
+	go server.ActivateAndServe()
+	return server, l.Addr().String()
+}
+
+// transfer asks addr for the zone, returning the records sent or the error
+func transfer(addr string, m *dns.Msg, tr *dns.Transfer) ([]dns.RR, error) {
+	envelopes, err := tr.In(m, addr)
+	if err != nil {
+		return nil, err
+	}
+	var records []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		records = append(records, envelope.RR...)
+	}
+	return records, nil
+}
+
+func TestZoneTransfers(t *testing.T) {
+	cfg, db := newTestDNS(t)
+	cfg.dnsTSIGKeys = map[string]string{"xfr.example.com.": "c2VjcmV0c2VjcmV0c2VjcmV0"}
+	server, addr := transferServer(t, cfg)
+	defer server.Shutdown()
+
+	axfr := new(dns.Msg)
+	axfr.SetAxfr("example.com.")
+	if _, err := transfer(addr, axfr, new(dns.Transfer)); err == nil {
+		t.Error("expected a transfer to be refused when nothing is allowed")
+	}
+
+	// By TSIG key
+	meta := db.dns[memDNSKey("example.com", "SOA")].meta
+	meta["transfer-keys"] = "xfr.example.com"
+	signed := axfr.Copy()
+	signed.SetTsig("xfr.example.com.", dns.HmacSHA256, 300, 0)
+	records, err := transfer(addr, signed, &dns.Transfer{TsigSecret: cfg.dnsTSIGKeys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[0].Header().Rrtype != dns.TypeSOA || records[3].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("expected the two addresses between two SOAs, got %v", records)
+	}
+	serial := records[0].(*dns.SOA).Serial
+
+	// By address, asking for the changes since the transfer above
+	delete(meta, "transfer-keys")
+	meta["allow-transfer"] = "10.9.9.9, 127.0.0.0/8"
+	if err := db.Register("new.example.com", "A", "10.0.0.3", nil, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	ixfr := new(dns.Msg)
+	ixfr.SetIxfr("example.com.", serial, "ns1.example.com.", "hostmaster.example.com.")
+	records, err = transfer(addr, ixfr, new(dns.Transfer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 || records[1].(*dns.SOA).Serial != serial || records[3].Header().Name != "new.example.com." {
+		t.Errorf("expected only the new address, got %v", records)
+	}
+
+	// Up to date
+	ixfr.Ns[0].(*dns.SOA).Serial = records[0].(*dns.SOA).Serial
+	if records, err = transfer(addr, ixfr, new(dns.Transfer)); err != nil || len(records) != 1 {
+		t.Errorf("expected a lone SOA, got %v %v", records, err)
+	}
+}
+
+func TestTransferTTLs(t *testing.T) {
+	cfg, db := newTestDNS(t)
+	if err := db.Register("lease.example.com", "A", "10.0.0.4", nil, 0, 600); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := db.GetDNS("example.com.", "SOA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, _, err := zoneRecords(cfg, "example.com.", entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var leased dns.RR
+	for _, rr := range records {
+		if rr.Header().Name == "lease.example.com." {
+			leased = rr
+		}
+	}
+	if leased == nil || leased.Header().Ttl != dnsDefaultTTL {
+		t.Errorf("expected the address to be transferred with the default TTL, got %v", leased)
+	}
+
+	// Only the TTL differs
+	old, _ := dns.NewRR("lease.example.com. 600 IN A 10.0.0.4")
+	if deleted, added := diffRecords([]dns.RR{old}, records); len(deleted) != 0 || len(added) != len(records)-1 {
+		t.Errorf("expected a record whose TTL changed to be left out, got -%v +%v", deleted, added)
+	}
+}
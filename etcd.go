@@ -2,12 +2,28 @@ package main
 
 import (
 	"strings"
+	"time"
 
 	"github.com/coreos/go-etcd/etcd"
 )
 
 type EtcdDB struct {
-	client *etcd.Client
+	client etcdClient
+	owner  string // recorded against every DNS value we register
+}
+
+// etcdClient is the subset of the etcd client that EtcdDB relies on, which
+// allows a stand-in to be substituted in tests
+type etcdClient interface {
+	Get(key string, sort, recursive bool) (*etcd.Response, error)
+	Set(key string, value string, ttl uint64) (*etcd.Response, error)
+	Create(key string, value string, ttl uint64) (*etcd.Response, error)
+	CreateDir(key string, ttl uint64) (*etcd.Response, error)
+	UpdateDir(key string, ttl uint64) (*etcd.Response, error)
+	CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*etcd.Response, error)
+	CompareAndDelete(key string, prevValue string, prevIndex uint64) (*etcd.Response, error)
+	Delete(key string, recursive bool) (*etcd.Response, error)
+	Watch(prefix string, waitIndex uint64, recursive bool, receiver chan *etcd.Response, stop chan bool) (*etcd.Response, error)
 }
 
 func NewEtcdDB(serverList string) DB {
@@ -17,13 +33,153 @@ func NewEtcdDB(serverList string) DB {
 	}
 	client := etcd.NewClient(servers)
 	client.SetConsistency("WEAK_CONSISTENCY")
-	db := EtcdDB{client}
+	owner, _ := getNetcoreName() // ownership is informational, so don't fail over it
+	db := EtcdDB{client: timedEtcdClient{client}, owner: owner}
 	return db
 }
 
+// Ping checks that etcd can be reached by reading the config directory
+func (db EtcdDB) Ping() error {
+	_, err := db.client.Get("config", false, false)
+	if etcdKeyNotFound(err) {
+		return nil // it answered, at least
+	}
+	return err
+}
+
+// timedEtcdClient records how long each request to etcd takes in the metrics
+type timedEtcdClient struct {
+	client etcdClient
+}
+
+func observeEtcd(operation string, start time.Time) {
+	etcdDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func (c timedEtcdClient) Get(key string, sort, recursive bool) (*etcd.Response, error) {
+	defer observeEtcd("get", time.Now())
+	return c.client.Get(key, sort, recursive)
+}
+
+func (c timedEtcdClient) Set(key string, value string, ttl uint64) (*etcd.Response, error) {
+	defer observeEtcd("set", time.Now())
+	return c.client.Set(key, value, ttl)
+}
+
+func (c timedEtcdClient) Create(key string, value string, ttl uint64) (*etcd.Response, error) {
+	defer observeEtcd("create", time.Now())
+	return c.client.Create(key, value, ttl)
+}
+
+func (c timedEtcdClient) CreateDir(key string, ttl uint64) (*etcd.Response, error) {
+	defer observeEtcd("createdir", time.Now())
+	return c.client.CreateDir(key, ttl)
+}
+
+func (c timedEtcdClient) UpdateDir(key string, ttl uint64) (*etcd.Response, error) {
+	defer observeEtcd("updatedir", time.Now())
+	return c.client.UpdateDir(key, ttl)
+}
+
+func (c timedEtcdClient) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	defer observeEtcd("compareandswap", time.Now())
+	return c.client.CompareAndSwap(key, value, ttl, prevValue, prevIndex)
+}
+
+func (c timedEtcdClient) CompareAndDelete(key string, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	defer observeEtcd("compareanddelete", time.Now())
+	return c.client.CompareAndDelete(key, prevValue, prevIndex)
+}
+
+func (c timedEtcdClient) Delete(key string, recursive bool) (*etcd.Response, error) {
+	defer observeEtcd("delete", time.Now())
+	return c.client.Delete(key, recursive)
+}
+
+// Watch isn't timed because it waits for as long as it takes for a change
+func (c timedEtcdClient) Watch(prefix string, waitIndex uint64, recursive bool, receiver chan *etcd.Response, stop chan bool) (*etcd.Response, error) {
+	return c.client.Watch(prefix, waitIndex, recursive, receiver, stop)
+}
+
+// watchDir calls fn with the key of everything that changes below dir until
+// stop is closed, or with an empty key when changes may have been missed
+func (db EtcdDB) watchDir(dir string, stop <-chan struct{}, fn func(key string)) {
+	db.watchDirEvents(dir, stop, func(response *etcd.Response) {
+		key := ""
+		if response != nil {
+			key = response.Node.Key
+		}
+		fn(key)
+	})
+}
+
+// watchDirEvents calls fn with each change below dir until stop is closed, or
+// with nil when changes may have been missed
+func (db EtcdDB) watchDirEvents(dir string, stop <-chan struct{}, fn func(response *etcd.Response)) {
+	stopWatch := make(chan bool)
+	go func() {
+		<-stop
+		close(stopWatch)
+	}()
+
+	var waitIndex uint64
+	if response, err := db.client.Get(dir, false, false); err == nil {
+		waitIndex = response.EtcdIndex + 1
+	}
+	for {
+		response, err := db.client.Watch(dir, waitIndex, true, nil, stopWatch)
+		if err == etcd.ErrWatchStoppedByUser {
+			return
+		}
+		if etcdIndexCleared(err) {
+			// We fell too far behind etcd's event history, so start again
+			// from now and report that anything may have changed
+			waitIndex = 0
+			response = nil
+		} else if err != nil {
+			etcdLog.Warn(dir+" watch failed", "err", err)
+			select {
+			case <-time.After(time.Second): // don't spin if etcd is unreachable
+				continue
+			case <-stop:
+				return
+			}
+		} else {
+			waitIndex = response.Node.ModifiedIndex + 1
+		}
+		select {
+		case <-stop:
+			return
+		default:
+			fn(response)
+		}
+	}
+}
+
 func etcdKeyNotFound(err error) bool {
 	if err == nil {
 		return false
 	}
 	return strings.Contains(err.Error(), "Key not found")
 }
+
+func etcdKeyExists(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), "Key already exists")
+}
+
+func etcdIndexCleared(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), "The event in requested index is outdated and cleared")
+}
+
+func etcdCompareFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), "Compare failed")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// EtcdV3DB is a DB stored in etcd using the v3 API. It keeps the same key
+// paths as EtcdDB (such as /dhcp/<mac>/ip) but as flat keys, with expiry
+// handled by etcd leases instead of per-node TTLs.
+type EtcdV3DB struct {
+	client *clientv3.Client
+	owner  string // recorded against every DNS value we register
+}
+
+// etcdV3Timeout bounds each individual request to etcd
+const etcdV3Timeout = 5 * time.Second
+
+func NewEtcdV3DB(endpointList string) (DB, error) {
+	var endpoints []string
+	if endpointList != "" {
+		endpoints = strings.Split(endpointList, ",")
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: etcdV3Timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client.KV = timedKV{client.KV}
+	owner, _ := getNetcoreName() // ownership is informational, so don't fail over it
+	return EtcdV3DB{client: client, owner: owner}, nil
+}
+
+// timedKV records how long each key-value request to etcd takes in the
+// metrics, under the same operation names as timedEtcdClient where they match
+type timedKV struct {
+	clientv3.KV
+}
+
+func (kv timedKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	defer observeEtcd("get", time.Now())
+	return kv.KV.Get(ctx, key, opts...)
+}
+
+func (kv timedKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	defer observeEtcd("set", time.Now())
+	return kv.KV.Put(ctx, key, val, opts...)
+}
+
+func (kv timedKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	defer observeEtcd("delete", time.Now())
+	return kv.KV.Delete(ctx, key, opts...)
+}
+
+func (kv timedKV) Txn(ctx context.Context) clientv3.Txn {
+	return timedTxn{kv.KV.Txn(ctx)}
+}
+
+// timedTxn times a transaction when it is committed
+type timedTxn struct {
+	clientv3.Txn
+}
+
+func (txn timedTxn) If(cs ...clientv3.Cmp) clientv3.Txn   { return timedTxn{txn.Txn.If(cs...)} }
+func (txn timedTxn) Then(ops ...clientv3.Op) clientv3.Txn { return timedTxn{txn.Txn.Then(ops...)} }
+func (txn timedTxn) Else(ops ...clientv3.Op) clientv3.Txn { return timedTxn{txn.Txn.Else(ops...)} }
+
+func (txn timedTxn) Commit() (*clientv3.TxnResponse, error) {
+	defer observeEtcd("txn", time.Now())
+	return txn.Txn.Commit()
+}
+
+func etcdV3Context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), etcdV3Timeout)
+}
+
+// Ping checks that etcd can be reached by counting the config keys
+func (db EtcdV3DB) Ping() error {
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	_, err := db.client.Get(ctx, "/config/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	return err
+}
+
+// grant returns a lease that expires after ttl seconds, or clientv3.NoLease if
+// ttl is zero
+func (db EtcdV3DB) grant(ttl uint64) (clientv3.LeaseID, error) {
+	if ttl == 0 {
+		return clientv3.NoLease, nil
+	}
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	response, err := db.client.Grant(ctx, int64(ttl))
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	return response.ID, nil
+}
+
+// revoke discards a lease that turned out not to be needed
+func (db EtcdV3DB) revoke(lease clientv3.LeaseID) {
+	if lease == clientv3.NoLease {
+		return
+	}
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	db.client.Revoke(ctx, lease)
+}
+
+// leaseOptions returns the options needed to attach a put to the given lease
+func leaseOptions(lease clientv3.LeaseID) []clientv3.OpOption {
+	if lease == clientv3.NoLease {
+		return nil
+	}
+	return []clientv3.OpOption{clientv3.WithLease(lease)}
+}
+
+// leaseExpires returns what's stored alongside the keys written on a lease of
+// ttl seconds, granted just now, to say when it runs out: the time in seconds
+// since the epoch, so that reading it takes no more than reading the keys
+func leaseExpires(ttl uint64) string {
+	return strconv.FormatInt(time.Now().Add(time.Duration(ttl)*time.Second).Unix(), 10)
+}
+
+// leaseExpirations returns when the lease of each key in kvs runs out, read
+// from those of kvs that expires picks out as written by leaseExpires. Only
+// the leases without one, such as those of keys copied by -migrate, are looked
+// up in etcd. Keys without a lease are not included, and neither are those
+// whose lease has run out, as the keys are about to go with it; callers must
+// treat a leased key missing from the map as expired.
+func (db EtcdV3DB) leaseExpirations(kvs []*mvccpb.KeyValue, expires func(key string) bool) (map[int64]time.Time, error) {
+	expirations := make(map[int64]time.Time)
+	for _, kv := range kvs {
+		if kv.Lease == 0 || !expires(string(kv.Key)) {
+			continue
+		}
+		if seconds, err := strconv.ParseInt(string(kv.Value), 10, 64); err == nil {
+			expirations[kv.Lease] = time.Unix(seconds, 0)
+		}
+	}
+	now := time.Now()
+	for _, kv := range kvs {
+		if _, ok := expirations[kv.Lease]; kv.Lease == 0 || ok {
+			continue
+		}
+		ctx, cancel := etcdV3Context()
+		response, err := db.client.TimeToLive(ctx, clientv3.LeaseID(kv.Lease))
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		expirations[kv.Lease] = now.Add(time.Duration(response.TTL) * time.Second) // etcd answers -1 for a lease that has run out
+	}
+	for lease, expiration := range expirations {
+		if !expiration.After(now) {
+			delete(expirations, lease)
+		}
+	}
+	return expirations, nil
+}
+
+// watchPrefix calls fn for every change under prefix until stop is closed,
+// starting from the revision after rev. If the watch is interrupted it is
+// resumed from the last revision seen so that no changes are missed; if that
+// revision has been compacted away then fn is called with a nil event to
+// signal that the caller should reload everything.
+func (db EtcdV3DB) watchPrefix(prefix string, rev int64, stop <-chan struct{}, fn func(event *clientv3.Event)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for ctx.Err() == nil {
+		watch := db.client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+		for response := range watch {
+			if response.CompactRevision != 0 {
+				rev = response.CompactRevision - 1
+				fn(nil)
+				continue
+			}
+			if err := response.Err(); err != nil {
+				break
+			}
+			for _, event := range response.Events {
+				fn(event)
+			}
+			rev = response.Header.Revision
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second): // don't spin if etcd is unreachable
+		}
+	}
+}
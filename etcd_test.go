@@ -0,0 +1,337 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// fakeEtcd is an in-memory stand-in for the etcd v2 keys API that implements
+// just enough of its behavior for EtcdDB to be exercised in tests
+type fakeEtcd struct {
+	sync.Mutex
+	nodes map[string]*fakeEtcdNode
+	index uint64
+	now   func() time.Time
+	fail  func(method string, key string) error // injects failures when set
+
+	events  []*etcd.Response // every change, for watches
+	changed chan struct{}    // closed and replaced whenever there's a change
+}
+
+type fakeEtcdNode struct {
+	value      string
+	dir        bool
+	expiration *time.Time
+	modified   uint64
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		nodes:   map[string]*fakeEtcdNode{"/": &fakeEtcdNode{dir: true}},
+		now:     time.Now,
+		changed: make(chan struct{}),
+	}
+}
+
+func newFakeEtcdDB() (EtcdDB, *fakeEtcd) {
+	fake := newFakeEtcd()
+	return EtcdDB{client: fake, owner: "test-owner"}, fake
+}
+
+func fakeEtcdKey(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+func fakeEtcdParent(key string) string {
+	i := strings.LastIndex(key, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return key[:i]
+}
+
+func fakeEtcdError(code int, message string, key string) error {
+	return &etcd.EtcdError{ErrorCode: code, Message: message, Cause: key}
+}
+
+// expire removes every node whose expiration has passed, along with any
+// descendants of expired directories
+func (f *fakeEtcd) expire() {
+	now := f.now()
+	for key, node := range f.nodes {
+		if node.expiration != nil && !node.expiration.After(now) {
+			f.remove(key, "expire")
+		}
+	}
+}
+
+func (f *fakeEtcd) remove(key string, action string) {
+	for k := range f.nodes {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(f.nodes, k)
+		}
+	}
+	f.index++
+	f.record(action, key)
+}
+
+// record notes a change to key for the benefit of watches
+func (f *fakeEtcd) record(action string, key string) {
+	f.events = append(f.events, &etcd.Response{Action: action, Node: &etcd.Node{Key: key, ModifiedIndex: f.index}, EtcdIndex: f.index})
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeEtcd) expiration(ttl uint64) *time.Time {
+	if ttl == 0 {
+		return nil
+	}
+	t := f.now().Add(time.Duration(ttl) * time.Second)
+	return &t
+}
+
+// makeParents creates any missing parent directories of key
+func (f *fakeEtcd) makeParents(key string) error {
+	parent := fakeEtcdParent(key)
+	if node, ok := f.nodes[parent]; ok {
+		if !node.dir {
+			return fakeEtcdError(104, "Not a directory", parent)
+		}
+		return nil
+	}
+	if err := f.makeParents(parent); err != nil {
+		return err
+	}
+	f.index++
+	f.nodes[parent] = &fakeEtcdNode{dir: true, modified: f.index}
+	return nil
+}
+
+// injected returns the failure to inject for the given call, if any
+func (f *fakeEtcd) injected(method string, key string) error {
+	if f.fail == nil {
+		return nil
+	}
+	return f.fail(method, key)
+}
+
+func (f *fakeEtcd) put(key string, node *fakeEtcdNode) (*etcd.Response, error) {
+	if err := f.makeParents(key); err != nil {
+		return nil, err
+	}
+	var prevNode *etcd.Node
+	if _, ok := f.nodes[key]; ok {
+		prevNode = f.node(key, false)
+	}
+	f.index++
+	node.modified = f.index
+	f.nodes[key] = node
+	f.record("set", key)
+	return &etcd.Response{Action: "set", Node: f.node(key, false), PrevNode: prevNode, EtcdIndex: f.index}, nil
+}
+
+func (f *fakeEtcd) node(key string, recursive bool) *etcd.Node {
+	n := f.nodes[key]
+	node := &etcd.Node{
+		Key:           key,
+		Value:         n.value,
+		Dir:           n.dir,
+		Expiration:    n.expiration,
+		ModifiedIndex: n.modified,
+	}
+	if n.expiration != nil {
+		node.TTL = int64(n.expiration.Sub(f.now()).Seconds() + 0.5)
+	}
+	if !n.dir {
+		return node
+	}
+	var children []string
+	for k := range f.nodes {
+		if k != key && fakeEtcdParent(k) == key {
+			children = append(children, k)
+		}
+	}
+	sort.Strings(children)
+	for _, child := range children {
+		if recursive {
+			node.Nodes = append(node.Nodes, f.node(child, true))
+		} else {
+			c := f.nodes[child]
+			node.Nodes = append(node.Nodes, &etcd.Node{Key: child, Value: c.value, Dir: c.dir, Expiration: c.expiration, ModifiedIndex: c.modified})
+		}
+	}
+	return node
+}
+
+func (f *fakeEtcd) Get(key string, sort, recursive bool) (*etcd.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.expire()
+	key = fakeEtcdKey(key)
+	if _, ok := f.nodes[key]; !ok {
+		return nil, fakeEtcdError(100, "Key not found", key)
+	}
+	return &etcd.Response{Action: "get", Node: f.node(key, recursive), EtcdIndex: f.index}, nil
+}
+
+func (f *fakeEtcd) Set(key string, value string, ttl uint64) (*etcd.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.expire()
+	key = fakeEtcdKey(key)
+	if err := f.injected("Set", key); err != nil {
+		return nil, err
+	}
+	if node, ok := f.nodes[key]; ok && node.dir {
+		return nil, fakeEtcdError(102, "Not a file", key)
+	}
+	return f.put(key, &fakeEtcdNode{value: value, expiration: f.expiration(ttl)})
+}
+
+func (f *fakeEtcd) Create(key string, value string, ttl uint64) (*etcd.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.expire()
+	key = fakeEtcdKey(key)
+	if err := f.injected("Create", key); err != nil {
+		return nil, err
+	}
+	if _, ok := f.nodes[key]; ok {
+		return nil, fakeEtcdError(105, "Key already exists", key)
+	}
+	return f.put(key, &fakeEtcdNode{value: value, expiration: f.expiration(ttl)})
+}
+
+func (f *fakeEtcd) CreateDir(key string, ttl uint64) (*etcd.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.expire()
+	key = fakeEtcdKey(key)
+	if err := f.injected("CreateDir", key); err != nil {
+		return nil, err
+	}
+	if _, ok := f.nodes[key]; ok {
+		return nil, fakeEtcdError(105, "Key already exists", key)
+	}
+	return f.put(key, &fakeEtcdNode{dir: true, expiration: f.expiration(ttl)})
+}
+
+func (f *fakeEtcd) UpdateDir(key string, ttl uint64) (*etcd.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.expire()
+	key = fakeEtcdKey(key)
+	if err := f.injected("UpdateDir", key); err != nil {
+		return nil, err
+	}
+	node, ok := f.nodes[key]
+	if !ok {
+		return nil, fakeEtcdError(100, "Key not found", key)
+	}
+	if !node.dir {
+		return nil, fakeEtcdError(104, "Not a directory", key)
+	}
+	f.index++
+	node.expiration = f.expiration(ttl)
+	node.modified = f.index
+	f.record("update", key)
+	return &etcd.Response{Action: "update", Node: f.node(key, false), EtcdIndex: f.index}, nil
+}
+
+func (f *fakeEtcd) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.expire()
+	key = fakeEtcdKey(key)
+	if err := f.injected("CompareAndSwap", key); err != nil {
+		return nil, err
+	}
+	node, ok := f.nodes[key]
+	if !ok {
+		return nil, fakeEtcdError(100, "Key not found", key)
+	}
+	if node.dir {
+		return nil, fakeEtcdError(102, "Not a file", key)
+	}
+	if (prevValue != "" && node.value != prevValue) || (prevIndex != 0 && node.modified != prevIndex) {
+		return nil, fakeEtcdError(101, "Compare failed", key)
+	}
+	return f.put(key, &fakeEtcdNode{value: value, expiration: f.expiration(ttl)})
+}
+
+func (f *fakeEtcd) CompareAndDelete(key string, prevValue string, prevIndex uint64) (*etcd.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.expire()
+	key = fakeEtcdKey(key)
+	if err := f.injected("CompareAndDelete", key); err != nil {
+		return nil, err
+	}
+	node, ok := f.nodes[key]
+	if !ok {
+		return nil, fakeEtcdError(100, "Key not found", key)
+	}
+	if node.dir {
+		return nil, fakeEtcdError(102, "Not a file", key)
+	}
+	if (prevValue != "" && node.value != prevValue) || (prevIndex != 0 && node.modified != prevIndex) {
+		return nil, fakeEtcdError(101, "Compare failed", key)
+	}
+	prevNode := f.node(key, false)
+	f.remove(key, "compareAndDelete")
+	return &etcd.Response{Action: "compareAndDelete", PrevNode: prevNode, EtcdIndex: f.index}, nil
+}
+
+func (f *fakeEtcd) Delete(key string, recursive bool) (*etcd.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.expire()
+	key = fakeEtcdKey(key)
+	if err := f.injected("Delete", key); err != nil {
+		return nil, err
+	}
+	node, ok := f.nodes[key]
+	if !ok {
+		return nil, fakeEtcdError(100, "Key not found", key)
+	}
+	if node.dir && !recursive {
+		return nil, fakeEtcdError(102, "Not a file", key)
+	}
+	prevNode := f.node(key, false)
+	f.remove(key, "delete")
+	return &etcd.Response{Action: "delete", PrevNode: prevNode, EtcdIndex: f.index}, nil
+}
+
+// Watch waits for the first change under prefix at or after waitIndex, or for
+// the next change if waitIndex is zero. Long-term watches with a receiver are
+// not supported.
+func (f *fakeEtcd) Watch(prefix string, waitIndex uint64, recursive bool, receiver chan *etcd.Response, stop chan bool) (*etcd.Response, error) {
+	prefix = fakeEtcdKey(prefix)
+	f.Lock()
+	if waitIndex == 0 {
+		waitIndex = f.index + 1
+	}
+	for {
+		for _, event := range f.events {
+			if event.Node.ModifiedIndex < waitIndex {
+				continue
+			}
+			if event.Node.Key == prefix || (recursive && strings.HasPrefix(event.Node.Key, prefix+"/")) {
+				f.Unlock()
+				return event, nil
+			}
+		}
+		changed := f.changed
+		f.Unlock()
+		select {
+		case <-changed:
+		case <-stop:
+			return nil, etcd.ErrWatchStoppedByUser
+		}
+		f.Lock()
+	}
+}
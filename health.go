@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var healthAddr = flag.String("health", "", "Address to serve /healthz and /readyz on, such as \":8080\" (or empty to disable them).")
+
+const healthCheckInterval = 5 * time.Second // FIXME: put this in a config
+
+const forwarderCheckTimeout = 2 * time.Second
+
+// dbHealth keeps track of whether the DB can be reached, checking it every
+// healthCheckInterval. A DB that isn't a Pinger is always reachable.
+type dbHealth struct {
+	db      Pinger
+	lock    sync.RWMutex
+	err     error
+	checked time.Time
+}
+
+func newDBHealth(db DB) *dbHealth {
+	pinger, _ := db.(Pinger)
+	return &dbHealth{db: pinger}
+}
+
+// run checks the DB every healthCheckInterval until stop is closed
+func (h *dbHealth) run(stop <-chan struct{}) {
+	if h.db == nil {
+		return
+	}
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		h.check()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (h *dbHealth) check() {
+	err := h.db.Ping()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err != nil && h.err == nil {
+		etcdLog.Error("etcd is unreachable", "err", err)
+	} else if err == nil && h.err != nil {
+		etcdLog.Info("etcd is reachable again")
+	}
+	h.err = err
+	h.checked = time.Now()
+}
+
+// Reachable reports whether the DB could be reached when it was last checked
+func (h *dbHealth) Reachable() bool {
+	if h == nil {
+		return true
+	}
+	_, err := h.Status()
+	return err == nil
+}
+
+// Status returns when the DB was last checked, and the error if it failed
+func (h *dbHealth) Status() (time.Time, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.checked, h.err
+}
+
+// HealthCheck is the outcome of one of the checks made by /healthz and /readyz
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// healthServer answers /healthz, which fails when a service isn't running, and
+// /readyz, which also fails when etcd can't be reached or no forwarder
+// answers. Both report every check.
+type healthServer struct {
+	cfg    *Config
+	sup    *supervisor
+	db     *dbHealth
+	lookup func(server string) error // asks a forwarder something
+}
+
+func healthSetup(cfg *Config, sup *supervisor, db *dbHealth, addr string) service {
+	return httpService("health", addr, healthServer{cfg: cfg, sup: sup, db: db, lookup: checkForwarder})
+}
+
+func (s healthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var checks []HealthCheck
+	switch r.URL.Path {
+	case "/healthz":
+		checks = append(s.serviceChecks(), s.etcdCheck(), s.configCheck())
+	case "/readyz":
+		checks = append(s.serviceChecks(), s.etcdCheck(), s.configCheck(), s.forwarderCheck())
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	ok := true
+	for _, check := range checks {
+		if !check.OK && (r.URL.Path == "/readyz" || strings.HasPrefix(check.Name, "service/")) {
+			ok = false
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		OK     bool          `json:"ok"`
+		Checks []HealthCheck `json:"checks"`
+	}{ok, checks})
+}
+
+// serviceChecks fails a service that isn't running, which for DNS and the
+// HTTP services means its listeners aren't bound
+func (s healthServer) serviceChecks() []HealthCheck {
+	var checks []HealthCheck
+	for _, status := range s.sup.Status() {
+		detail := status.State
+		if status.Error != "" {
+			detail += ": " + status.Error
+		}
+		checks = append(checks, HealthCheck{Name: "service/" + status.Name, OK: status.State == "running", Detail: detail})
+	}
+	return checks
+}
+
+func (s healthServer) etcdCheck() HealthCheck {
+	if s.db == nil || s.db.db == nil {
+		return HealthCheck{Name: "etcd", OK: true, Detail: "not used"}
+	}
+	checked, err := s.db.Status()
+	if checked.IsZero() {
+		return HealthCheck{Name: "etcd", OK: false, Detail: "not checked yet"}
+	}
+	if err != nil {
+		return HealthCheck{Name: "etcd", OK: false, Detail: err.Error()}
+	}
+	return HealthCheck{Name: "etcd", OK: true, Detail: "checked " + checked.Format(time.RFC3339)}
+}
+
+// configCheck reports when the config was last loaded. A failed reload leaves
+// the previous config in use, so it doesn't fail the check.
+func (s healthServer) configCheck() HealthCheck {
+	loaded, err := s.cfg.Loaded()
+	detail := "loaded " + loaded.Format(time.RFC3339)
+	if err != nil {
+		detail += "; the last reload failed: " + err.Error()
+	}
+	return HealthCheck{Name: "config", OK: true, Detail: detail}
+}
+
+// forwarderCheck asks every forwarder something at once, and fails only if
+// none of them answer
+func (s healthServer) forwarderCheck() HealthCheck {
+	var forwarders []string
+	for _, server := range s.cfg.DNSForwarders() {
+		if server = strings.TrimSpace(server); server != "" && server != "!" {
+			forwarders = append(forwarders, server)
+		}
+	}
+	if len(forwarders) == 0 {
+		return HealthCheck{Name: "forwarders", OK: true, Detail: "none configured"}
+	}
+
+	errs := make([]error, len(forwarders))
+	var wg sync.WaitGroup
+	for i, server := range forwarders {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			errs[i] = s.lookup(server)
+		}(i, server)
+	}
+	wg.Wait()
+
+	check := HealthCheck{Name: "forwarders"}
+	var details []string
+	for i, server := range forwarders {
+		if errs[i] != nil {
+			details = append(details, server+" failed: "+errs[i].Error())
+		} else {
+			check.OK = true
+			details = append(details, server+" ok")
+		}
+	}
+	check.Detail = strings.Join(details, "; ")
+	return check
+}
+
+// checkForwarder asks server for the root name servers
+func checkForwarder(server string) error {
+	c := &dns.Client{Timeout: forwarderCheckTimeout}
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+	_, _, err := c.Exchange(m, server)
+	return err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakePinger stands in for etcd, failing whenever err is set
+type fakePinger struct {
+	err *error
+}
+
+func (p fakePinger) Ping() error { return *p.err }
+
+func TestHealthEndpoints(t *testing.T) {
+	var etcdErr error
+	db := &dbHealth{db: fakePinger{&etcdErr}}
+	db.check()
+
+	svc, _ := testService(0)
+	sup := newSupervisor(false)
+	sup.Start(svc)
+	defer sup.Stop(time.Second)
+
+	cfg := &Config{hostname: "core1", loaded: time.Now(), dnsForwarders: []string{"192.0.2.1:53", "192.0.2.2:53"}}
+	forwarderErrs := map[string]error{"192.0.2.1:53": errors.New("timeout")}
+	server := httptest.NewServer(healthServer{cfg: cfg, sup: sup, db: db, lookup: func(server string) error {
+		return forwarderErrs[server]
+	}})
+	defer server.Close()
+
+	get := func(path string) (int, map[string]bool) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Checks []HealthCheck `json:"checks"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		checks := make(map[string]bool)
+		for _, check := range body.Checks {
+			checks[check.Name] = check.OK
+		}
+		return resp.StatusCode, checks
+	}
+
+	// One forwarder answering is enough
+	if status, checks := get("/readyz"); status != http.StatusOK || !checks["service/test"] || !checks["etcd"] || !checks["forwarders"] {
+		t.Errorf("expected to be ready, got %d %v", status, checks)
+	}
+
+	forwarderErrs["192.0.2.2:53"] = errors.New("refused")
+	if status, checks := get("/readyz"); status != http.StatusServiceUnavailable || checks["forwarders"] {
+		t.Errorf("expected not to be ready without forwarders, got %d %v", status, checks)
+	}
+
+	etcdErr = errors.New("connection refused")
+	db.check()
+	if db.Reachable() {
+		t.Error("expected etcd to be unreachable")
+	}
+	if status, checks := get("/healthz"); status != http.StatusOK || checks["etcd"] {
+		t.Errorf("expected to be alive without etcd, got %d %v", status, checks)
+	}
+
+	sup.setStatus("test", "restarting", errors.New("address in use"))
+	if status, _ := get("/healthz"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected not to be alive while a service is down, got %d", status)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var logFormat = flag.String("logFormat", "logfmt", "Log output format: logfmt or json.")
+var logLevel = flag.String("logLevel", "", "Log levels such as \"info\" or \"warn,dhcp=debug\", for every subsystem or just one (debug, info, warn or error). Overrides the loglevel setting.")
+
+// logSubsystems lists the parts of netcore whose log levels can be set apart
+var logSubsystems = []string{"main", "config", "etcd", "dhcp", "dns", "api"}
+
+// defaultLogLevel applies to any subsystem that hasn't been given a level
+const defaultLogLevel = "info"
+
+var (
+	logLevels = make(map[string]*slog.LevelVar)
+
+	mainLog   = newSubsystemLogger("main")
+	configLog = newSubsystemLogger("config")
+	etcdLog   = newSubsystemLogger("etcd")
+	dhcpLog   = newSubsystemLogger("dhcp")
+	dnsLog    = newSubsystemLogger("dns")
+	apiLog    = newSubsystemLogger("api")
+)
+
+// logOutput is the handler that every subsystem logger writes through once its
+// level has been checked. It starts out as logfmt on stderr.
+var logOutput = struct {
+	sync.RWMutex
+	handler slog.Handler
+}{handler: newLogHandler(os.Stderr, "logfmt")}
+
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	options := &slog.HandlerOptions{Level: slog.LevelDebug} // the subsystem levels do the filtering
+	if format == "json" {
+		return slog.NewJSONHandler(w, options)
+	}
+	return slog.NewTextHandler(w, options)
+}
+
+// setupLogging sends log output to w in the given format ("logfmt" or "json")
+// and also routes anything written with the standard log package through it
+func setupLogging(w io.Writer, format string) error {
+	if format != "logfmt" && format != "json" {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	logOutput.Lock()
+	logOutput.handler = newLogHandler(w, format)
+	logOutput.Unlock()
+	log.SetFlags(0)
+	log.SetOutput(logWriter{mainLog})
+	return nil
+}
+
+// newSubsystemLogger returns a logger that tags every entry with the subsystem
+// and drops anything below the subsystem's level
+func newSubsystemLogger(subsystem string) *slog.Logger {
+	level := new(slog.LevelVar)
+	level.Set(slog.LevelInfo)
+	logLevels[subsystem] = level
+	return slog.New(subsystemHandler{level: level}).With("subsystem", subsystem)
+}
+
+// subsystemHandler checks the level of one subsystem before passing entries on
+// to logOutput
+type subsystemHandler struct {
+	level *slog.LevelVar
+	wrap  []func(slog.Handler) slog.Handler // With and WithGroup calls, in order
+}
+
+func (h subsystemHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h subsystemHandler) Handle(ctx context.Context, record slog.Record) error {
+	logOutput.RLock()
+	handler := logOutput.handler
+	logOutput.RUnlock()
+	for _, wrap := range h.wrap {
+		handler = wrap(handler)
+	}
+	return handler.Handle(ctx, record)
+}
+
+func (h subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+func (h subsystemHandler) with(wrap func(slog.Handler) slog.Handler) slog.Handler {
+	next := subsystemHandler{level: h.level, wrap: make([]func(slog.Handler) slog.Handler, 0, len(h.wrap)+1)}
+	next.wrap = append(append(next.wrap, h.wrap...), wrap)
+	return next
+}
+
+// logWriter turns lines written with the standard log package, such as those
+// from the libraries we use, into entries at info level
+type logWriter struct {
+	logger *slog.Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// parseLogLevels reads levels such as "warn,dhcp=debug", where a level on its
+// own applies to every subsystem that isn't named. Every subsystem is
+// included in the result.
+func parseLogLevels(spec string) (map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level)
+	fallback := defaultLogLevel
+	named := make(map[string]string)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if i := strings.Index(part, "="); i >= 0 {
+			subsystem := strings.TrimSpace(part[:i])
+			if _, ok := logLevels[subsystem]; !ok {
+				return nil, fmt.Errorf("unknown log subsystem %q", subsystem)
+			}
+			named[subsystem] = strings.TrimSpace(part[i+1:])
+		} else {
+			fallback = part
+		}
+	}
+	for _, subsystem := range logSubsystems {
+		name := fallback
+		if n, ok := named[subsystem]; ok {
+			name = n
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return nil, fmt.Errorf("unknown log level %q", name)
+		}
+		levels[subsystem] = level
+	}
+	return levels, nil
+}
+
+// setLogLevels changes the level of every subsystem as given by spec (see
+// parseLogLevels), or leaves them all alone if spec can't be understood
+func setLogLevels(spec string) error {
+	levels, err := parseLogLevels(spec)
+	if err != nil {
+		return err
+	}
+	for subsystem, level := range levels {
+		logLevels[subsystem].Set(level)
+	}
+	return nil
+}
+
+// currentLogLevels describes the level of every subsystem in the form taken by
+// setLogLevels
+func currentLogLevels() string {
+	var parts []string
+	for _, subsystem := range logSubsystems {
+		parts = append(parts, subsystem+"="+strings.ToLower(logLevels[subsystem].Level().String()))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// applyLogLevels sets the log levels from the -logLevel flag if it was given,
+// or otherwise from the loglevel setting in cfg
+func applyLogLevels(cfg *Config) {
+	spec := *logLevel
+	if spec == "" {
+		spec = cfg.LogLevel()
+	}
+	if err := setLogLevels(spec); err != nil {
+		configLog.Warn("log levels not changed", "levels", spec, "err", err)
+		return
+	}
+	configLog.Debug("log levels set", "levels", currentLogLevels())
+}
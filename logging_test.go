@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogLevelsAndFormat(t *testing.T) {
+	var out bytes.Buffer
+	if err := setupLogging(&out, "json"); err != nil {
+		t.Fatal(err)
+	}
+	defer setupLogging(os.Stderr, "logfmt")
+	defer setLogLevels(defaultLogLevel)
+
+	if err := setLogLevels("warn,dhcp=debug"); err != nil {
+		t.Fatal(err)
+	}
+	if levels := currentLogLevels(); levels != "api=warn,config=warn,dhcp=debug,dns=warn,etcd=warn,main=warn" {
+		t.Errorf("unexpected levels: %s", levels)
+	}
+	dnsLog.Info("answered", "qname", "example.com.", "rcode", "NOERROR")
+	dhcpLog.Debug("offer from pool", "mac", "00:11:22:33:44:55", "ip", "10.0.0.10")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected just the DHCP entry, got:\n%s", out.String())
+	}
+	var entry map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["subsystem"] != "dhcp" || entry["level"] != "DEBUG" || entry["mac"] != "00:11:22:33:44:55" || entry["ip"] != "10.0.0.10" {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+
+	for _, spec := range []string{"loud", "smtp=debug", "dns=verbose"} {
+		if err := setLogLevels(spec); err == nil {
+			t.Errorf("expected %q to be refused", spec)
+		}
+	}
+	if levels := currentLogLevels(); !strings.Contains(levels, "dhcp=debug") {
+		t.Errorf("expected bad levels to leave the old ones alone, got %s", levels)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// MemDB is a DB that keeps everything in memory. It is suitable for tests and
+// for single-box deployments where nothing needs to be shared between sites.
+// Nothing is persisted, so all configuration, leases and records are lost when
+// the process exits.
+type MemDB struct {
+	mu             sync.Mutex
+	config         map[string]string
+	configWatchers []chan string
+	ips            map[string]*memIPEntry
+	macs           map[string]*memMACEntry
+	dns            map[string]*memRRSet
+	dnsIndex       uint64           // counts DNS writes, like etcd's modification index
+	owner          string           // recorded against every DNS value we register
+	now            func() time.Time // replaceable clock for expiry
+	dnsWatchers    []*memDNSWatcher
+	notifyClaims   map[string]*time.Time // when each claim to send NOTIFY expires
+}
+
+func NewMemDB() *MemDB {
+	owner, _ := getNetcoreName() // ownership is informational, so don't fail over it
+	return &MemDB{
+		config:       make(map[string]string),
+		ips:          make(map[string]*memIPEntry),
+		macs:         make(map[string]*memMACEntry),
+		dns:          make(map[string]*memRRSet),
+		notifyClaims: make(map[string]*time.Time),
+		owner:        owner,
+		now:          time.Now,
+	}
+}
+
+// memExpiration returns the expiration time for a value that should live for
+// ttl seconds, or nil if ttl is zero and the value should never expire
+func (db *MemDB) memExpiration(ttl uint64) *time.Time {
+	if ttl == 0 {
+		return nil
+	}
+	expiration := db.now().Add(time.Duration(ttl) * time.Second)
+	return &expiration
+}
+
+// memExpired returns true if the given expiration has passed
+func (db *MemDB) memExpired(expiration *time.Time) bool {
+	return expiration != nil && !expiration.After(db.now())
+}
+
+// memRemaining returns the number of whole seconds left until expiration
+func (db *MemDB) memRemaining(expiration *time.Time) int64 {
+	if expiration == nil {
+		return 0
+	}
+	return int64(expiration.Sub(db.now()).Seconds() + 0.5)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsAddr = flag.String("metrics", "", "Address to serve Prometheus metrics on at /metrics, such as \":9153\" (or empty to disable them).")
+
+var (
+	dhcpMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "netcore",
+		Subsystem: "dhcp",
+		Name:      "messages_total",
+		Help:      "DHCP messages received, by message type and outcome (offer, ack, nak, exhausted, denied, ignored, unavailable or error).",
+	}, []string{"type", "outcome"})
+
+	dnsQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "netcore",
+		Subsystem: "dns",
+		Name:      "queries_total",
+		Help:      "DNS questions answered, by query type and response code.",
+	}, []string{"type", "rcode"})
+
+	dnsCacheLookups = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "netcore",
+		Subsystem: "dns",
+		Name:      "cache_lookups_total",
+		Help:      "DNS questions looked up in the cache.",
+	})
+
+	dnsCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "netcore",
+		Subsystem: "dns",
+		Name:      "cache_misses_total",
+		Help:      "DNS questions that weren't in the cache and had to be answered from etcd or the forwarders.",
+	})
+
+	dnsForwarderDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "netcore",
+		Subsystem: "dns",
+		Name:      "forwarder_duration_seconds",
+		Help:      "Time taken by each forwarder to answer, including failed attempts.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"forwarder"})
+
+	dnsForwarderErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "netcore",
+		Subsystem: "dns",
+		Name:      "forwarder_errors_total",
+		Help:      "Questions that a forwarder failed to answer.",
+	}, []string{"forwarder"})
+
+	etcdDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "netcore",
+		Subsystem: "etcd",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken by etcd requests, by operation. Watches are not included.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(dhcpMessages, dnsQueries, dnsCacheLookups, dnsCacheMisses, dnsForwarderDuration, dnsForwarderErrors, etcdDuration)
+}
+
+// metricsSetup serves the metrics on addr, including the pool utilization of
+// every zone, which is worked out whenever the metrics are collected
+func metricsSetup(cfg *Config, addr string) service {
+	prometheus.MustRegister(dhcpPoolCollector{db: cfg.db})
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return httpService("metrics", addr, mux)
+}
+
+var (
+	dhcpPoolSizeDesc = prometheus.NewDesc("netcore_dhcp_pool_addresses", "Addresses in the zone's DHCP pool.", []string{"zone"}, nil)
+	dhcpPoolUsedDesc = prometheus.NewDesc("netcore_dhcp_pool_leased_addresses", "Addresses in the zone's DHCP pool that are leased or reserved.", []string{"zone"}, nil)
+)
+
+// dhcpPoolCollector reports how full the DHCP pool of every zone is
+type dhcpPoolCollector struct {
+	db DB
+}
+
+func (c dhcpPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dhcpPoolSizeDesc
+	ch <- dhcpPoolUsedDesc
+}
+
+func (c dhcpPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	pools, err := dhcpPoolUsage(c.db)
+	if err != nil {
+		dhcpLog.Warn("pool usage unavailable for metrics", "err", err)
+		return
+	}
+	for _, pool := range pools {
+		ch <- prometheus.MustNewConstMetric(dhcpPoolSizeDesc, prometheus.GaugeValue, float64(pool.Size), pool.Zone)
+		ch <- prometheus.MustNewConstMetric(dhcpPoolUsedDesc, prometheus.GaugeValue, float64(pool.Leased), pool.Zone)
+	}
+}
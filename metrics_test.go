@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDHCPPoolUsage(t *testing.T) {
+	db := NewMemDB()
+	for _, command := range []string{
+		"zone create office subnet=10.0.0.0/24 gateway=10.0.0.1 dhcpsubnet=10.0.0.128/28",
+		"zone create branch subnet=10.1.0.0/24 gateway=10.1.0.1",
+		"zone create lab subnet=10.2.0.0/24 gateway=10.2.0.1 dhcpsubnet=10.2.0.192/27",
+		"reservation create 00:11:22:33:44:55 10.0.0.130",
+		"lease create 00:11:22:33:44:66 10.0.0.131",
+		"lease create 00:11:22:33:44:77 10.0.0.20", // outside the pool
+	} {
+		if _, err := runAdminCommand(t, db, command); err != nil {
+			t.Fatalf("%s: %s", command, err)
+		}
+	}
+
+	pools, err := dhcpPoolUsage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 2 {
+		t.Fatalf("expected the two zones with pools, got %+v", pools)
+	}
+	if pools[0].Zone != "lab" || pools[0].Size != 31 || pools[0].Leased != 0 {
+		t.Errorf("unexpected usage for lab: %+v", pools[0])
+	}
+	if pools[1].Zone != "office" || pools[1].Size != 15 || pools[1].Leased != 2 {
+		t.Errorf("unexpected usage for office: %+v", pools[1])
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// etcdV2Trees are the top level trees that belong to netcore in etcd
+var etcdV2Trees = []string{"config", "dhcp", "dns"}
+
+// migrateEtcdV2ToV3 copies the netcore trees from the etcd v2 keys API into
+// the flat key layout used by EtcdV3DB and returns the number of keys copied.
+// Keys with a TTL in v2, or that live in a directory with a TTL, are attached
+// to a v3 lease with the same remaining TTL, or the shortest of them, as the
+// key goes with its directory in v2. Existing v3 keys are overwritten.
+func migrateEtcdV2ToV3(from EtcdDB, to EtcdV3DB) (int, error) {
+	m := etcdMigration{to: to, leases: make(map[int64]clientv3.LeaseID)}
+	for _, tree := range etcdV2Trees {
+		response, err := from.client.Get(tree, true, true)
+		if etcdKeyNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return m.count, err
+		}
+		if err := m.copyNode(response.Node, 0); err != nil {
+			return m.count, err
+		}
+	}
+	return m.count, nil
+}
+
+type etcdMigration struct {
+	to     EtcdV3DB
+	leases map[int64]clientv3.LeaseID // shared between keys with the same TTL
+	count  int
+}
+
+func (m *etcdMigration) copyNode(node *etcd.Node, ttl int64) error {
+	if node.TTL > 0 && (ttl == 0 || node.TTL < ttl) {
+		ttl = node.TTL // a key in a directory goes when the directory does
+	}
+
+	if node.Dir {
+		for _, child := range node.Nodes {
+			if err := m.copyNode(child, ttl); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var opts []clientv3.OpOption
+	if ttl > 0 {
+		lease, ok := m.leases[ttl]
+		if !ok {
+			var err error
+			lease, err = m.to.grant(uint64(ttl))
+			if err != nil {
+				return err
+			}
+			m.leases[ttl] = lease
+		}
+		opts = leaseOptions(lease)
+	}
+
+	ctx, cancel := etcdV3Context()
+	defer cancel()
+	_, err := m.to.client.Put(ctx, node.Key, node.Value, opts...)
+	if err != nil {
+		return err
+	}
+	m.count++
+	return nil
+}
@@ -2,18 +2,34 @@ package main
 
 import (
 	"flag"
-	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
 var etcdServers = flag.String("etcd", "", "Comma-separated list of etcd servers.")
+var etcd3Endpoints = flag.String("etcd3", "", "Comma-separated list of etcd v3 endpoints.")
+var backend = flag.String("backend", "etcd", "Storage backend to use: etcd (v2 API), etcd3 (v3 API) or memory (nothing is shared or persisted).")
+var migrate = flag.Bool("migrate", false, "Copy the config, dhcp and dns trees from etcd (v2 API) into etcd3 (v3 API) and exit.")
+var check = flag.Bool("check", false, "Load and validate the config for this host (see -name), report any problems and exit without starting anything.")
+var showEffectiveConfig = flag.Bool("showConfig", false, "Print the effective config for this host (see -name) and where each value came from, then exit.")
+var memoryConfig = flag.String("memoryConfig", "", "File of \"key = value\" config lines to load into the memory backend.")
 
-func init() {
+func main() {
 	flag.Parse()
-}
 
-func main() {
+	if err := setupLogging(os.Stderr, *logFormat); err != nil {
+		mainLog.Error("logging setup failed", "err", err)
+		os.Exit(1)
+	}
+	if *logLevel != "" {
+		if err := setLogLevels(*logLevel); err != nil {
+			mainLog.Error("logging setup failed", "err", err)
+			os.Exit(1)
+		}
+	}
+
 	if len(*etcdServers) == 0 {
 		if len(os.Getenv("ETCD_PORT")) > 0 {
 			*etcdServers = strings.Replace(os.Getenv("ETCD_PORT"), "tcp://", "http://", 1)
@@ -21,38 +37,147 @@ func main() {
 			*etcdServers = "etcd" // just some default hostname that Docker or otherwise might use
 		}
 	}
-	db := NewEtcdDB(*etcdServers)
+	if len(*etcd3Endpoints) == 0 {
+		*etcd3Endpoints = "etcd:2379" // the same default host on the v3 client port
+	}
+
+	if *migrate {
+		v3, err := NewEtcdV3DB(*etcd3Endpoints)
+		if err != nil {
+			mainLog.Error("migration failed", "err", err)
+			os.Exit(1)
+		}
+		count, err := migrateEtcdV2ToV3(NewEtcdDB(*etcdServers).(EtcdDB), v3.(EtcdV3DB))
+		mainLog.Info("migrated keys from etcd v2 to v3", "keys", count)
+		if err != nil {
+			mainLog.Error("migration failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var db DB
+	switch *backend {
+	case "etcd":
+		db = NewEtcdDB(*etcdServers)
+	case "etcd3":
+		var err error
+		db, err = NewEtcdV3DB(*etcd3Endpoints)
+		if err != nil {
+			mainLog.Error("configuration failed", "err", err)
+			os.Exit(1)
+		}
+	case "memory":
+		mem := NewMemDB()
+		if *memoryConfig != "" {
+			f, err := os.Open(*memoryConfig)
+			if err != nil {
+				mainLog.Error("configuration failed", "err", err)
+				os.Exit(1)
+			}
+			err = mem.LoadConfig(f)
+			f.Close()
+			if err != nil {
+				mainLog.Error("configuration failed", "err", err)
+				os.Exit(1)
+			}
+		}
+		db = mem
+	default:
+		mainLog.Error("unknown backend", "backend", *backend)
+		os.Exit(1)
+	}
+
+	if flag.NArg() > 0 {
+		os.Exit(adminMain(db, flag.Args()))
+	}
+	if *check {
+		os.Exit(checkConfig(db))
+	}
+	if *showEffectiveConfig {
+		os.Exit(showConfig(db))
+	}
+
+	if store, ok := db.(configStore); ok {
+		if err := writeConfigOverrides(store); err != nil {
+			mainLog.Error("configuration failed", "err", err)
+			os.Exit(1)
+		}
+	}
 
-	log.Println("PRECONFIG")
 	cfg, err := db.GetConfig()
-	log.Println("POSTCONFIG")
 
 	if err != nil {
-		log.Printf("Configuration failed: %s\n", err)
+		mainLog.Error("configuration failed", "err", err)
 		os.Exit(1)
 	}
 
-	var dhcpExit chan error
+	applyLogLevels(cfg)
+	cfg.OnChange(func() { applyLogLevels(cfg) })
+	stopWatching := make(chan struct{})
+	go watchConfig(cfg, stopWatching)
+	health := newDBHealth(db)
+	go health.run(stopWatching)
+
+	var services []service
 	if cfg.DHCPIP() == nil {
-		log.Println("DHCP service is disabled; this machine does not have a DHCP IP assigned.")
+		mainLog.Info("DHCP service is disabled; this machine does not have a DHCP IP assigned")
 	} else if cfg.DHCPSubnet() == nil {
-		log.Println("DHCP service is disabled; this machine's zone does not have a DHCP subnet assigned.")
+		mainLog.Info("DHCP service is disabled; this machine's zone does not have a DHCP subnet assigned")
 	} else if cfg.DHCPNIC() == "" {
-		log.Println("DHCP service is disabled; this machine does not have a DHCP NIC assigned.")
+		mainLog.Info("DHCP service is disabled; this machine does not have a DHCP NIC assigned")
 	} else {
-		dhcpExit = dhcpSetup(cfg)
+		services = append(services, dhcpSetup(cfg, health))
+	}
+
+	secondary := newDNSSecondary(cfg)
+	services = append(services, dnsSetup(cfg, secondary), secondarySetup(secondary))
+	if watcher, ok := db.(DNSWatcher); ok {
+		services = append(services, notifySetup(cfg, watcher))
+	}
+	if keeper, ok := db.(SerialKeeper); ok {
+		services = append(services, serialSetup(keeper))
+	}
+
+	if *apiAddr != "" {
+		api, err := apiSetup(cfg, *apiAddr, *apiToken)
+		if err != nil {
+			mainLog.Error("API failed", "err", err)
+			os.Exit(1)
+		}
+		services = append(services, api)
+	}
+
+	if *metricsAddr != "" {
+		services = append(services, metricsSetup(cfg, *metricsAddr))
+	}
+
+	sup := newSupervisor(*restartServices)
+	if *healthAddr != "" {
+		services = append(services, healthSetup(cfg, sup, health, *healthAddr))
 	}
 
-	dnsExit := dnsSetup(cfg)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
 
-	log.Println("NETCORE Started.")
+	sup.Start(services...)
+	sdNotify("READY=1")
+	mainLog.Info("started", "host", cfg.Hostname(), "zone", cfg.Zone())
 
+	status := 0
 	select {
-	case err := <-dhcpExit:
-		log.Printf("DHCP Exited: %s\n", err)
-		os.Exit(1)
-	case err := <-dnsExit:
-		log.Printf("DNS Exited: %s\n", err)
-		os.Exit(1)
+	case sig := <-signals:
+		mainLog.Info("shutting down", "signal", sig.String())
+	case <-sup.Failed():
+		status = 1 // already logged by the supervisor
+	}
+
+	sdNotify("STOPPING=1")
+	close(stopWatching)
+	if err := sup.Stop(shutdownTimeout); err != nil {
+		mainLog.Error("shutdown failed", "err", err)
+		status = 1
 	}
+	mainLog.Info("stopped")
+	os.Exit(status)
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const poolCheckInterval = time.Minute // FIXME: put this in a config
+
+const poolAlertInterval = time.Hour // FIXME: put this in a config
+
+// poolLevel is how worried we are about how full a DHCP pool is
+type poolLevel int
+
+const (
+	poolOK poolLevel = iota
+	poolWarning
+	poolCritical
+)
+
+func (l poolLevel) String() string {
+	switch l {
+	case poolWarning:
+		return "warning"
+	case poolCritical:
+		return "critical"
+	}
+	return "ok"
+}
+
+// poolAlerter emails an alert when this server's DHCP pool fills past the
+// dhcppoolwarn or dhcppoolcritical level, and a recovery notice once it drops
+// back below them. Apart from escalations to critical, at most one message is
+// sent per poolAlertInterval so that a pool hovering around a level doesn't
+// flood anyone's inbox; a change that is held back is sent once the interval
+// has passed if it still applies.
+type poolAlerter struct {
+	cfg      *Config
+	send     func(subject string, body string) error
+	now      func() time.Time
+	check    chan struct{}
+	level    poolLevel // the level that was last notified
+	lastSent time.Time
+}
+
+func newPoolAlerter(cfg *Config) *poolAlerter {
+	a := &poolAlerter{
+		cfg:   cfg,
+		now:   time.Now,
+		check: make(chan struct{}, 1),
+	}
+	a.send = func(subject string, body string) error {
+		return sendMail(cfg.AlertSMTP(), cfg.AlertFrom(), cfg.AlertTo(), subject, body)
+	}
+	return a
+}
+
+// Check asks for the pool to be checked straight away, without waiting for it
+func (a *poolAlerter) Check() {
+	select {
+	case a.check <- struct{}{}:
+	default: // a check is already due
+	}
+}
+
+// run checks the pool every poolCheckInterval and whenever Check is called,
+// until stop is closed
+func (a *poolAlerter) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(poolCheckInterval)
+	defer ticker.Stop()
+	for {
+		a.checkPool()
+		select {
+		case <-ticker.C:
+		case <-a.check:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (a *poolAlerter) checkPool() {
+	pool := a.cfg.DHCPSubnet()
+	if a.cfg.AlertSMTP() == "" || pool == nil {
+		return
+	}
+	leases, err := a.cfg.db.ListLeases()
+	if err != nil {
+		dhcpLog.Warn("pool check failed", "err", err)
+		return
+	}
+	a.notify(countPoolUsage(a.cfg.Zone(), pool, leases))
+}
+
+// notify sends whatever message is called for by usage
+func (a *poolAlerter) notify(usage PoolUsage) {
+	warn, critical := a.cfg.DHCPPoolWarn(), a.cfg.DHCPPoolCritical()
+	level := poolOK
+	if percent := usage.Percent(); percent >= critical {
+		level = poolCritical
+	} else if percent >= warn {
+		level = poolWarning
+	}
+	if level == a.level {
+		return
+	}
+	now := a.now()
+	if level != poolCritical && !a.lastSent.IsZero() && now.Sub(a.lastSent) < poolAlertInterval {
+		return // try again once the interval is up
+	}
+
+	var subject string
+	if level == poolOK {
+		subject = fmt.Sprintf("netcore: DHCP pool for zone %s has recovered (%d%% full)", usage.Zone, usage.Percent())
+	} else {
+		subject = fmt.Sprintf("netcore: DHCP pool for zone %s is %d%% full (%s)", usage.Zone, usage.Percent(), level)
+	}
+	body := fmt.Sprintf("The DHCP pool %s for zone %s has %d of its %d addresses leased or reserved (%d%%).\n"+
+		"Alerts are sent at %d%% (warning) and %d%% (critical).\n\n"+
+		"Sent by netcore on %s.\n",
+		usage.Pool, usage.Zone, usage.Leased, usage.Size, usage.Percent(), warn, critical, a.cfg.Hostname())
+	if err := a.send(subject, body); err != nil {
+		dhcpLog.Error("pool alert failed to send", "zone", usage.Zone, "err", err)
+		return
+	}
+	dhcpLog.Info("pool alert sent", "zone", usage.Zone, "level", level.String(), "percent", usage.Percent())
+	a.level = level
+	a.lastSent = now
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoolAlerts(t *testing.T) {
+	cfg := &Config{hostname: "core1", dhcpPoolWarn: 85, dhcpPoolCritical: 100}
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	var sent []string
+	a := newPoolAlerter(cfg)
+	a.now = func() time.Time { return now }
+	a.send = func(subject string, body string) error {
+		sent = append(sent, subject)
+		return nil
+	}
+
+	_, pool, _ := net.ParseCIDR("10.0.0.0/28")
+	usage := func(leased int) PoolUsage {
+		return PoolUsage{Zone: "office", Pool: pool, Size: 15, Leased: leased}
+	}
+	for _, step := range []struct {
+		leased  int
+		elapsed time.Duration
+		expect  string
+	}{
+		{leased: 5, expect: ""},
+		{leased: 13, expect: "is 86% full (warning)"},
+		{leased: 12, elapsed: time.Minute, expect: ""},           // recovered, but too soon to say so
+		{leased: 13, elapsed: time.Minute, expect: ""},           // back to where it was
+		{leased: 15, elapsed: time.Minute, expect: "(critical)"}, // escalations aren't held back
+		{leased: 3, elapsed: time.Minute, expect: ""},
+		{leased: 3, elapsed: time.Hour, expect: "has recovered (20% full)"},
+	} {
+		now = now.Add(step.elapsed)
+		sent = nil
+		a.notify(usage(step.leased))
+		if step.expect == "" && len(sent) != 0 {
+			t.Errorf("%d leased: expected nothing to be sent, got %q", step.leased, sent)
+		}
+		if step.expect != "" && (len(sent) != 1 || !strings.Contains(sent[0], step.expect)) {
+			t.Errorf("%d leased: expected %q to be sent, got %q", step.leased, step.expect, sent)
+		}
+	}
+}
+
+func TestPoolAlertsStop(t *testing.T) {
+	a := newPoolAlerter(&Config{hostname: "core1"})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		a.run(stop)
+		close(done)
+	}()
+	a.Check()
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("expected the pool checks to stop")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var restartServices = flag.Bool("restart", false, "Restart a service that fails, with backoff, instead of exiting.")
+
+const (
+	restartMinBackoff = time.Second
+	restartMaxBackoff = time.Minute
+	restartResetAfter = 5 * time.Minute // a service that ran this long starts over at the minimum backoff
+)
+
+// shutdownTimeout bounds how long in-flight work is given to finish when
+// shutting down
+const shutdownTimeout = 10 * time.Second // FIXME: put this in a config
+
+// ErrShutdownTimeout is returned when services don't stop within shutdownTimeout
+var ErrShutdownTimeout = errors.New("Services took too long to stop.")
+
+// service is a long-running part of netcore, such as the DHCP or DNS server.
+// run serves until the service fails or is stopped, calling ready once it is
+// able to answer. stop makes it stop answering and waits for any work in
+// flight, such as etcd writes, to finish; run might not return if the
+// underlying listener can't be closed.
+type service struct {
+	name string
+	run  func(ready func()) error
+	stop func()
+}
+
+// supervisor runs services, restarting any that fail if restart is set
+type supervisor struct {
+	restart  bool
+	services []service
+	failed   chan error // a service failed and won't be restarted
+	stopping chan struct{}
+	wg       sync.WaitGroup
+	lock     sync.Mutex
+	status   map[string]ServiceStatus
+}
+
+// ServiceStatus is the state of one service: starting, running, restarting,
+// failed or stopped, with the error it last failed with
+type ServiceStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+func newSupervisor(restart bool) *supervisor {
+	return &supervisor{
+		restart:  restart,
+		failed:   make(chan error, 1),
+		stopping: make(chan struct{}),
+		status:   make(map[string]ServiceStatus),
+	}
+}
+
+// Status returns the state of every service, in the order they were started
+func (s *supervisor) Status() []ServiceStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var status []ServiceStatus
+	for _, svc := range s.services {
+		status = append(status, s.status[svc.name])
+	}
+	return status
+}
+
+func (s *supervisor) setStatus(name string, state string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := ServiceStatus{Name: name, State: state}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	s.status[name] = status
+}
+
+// Start runs every service and waits until each of them is ready or has
+// failed the first time
+func (s *supervisor) Start(services ...service) {
+	var ready sync.WaitGroup
+	for _, svc := range services {
+		s.lock.Lock()
+		s.services = append(s.services, svc)
+		s.lock.Unlock()
+		s.setStatus(svc.name, "starting", nil)
+		ready.Add(1)
+		s.wg.Add(1)
+		go s.supervise(svc, ready.Done)
+	}
+	ready.Wait()
+}
+
+// Failed reports a service that failed and wasn't restarted
+func (s *supervisor) Failed() <-chan error {
+	return s.failed
+}
+
+func (s *supervisor) supervise(svc service, ready func()) {
+	defer s.wg.Done()
+	var once sync.Once
+	readyOnce := func() { once.Do(ready) }
+	defer readyOnce() // in case it failed before it was ready
+
+	running := func() {
+		s.setStatus(svc.name, "running", nil)
+		readyOnce()
+	}
+
+	backoff := restartMinBackoff
+	for {
+		started := time.Now()
+		err := svc.run(running)
+		select {
+		case <-s.stopping:
+			return
+		default:
+		}
+		if err == nil {
+			err = errors.New("stopped unexpectedly")
+		}
+		mainLog.Error("service failed", "service", svc.name, "err", err)
+		if !s.restart {
+			s.setStatus(svc.name, "failed", err)
+			select {
+			case s.failed <- err:
+			default:
+			}
+			return
+		}
+		s.setStatus(svc.name, "restarting", err)
+		readyOnce() // don't hold up startup while retrying
+
+		if time.Since(started) > restartResetAfter {
+			backoff = restartMinBackoff
+		}
+		mainLog.Info("restarting service", "service", svc.name, "backoff", backoff.String())
+		sdNotify("STATUS=Restarting " + svc.name)
+		select {
+		case <-time.After(backoff):
+		case <-s.stopping:
+			return
+		}
+		if backoff *= 2; backoff > restartMaxBackoff {
+			backoff = restartMaxBackoff
+		}
+	}
+}
+
+// Stop stops every service, in the reverse of the order they were started,
+// and waits for them to finish what they were doing, for up to timeout
+func (s *supervisor) Stop(timeout time.Duration) error {
+	close(s.stopping)
+	done := make(chan struct{})
+	go func() {
+		for i := len(s.services) - 1; i >= 0; i-- {
+			mainLog.Info("stopping service", "service", s.services[i].name)
+			s.services[i].stop()
+			s.setStatus(s.services[i].name, "stopped", nil)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return ErrShutdownTimeout
+	}
+}
+
+// httpService serves handler on addr until it is stopped, when the requests
+// being answered are given shutdownTimeout to finish
+func httpService(name string, addr string, handler http.Handler) service {
+	server := &http.Server{Addr: addr, Handler: handler}
+	return service{
+		name: name,
+		run: func(ready func()) error {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			ready()
+			if err := server.Serve(listener); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		},
+		stop: func() {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			server.Shutdown(ctx)
+		},
+	}
+}
+
+// sdNotify tells systemd about our state, such as "READY=1", when we were
+// started by it as a Type=notify service. It does nothing otherwise.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testService fails the first few times it is run and then serves until it
+// is stopped
+func testService(failures int32) (service, *atomic.Int32) {
+	runs := new(atomic.Int32)
+	stop := make(chan struct{})
+	return service{
+		name: "test",
+		run: func(ready func()) error {
+			if runs.Add(1) <= failures {
+				return errors.New("failed to listen")
+			}
+			ready()
+			<-stop
+			return nil
+		},
+		stop: func() { close(stop) },
+	}, runs
+}
+
+func TestSupervisorFailure(t *testing.T) {
+	svc, runs := testService(1)
+	sup := newSupervisor(false)
+	sup.Start(svc)
+	select {
+	case err := <-sup.Failed():
+		if err == nil || err.Error() != "failed to listen" {
+			t.Errorf("unexpected failure: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the failure to be reported")
+	}
+	if runs.Load() != 1 {
+		t.Errorf("expected no restart, got %d runs", runs.Load())
+	}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	svc, runs := testService(1)
+	sup := newSupervisor(true)
+	started := time.Now()
+	sup.Start(svc)
+
+	deadline := time.Now().Add(restartMinBackoff + time.Second)
+	for runs.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runs.Load() != 2 {
+		t.Fatalf("expected a restart, got %d runs", runs.Load())
+	}
+	if elapsed := time.Since(started); elapsed < restartMinBackoff {
+		t.Errorf("restarted after %v, before the backoff", elapsed)
+	}
+	select {
+	case err := <-sup.Failed():
+		t.Errorf("unexpected failure: %v", err)
+	default:
+	}
+
+	if err := sup.Stop(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	sup.wg.Wait()
+}
@@ -1,5 +1,27 @@
 package main
 
+import (
+	"bytes"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// sendMail sends a plain text message through the SMTP relay at addr, which
+// is expected to accept mail from us without authenticating
+func sendMail(addr string, from string, to []string, subject string, body string) error {
+	// FIXME: support relays that want STARTTLS with authentication
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(addr, nil, from, to, []byte(msg.String()))
+}
+
 // import (
 // 	"bitbucket.org/chrj/smtpd"
 // 	"github.com/coreos/go-etcd/etcd"
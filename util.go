@@ -1,12 +1,17 @@
 package main
 
 import (
+	"flag"
+	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 
 	"code.google.com/p/go-uuid/uuid"
 )
 
+var netcoreName = flag.String("name", "", "Name this netcore instance is known by in the config (defaults to NETCORE_NAME, then ETCD_NAME, then the hostname).")
+
 func getHostname() (string, error) {
 	fqdn, err := exec.Command("hostname", "-f").Output()
 	if err != nil {
@@ -15,6 +20,27 @@ func getHostname() (string, error) {
 	return strings.TrimSpace(string(fqdn)), nil
 }
 
+// getNetcoreName returns the name this netcore instance is known by, which is
+// taken from the name flag, then NETCORE_NAME, then ETCD_NAME, then the
+// machine's hostname
+func getNetcoreName() (string, error) {
+	if *netcoreName != "" {
+		return *netcoreName, nil
+	}
+	if len(os.Getenv("NETCORE_NAME")) > 0 {
+		return os.Getenv("NETCORE_NAME"), nil
+	}
+	if len(os.Getenv("ETCD_NAME")) > 0 {
+		re := regexp.MustCompile(`^/([^/]+)/`)
+		hostnameParts := re.FindStringSubmatch(os.Getenv("ETCD_NAME"))
+		if len(hostnameParts) > 1 && len(hostnameParts[1]) > 0 {
+			return hostnameParts[1], nil
+		}
+		return "", nil
+	}
+	return getHostname()
+}
+
 func reverseSlice(in []string) []string {
 	out := make([]string, len(in))
 	for i := range in {